@@ -30,35 +30,19 @@ func main() {
 		os.Exit(1)
 	}
 
-	// --- Create the Database Pool ---
-	// Use the helper from the library to create a pool with suitable defaults.
-	dbPool, err := sqlitecrawshaw.NewCrawshawPool(*dbPath)
-	if err != nil {
-		slog.Error("failed to create database pool", "error", err)
-		os.Exit(1) // Exit if pool creation fails
-	}
-
-	// Defer closing the pool here, as main owns it now.
-	// This must happen *after* the server finishes.
-	defer func() {
-		slog.Info("Closing database pool...")
-		if err := dbPool.Close(); err != nil {
-			slog.Error("Error closing database pool", "error", err)
-		}
-	}()
-
-	// --- Initialize the Application ---
 	// --- Initialize the Application ---
+	// WithDbCrawshawPath opens and owns the pool, and closes it on shutdown.
+	// Use NewCrawshawPool and WithDbCrawshaw instead when the application
+	// shares the pool.
 	_, srv, err := restinpieces.New(
 		core.WithAgeKeyPath(*ageKeyPath),
-		sqlitecrawshaw.WithDbCrawshaw(dbPool),
+		sqlitecrawshaw.WithDbCrawshawPath(*dbPath),
 		restinpieces.WithCacheRistretto(),
 		restinpieces.WithTextLogger(nil),
 	)
 
 	if err != nil {
 		slog.Error("failed to initialize application", "error", err)
-		// Pool will be closed by the deferred function
 		os.Exit(1) // Exit if app initialization fails
 	}
 
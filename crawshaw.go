@@ -1,9 +1,17 @@
 package sqlitecrawshaw
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
+	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"github.com/caasmo/restinpieces/core"
 	"github.com/caasmo/restinpieces-sqlite-crawshaw/crawshaw"
@@ -16,10 +24,51 @@ func WithDbCrawshaw(pool *sqlitex.Pool) core.Option {
 		// Panic is reasonable here as it indicates a fundamental setup error.
 		panic(fmt.Sprintf("failed to initialize crawshaw DB with existing pool: %v", err))
 	}
+	if err := dbInstance.Migrate(); err != nil {
+		panic(fmt.Sprintf("failed to migrate crawshaw DB schema: %v", err))
+	}
 	// Use the renamed app database option
 	return core.WithDbApp(dbInstance)
 }
 
+// WithDbCrawshawPath configures the App to use the Crawshaw SQLite implementation
+// with a pool opened internally at dbPath with the NewCrawshawPool defaults.
+// Use it when the application does not share the pool. The Db owns the pool
+// and closes it on shutdown, see closeOnShutdown.
+func WithDbCrawshawPath(dbPath string) core.Option {
+	pool, err := NewCrawshawPool(dbPath)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open crawshaw pool: %v", err))
+	}
+	dbInstance, err := crawshaw.New(pool, crawshaw.WithOwnedPool())
+	if err != nil {
+		pool.Close()
+		panic(fmt.Sprintf("failed to initialize crawshaw DB: %v", err))
+	}
+	if err := dbInstance.Migrate(); err != nil {
+		dbInstance.Close()
+		panic(fmt.Sprintf("failed to migrate crawshaw DB schema: %v", err))
+	}
+	closeOnShutdown(dbInstance)
+	return core.WithDbApp(dbInstance)
+}
+
+// shutdownSignals are the signals on which the restinpieces server shuts down.
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGQUIT}
+
+// closeOnShutdown closes d, and the pool it owns, once a shutdown signal is
+// received. Options have no hook in the server's shutdown, which exits the
+// process right after it, so the Db is closed alongside the server's daemons
+// and HTTP servers: requests still draining then fail with crawshaw.ErrClosed.
+func closeOnShutdown(d *crawshaw.Db) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, shutdownSignals...)
+	go func() {
+		<-sig
+		signal.Stop(sig)
+		_ = d.Close()
+	}()
+}
 
 // If your application interacts directly with the database alongside restinpieces,
 // it's crucial to use a *single shared pool* to prevent database locking issues (SQLITE_BUSY errors).
@@ -28,20 +77,206 @@ func WithDbCrawshaw(pool *sqlitex.Pool) core.Option {
 // pool and then pass it to both restinpieces (via options like WithDbCrawshaw)
 // and your own application's database access layer.
 
+// PoolOption configures the connections of a pool created by NewCrawshawPool.
+type PoolOption func(*poolConfig)
+
+// poolConfig holds the per-connection settings collected from PoolOptions.
+type poolConfig struct {
+	pragmas []string
+	// connPragmas are run outside the init script, which sqlitex executes
+	// inside a savepoint: some pragmas cannot be changed in a transaction.
+	connPragmas []string
+}
+
+// initScript returns the script run on every connection of the pool.
+func (c *poolConfig) initScript() string {
+	return strings.Join(c.pragmas, "\n")
+}
+
+// applyConnPragmas runs the connPragmas on each of the poolSize connections,
+// holding them all at once so that every connection is visited.
+func (c *poolConfig) applyConnPragmas(pool *sqlitex.Pool, poolSize int) error {
+	if len(c.connPragmas) == 0 {
+		return nil
+	}
+
+	conns := make([]*sqlite.Conn, 0, poolSize)
+	defer func() {
+		for _, conn := range conns {
+			pool.Put(conn)
+		}
+	}()
+
+	for i := 0; i < poolSize; i++ {
+		conn := pool.Get(context.Background())
+		if conn == nil {
+			return fmt.Errorf("failed to get db connection for pragmas: connection is nil")
+		}
+		conns = append(conns, conn)
+
+		for _, pragma := range c.connPragmas {
+			if err := sqlitex.ExecTransient(conn, pragma, nil); err != nil {
+				return fmt.Errorf("failed to run %q: %w", pragma, err)
+			}
+		}
+	}
+	return nil
+}
+
+// WithWalAutocheckpoint sets PRAGMA wal_autocheckpoint=<pages> on every pooled
+// connection. SQLite checkpoints the WAL into the main database once it grows
+// past this many pages (default 1000).
+// A lower value keeps the WAL file small and reads fast, at the cost of more
+// frequent checkpoints stalling writers. A higher value batches more writes per
+// checkpoint, but lets the WAL grow larger under heavy write load.
+// A value <= 0 disables automatic checkpointing.
+func WithWalAutocheckpoint(pages int) PoolOption {
+	return func(c *poolConfig) {
+		c.pragmas = append(c.pragmas, fmt.Sprintf("PRAGMA wal_autocheckpoint=%d;", pages))
+	}
+}
+
+// WithSynchronousNormal sets PRAGMA synchronous=NORMAL on every pooled
+// connection. In WAL mode NORMAL only syncs the WAL at checkpoints instead of
+// on every commit, which greatly raises write throughput. The database stays
+// consistent after an application crash; a power loss or OS crash may roll
+// back the last transactions committed before it, but never corrupts the file.
+func WithSynchronousNormal() PoolOption {
+	return func(c *poolConfig) {
+		c.connPragmas = append(c.connPragmas, "PRAGMA synchronous=NORMAL;")
+	}
+}
+
 // NewCrawshawPool creates a new Crawshaw SQLite connection pool with reasonable defaults
 // compatible with restinpieces (e.g., WAL mode enabled).
 // Use this if your application needs to share the pool with restinpieces.
-func NewCrawshawPool(dbPath string) (*sqlitex.Pool, error) {
+func NewCrawshawPool(dbPath string, opts ...PoolOption) (*sqlitex.Pool, error) {
 	poolSize := runtime.NumCPU()
 	initString := fmt.Sprintf("file:%s", dbPath)
 
-	// sqlitex.Open with flags=0 defaults to:
+	cfg := &poolConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	// sqlitex.OpenInit with flags=0 defaults to:
 	// SQLITE_OPEN_READWRITE | SQLITE_OPEN_CREATE | SQLITE_OPEN_WAL |
 	// SQLITE_OPEN_URI | SQLITE_OPEN_NOMUTEX
-	pool, err := sqlitex.Open(initString, 0, poolSize)
+	pool, err := sqlitex.OpenInit(context.Background(), initString, 0, poolSize, cfg.initScript())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create default crawshaw pool at %s: %w", dbPath, err)
 	}
+	if err := cfg.applyConnPragmas(pool, poolSize); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to configure default crawshaw pool at %s: %w", dbPath, err)
+	}
 	return pool, nil
 }
 
+// NewCrawshawPoolReadOnly creates a pool like NewCrawshawPool whose connections
+// are opened with SQLITE_OPEN_READONLY, so any write fails at the engine level.
+// The database file must already exist. Use it with crawshaw.NewReadOnly for
+// reporting processes or read replicas.
+func NewCrawshawPoolReadOnly(dbPath string, opts ...PoolOption) (*sqlitex.Pool, error) {
+	poolSize := runtime.NumCPU()
+	initString := fmt.Sprintf("file:%s", dbPath)
+
+	cfg := &poolConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	// No SQLITE_OPEN_WAL: setting the journal mode needs a writable connection.
+	flags := sqlite.SQLITE_OPEN_READONLY | sqlite.SQLITE_OPEN_URI | sqlite.SQLITE_OPEN_NOMUTEX
+	pool, err := sqlitex.OpenInit(context.Background(), initString, flags, poolSize, cfg.initScript())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create read-only crawshaw pool at %s: %w", dbPath, err)
+	}
+	if err := cfg.applyConnPragmas(pool, poolSize); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to configure read-only crawshaw pool at %s: %w", dbPath, err)
+	}
+	return pool, nil
+}
+
+// NewCrawshawPoolVerified creates a pool like NewCrawshawPool and runs
+// PRAGMA quick_check on one of its connections before returning it.
+// A corrupt database file is then reported as a clear startup error instead of
+// a cryptic failure on the first query. The pool is closed if the check fails.
+func NewCrawshawPoolVerified(dbPath string, opts ...PoolOption) (*sqlitex.Pool, error) {
+	pool, err := NewCrawshawPool(dbPath, opts...)
+	if err != nil {
+		// Damage to the header can already fail the pragmas run on open.
+		var sqliteErr sqlite.Error
+		if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite.SQLITE_CORRUPT || sqliteErr.Code == sqlite.SQLITE_NOTADB) {
+			return nil, fmt.Errorf("database file %s is corrupt: %w", dbPath, err)
+		}
+		return nil, err
+	}
+
+	if err := quickCheck(pool); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("database file %s is corrupt: %w", dbPath, err)
+	}
+	return pool, nil
+}
+
+// quickCheck runs PRAGMA quick_check on a pooled connection. The pragma returns
+// a single "ok" row for a healthy database, or one row per problem found.
+func quickCheck(pool *sqlitex.Pool) error {
+	conn := pool.Get(context.Background())
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for quick_check: connection is nil")
+	}
+	defer pool.Put(conn)
+
+	var problems []string
+	err := sqlitex.Exec(conn, "PRAGMA quick_check;", func(stmt *sqlite.Stmt) error {
+		if msg := stmt.ColumnText(0); msg != "ok" {
+			problems = append(problems, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("quick_check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// warmPoolTimeout bounds the wait for each connection acquired by WarmPool.
+const warmPoolTimeout = time.Second
+
+// WarmPool acquires n connections of the pool at once and runs a trivial query
+// on each before releasing them. Although the pool opens its connections
+// upfront, every connection parses the schema lazily on its first statement;
+// warming them at startup moves that cost out of the first requests.
+// n must not exceed the pool size: an error is returned when a connection
+// cannot be acquired within warmPoolTimeout.
+func WarmPool(pool *sqlitex.Pool, n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), warmPoolTimeout)
+	defer cancel()
+
+	conns := make([]*sqlite.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			pool.Put(conn)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		conn := pool.Get(ctx)
+		if conn == nil {
+			return fmt.Errorf("failed to get db connection %d of %d for warmup: connection is nil", i+1, n)
+		}
+		conns = append(conns, conn)
+
+		// Reading sqlite_master forces the connection to load the schema.
+		if err := sqlitex.Exec(conn, "SELECT count(*) FROM sqlite_master;", nil); err != nil {
+			return fmt.Errorf("failed to warm db connection %d of %d: %w", i+1, n, err)
+		}
+	}
+	return nil
+}
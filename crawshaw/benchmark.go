@@ -1,33 +1,98 @@
 package crawshaw
 
 import (
+	"context"
+	"fmt"
+
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 )
 
 // TODO deprecated
 
-func (d *Db) GetById(id int64) int {
-	conn := d.pool.Get(nil)
+// GetById returns the value of the foo row with the given rowid, or
+// ErrNotFound. The ctx deadline bounds connection acquisition; without one
+// defaultTimeout applies.
+func (d *Db) GetById(ctx context.Context, id int64) (int, error) {
+	conn, cancel := d.getWithTimeout(ctx)
+	defer cancel()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for get by id: %w", d.connErr())
+	}
 	defer d.pool.Put(conn)
 
 	var value int
+	found := false
 	fn := func(stmt *sqlite.Stmt) error {
 		value = int(stmt.GetInt64("value"))
+		found = true
 		return nil
 	}
 
 	if err := sqlitex.Exec(conn, "select value from foo where rowid = ? limit 1", fn, any(id)); err != nil {
-		panic(err)
+		return 0, fmt.Errorf("failed to get foo %d: %w", id, err)
 	}
-	return value
+	if !found {
+		return 0, ErrNotFound
+	}
+	return value, nil
 }
 
-func (d *Db) InsertWithPool(value int64) {
-	conn := d.pool.Get(nil)
+// InsertWithPool inserts a foo row with the given id and value.
+//
+// Deprecated: it takes a connection and commits once per row. Use KVSetMany,
+// which batches the writes in a single transaction.
+// The ctx deadline bounds connection acquisition; without one defaultTimeout
+// applies.
+func (d *Db) InsertWithPool(ctx context.Context, id, value int64) error {
+	conn, cancel := d.getWithTimeout(ctx)
+	defer cancel()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for insert: %w", d.connErr())
+	}
 	defer d.pool.Put(conn)
 
-	if err := sqlitex.Exec(conn, "INSERT INTO foo(id, value) values(1000000,?)", nil, any(value)); err != nil {
-		panic(err)
+	if err := sqlitex.Exec(conn, "INSERT INTO foo(id, value) values(?,?)", nil, any(id), any(value)); err != nil {
+		return fmt.Errorf("failed to insert foo %d: %w", id, err)
+	}
+	return nil
+}
+
+// KVSetMany stores all pairs in the crawshaw_kv table, replacing the values of
+// existing keys. The pairs are written in a single transaction on one
+// connection: either all of them are stored or none is.
+func (d *Db) KVSetMany(pairs map[string][]byte) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for kv set many: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn, "BEGIN IMMEDIATE;", nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for kv set many: %w", err)
+	}
+
+	for key, value := range pairs {
+		err = d.exec(conn,
+			`INSERT INTO crawshaw_kv (key, value) VALUES (?, ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+			nil, key, value)
+		if err != nil {
+			err = fmt.Errorf("failed to set key %q: %w", key, err)
+			break
+		}
+	}
+	if err == nil {
+		err = d.exec(conn, "COMMIT;", nil)
+	}
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return fmt.Errorf("failed to set %d kv pairs: %w", len(pairs), err)
 	}
+	return nil
 }
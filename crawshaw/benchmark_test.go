@@ -0,0 +1,209 @@
+package crawshaw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/caasmo/restinpieces/db"
+)
+
+func TestBenchmarkMethodsReturnErrors(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	// The foo table does not exist in the test schema.
+	t.Run("missing table", func(t *testing.T) {
+		if err := testDB.InsertWithPool(context.Background(), 1, 42); err == nil {
+			t.Error("expected InsertWithPool error but got none")
+		}
+		if _, err := testDB.GetById(context.Background(), 1); err == nil {
+			t.Error("expected GetById error but got none")
+		}
+	})
+
+	conn := testDB.pool.Get(nil)
+	err := sqlitex.ExecScript(conn, "DROP TABLE IF EXISTS foo; CREATE TABLE foo (id INTEGER PRIMARY KEY, value INTEGER);")
+	testDB.pool.Put(conn)
+	if err != nil {
+		t.Fatalf("failed to create foo table: %v", err)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		if err := testDB.InsertWithPool(context.Background(), 7, 42); err != nil {
+			t.Fatalf("InsertWithPool failed: %v", err)
+		}
+		value, err := testDB.GetById(context.Background(), 7)
+		if err != nil {
+			t.Fatalf("GetById failed: %v", err)
+		}
+		if value != 42 {
+			t.Errorf("value mismatch: got %d, want %d", value, 42)
+		}
+	})
+
+	t.Run("missing row", func(t *testing.T) {
+		if _, err := testDB.GetById(context.Background(), 8); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+// kvValue reads the value of key from the crawshaw_kv table.
+func kvValue(t testing.TB, testDB *Db, key string) (string, bool) {
+	t.Helper()
+
+	conn := testDB.pool.Get(nil)
+	defer testDB.pool.Put(conn)
+
+	var (
+		value string
+		found bool
+	)
+	err := sqlitex.Exec(conn, "SELECT value FROM crawshaw_kv WHERE key = ?", func(stmt *sqlite.Stmt) error {
+		value = stmt.ColumnText(0)
+		found = true
+		return nil
+	}, key)
+	if err != nil {
+		t.Fatalf("failed to read key %q: %v", key, err)
+	}
+	return value, found
+}
+
+func TestKVSetMany(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	t.Run("insert and replace", func(t *testing.T) {
+		if err := testDB.KVSetMany(map[string][]byte{"a": []byte("1"), "b": []byte("2")}); err != nil {
+			t.Fatalf("KVSetMany failed: %v", err)
+		}
+		if err := testDB.KVSetMany(map[string][]byte{"b": []byte("3"), "c": []byte("4")}); err != nil {
+			t.Fatalf("KVSetMany failed: %v", err)
+		}
+		for key, want := range map[string]string{"a": "1", "b": "3", "c": "4"} {
+			if got, _ := kvValue(t, testDB, key); got != want {
+				t.Errorf("value of %q mismatch: got %q, want %q", key, got, want)
+			}
+		}
+	})
+
+	t.Run("rolls back on error", func(t *testing.T) {
+		// A nil value violates the NOT NULL constraint.
+		err := testDB.KVSetMany(map[string][]byte{"d": []byte("5"), "e": nil})
+		if err == nil {
+			t.Fatal("expected KVSetMany error but got none")
+		}
+		if _, found := kvValue(t, testDB, "d"); found {
+			t.Error("expected no pair stored after a failed batch")
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if err := testDB.KVSetMany(nil); err != nil {
+			t.Errorf("KVSetMany failed: %v", err)
+		}
+	})
+}
+
+// benchmarkPairs returns n distinct pairs, prefixed to stay unique across
+// benchmark iterations.
+func benchmarkPairs(prefix string, n int) map[string][]byte {
+	pairs := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		pairs[fmt.Sprintf("%s-%d", prefix, i)] = []byte("value")
+	}
+	return pairs
+}
+
+func BenchmarkKVSetMany(b *testing.B) {
+	const batchSize = 100
+
+	b.Run("batched", func(b *testing.B) {
+		testDB := setupDB(b)
+		defer testDB.pool.Close()
+
+		for i := 0; i < b.N; i++ {
+			if err := testDB.KVSetMany(benchmarkPairs(fmt.Sprint(i), batchSize)); err != nil {
+				b.Fatalf("KVSetMany failed: %v", err)
+			}
+		}
+	})
+
+	b.Run("per call", func(b *testing.B) {
+		testDB := setupDB(b)
+		defer testDB.pool.Close()
+
+		for i := 0; i < b.N; i++ {
+			for key, value := range benchmarkPairs(fmt.Sprint(i), batchSize) {
+				if err := testDB.KVSetMany(map[string][]byte{key: value}); err != nil {
+					b.Fatalf("KVSetMany failed: %v", err)
+				}
+			}
+		}
+	})
+}
+
+// claimJobsExec is claimJobs with the reflection based binding of
+// sqlitex.Exec, the baseline of BenchmarkClaim.
+func claimJobsExec(conn *sqlite.Conn, query, workerID, now, leaseModifier string, attemptIncrement, limit, _ int) ([]*db.Job, error) {
+	jobs := []*db.Job{}
+	err := sqlitex.Exec(conn, query, func(stmt *sqlite.Stmt) error {
+		job, err := newJobFromStmt(stmt)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+		return nil
+	}, workerID, now, attemptIncrement, leaseModifier, limit)
+	return jobs, err
+}
+
+func BenchmarkClaim(b *testing.B) {
+	const batchSize = 10
+
+	claimFns := []struct {
+		name  string
+		claim func(conn *sqlite.Conn, query, workerID, now, leaseModifier string, attemptIncrement, limit, maxPerType int) ([]*db.Job, error)
+	}{
+		{"prepared", claimJobs},
+		{"exec", claimJobsExec},
+	}
+	for _, fn := range claimFns {
+		b.Run(fn.name, func(b *testing.B) {
+			testDB := setupDB(b)
+			defer testDB.pool.Close()
+
+			for i := 0; i < batchSize; i++ {
+				job := db.Job{JobType: "bench_job", Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)), MaxAttempts: 3}
+				if err := testDB.InsertJob(job); err != nil {
+					b.Fatalf("InsertJob failed: %v", err)
+				}
+			}
+
+			conn := testDB.pool.Get(nil)
+			defer testDB.pool.Put(conn)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				jobs, err := fn.claim(conn, claimSQL, "bench-worker", "now", "", 0, batchSize, 0)
+				if err != nil {
+					b.Fatalf("claim failed: %v", err)
+				}
+				if len(jobs) != batchSize {
+					b.Fatalf("claimed jobs mismatch: got %d, want %d", len(jobs), batchSize)
+				}
+
+				b.StopTimer()
+				if err := sqlitex.Exec(conn, "UPDATE job_queue SET status = 'pending', locked_by = ''", nil); err != nil {
+					b.Fatalf("failed to release jobs: %v", err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -1,28 +1,44 @@
 package crawshaw
 
 import (
+	"bytes"
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"encoding/json"
+	"filippo.io/age"
 	"fmt"
 	"github.com/caasmo/restinpieces/db"
 	"io"
+	"strings"
 	"time"
 )
 
+// latestConfigSQL selects the active config version of a scope: the one set
+// with SetActiveConfig if any, else the newest. Versions created within the
+// same second are ordered by id. Binds the scope twice.
+const latestConfigSQL = `SELECT content, format FROM app_config
+		 WHERE scope = ?
+		 ORDER BY id = (SELECT version_id FROM crawshaw_config_active WHERE scope = ?) DESC,
+			created_at DESC, id DESC
+		 LIMIT 1;`
+
 func (d *Db) LatestConfig(scope string) ([]byte, error) {
-	conn := d.pool.Get(nil)
+	cached, gen, ok := d.cachedConfig(scope)
+	if ok {
+		return cached, nil
+	}
+
+	conn := d.getConn()
 	if conn == nil {
-		return nil, fmt.Errorf("failed to get db connection for scope '%s': connection is nil", scope)
+		return nil, fmt.Errorf("failed to get db connection for scope '%s': %w", scope, d.connErr())
 	}
 	defer d.pool.Put(conn)
 
 	var contentData []byte
-	err := sqlitex.Exec(conn,
-		`SELECT content FROM app_config
-		 WHERE scope = ?
-		 ORDER BY created_at DESC
-		 LIMIT 1;`,
+	var format string
+	err := d.exec(conn, latestConfigSQL,
 		func(stmt *sqlite.Stmt) error {
+			format = stmt.GetText("format")
 			if stmt.ColumnCount() > 0 && stmt.ColumnType(0) != sqlite.SQLITE_NULL {
 				reader := stmt.ColumnReader(0)
 				var readErr error
@@ -32,25 +48,339 @@ func (d *Db) LatestConfig(scope string) ([]byte, error) {
 			return nil
 		},
 		scope,
+		scope,
 	)
 
+	d.metrics.observe("LatestConfig", opRead, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get latest config content for scope '%s': %w", scope, err)
 	}
 
-	return contentData, nil
+	plain, err := d.decryptConfig(scope, contentData, format)
+	if err != nil {
+		return nil, err
+	}
+	d.storeConfig(scope, plain, gen)
+	return plain, nil
 }
 
-func (d *Db) InsertConfig(scope string, contentData []byte, format string, description string) error {
-	conn := d.pool.Get(nil)
+// LatestConfigStream copies the latest config content of scope to w instead
+// of returning it in a buffer, and returns the number of bytes written.
+// The pooled connection is held while copying. Encrypted content is
+// decrypted on the fly. Returns ErrNotFound if the scope has no config.
+func (d *Db) LatestConfigStream(scope string, w io.Writer) (int64, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for scope '%s': %w", scope, d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	found := false
+	var written int64
+	err := d.exec(conn, latestConfigSQL,
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			if stmt.ColumnType(0) == sqlite.SQLITE_NULL {
+				return nil
+			}
+
+			var r io.Reader = stmt.ColumnReader(0)
+			if strings.HasSuffix(stmt.GetText("format"), ageFormatSuffix) {
+				if d.ageIdentity == nil {
+					return fmt.Errorf("config is encrypted but no age identity is configured")
+				}
+				var err error
+				r, err = age.Decrypt(r, d.ageIdentity)
+				if err != nil {
+					return fmt.Errorf("failed to decrypt config: %w", err)
+				}
+			}
+
+			var err error
+			written, err = io.Copy(w, r)
+			return err
+		},
+		scope,
+		scope,
+	)
+
+	if err != nil {
+		return written, fmt.Errorf("failed to stream latest config content for scope '%s': %w", scope, err)
+	}
+	if !found {
+		return 0, ErrNotFound
+	}
+	return written, nil
+}
+
+// exportedConfig is one line of the ExportLatestConfigs NDJSON stream.
+// Content is a byte slice, so it is encoded as base64 and survives content
+// that is not valid UTF-8.
+type exportedConfig struct {
+	Scope   string `json:"scope"`
+	Format  string `json:"format"`
+	Content []byte `json:"content"`
+}
+
+// ExportLatestConfigs writes the active config of every scope, the one
+// LatestConfig returns, to w as NDJSON: one {"scope", "format", "content"}
+// object per line, ordered by scope, with the content base64 encoded.
+// Encrypted content is decrypted and its format written without the "+age"
+// suffix, so the stream can be restored with InsertConfig. Lines are written
+// as rows are read.
+func (d *Db) ExportLatestConfigs(w io.Writer) error {
+	conn := d.getConn()
 	if conn == nil {
-		return fmt.Errorf("failed to get db connection for config insert: connection is nil")
+		return fmt.Errorf("failed to get db connection for export latest configs: %w", d.connErr())
 	}
 	defer d.pool.Put(conn)
 
-	now := db.TimeFormat(time.Now())
+	enc := json.NewEncoder(w)
+	err := d.exec(conn,
+		`SELECT scope, content, format FROM (
+			SELECT c.scope, c.content, c.format,
+				ROW_NUMBER() OVER (
+					PARTITION BY c.scope
+					ORDER BY c.id = a.version_id DESC, c.created_at DESC, c.id DESC
+				) AS rn
+			FROM app_config c
+			LEFT JOIN crawshaw_config_active a ON a.scope = c.scope
+		)
+		WHERE rn = 1
+		ORDER BY scope`,
+		func(stmt *sqlite.Stmt) error {
+			scope := stmt.GetText("scope")
+			format := stmt.GetText("format")
+			var contentData []byte
+			if stmt.ColumnType(1) != sqlite.SQLITE_NULL {
+				var err error
+				contentData, err = io.ReadAll(stmt.ColumnReader(1))
+				if err != nil {
+					return err
+				}
+			}
+
+			plain, err := d.decryptConfig(scope, contentData, format)
+			if err != nil {
+				return err
+			}
+			return enc.Encode(exportedConfig{
+				Scope:   scope,
+				Format:  strings.TrimSuffix(format, ageFormatSuffix),
+				Content: plain,
+			})
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to export latest configs: %w", err)
+	}
+	return nil
+}
+
+// ageFormatSuffix marks the stored format of config content encrypted with age.
+const ageFormatSuffix = "+age"
+
+// encryptConfig encrypts content to the recipient of the configured age identity.
+func (d *Db) encryptConfig(scope string, contentData []byte) ([]byte, error) {
+	if d.ageIdentity == nil {
+		return nil, fmt.Errorf("failed to encrypt config for scope '%s': no age identity configured", scope)
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, d.ageIdentity.Recipient())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt config for scope '%s': %w", scope, err)
+	}
+	if _, err := w.Write(contentData); err != nil {
+		return nil, fmt.Errorf("failed to encrypt config for scope '%s': %w", scope, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encrypt config for scope '%s': %w", scope, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptConfig returns content as stored unless its format marks it as
+// encrypted, in which case it is decrypted with the configured age identity.
+func (d *Db) decryptConfig(scope string, contentData []byte, format string) ([]byte, error) {
+	if contentData == nil || !strings.HasSuffix(format, ageFormatSuffix) {
+		return contentData, nil
+	}
+	if d.ageIdentity == nil {
+		return nil, fmt.Errorf("config for scope '%s' is encrypted but no age identity is configured", scope)
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(contentData), d.ageIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config for scope '%s': %w", scope, err)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config for scope '%s': %w", scope, err)
+	}
+	return plain, nil
+}
+
+// defaultMaxConfigSize guards against accidentally storing huge blobs as config.
+const defaultMaxConfigSize = 1 << 20 // 1MB
+
+func (d *Db) InsertConfig(scope string, contentData []byte, format string, description string) error {
+	contentData, format, err := d.prepareConfig(scope, contentData, format)
+	if err != nil {
+		return err
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for config insert: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err = d.exec(conn, "BEGIN IMMEDIATE;", nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for config insert: %w", err)
+	}
+
+	err = d.insertConfigVersion(conn, scope, contentData, format, description)
+	if err == nil {
+		err = d.exec(conn, "COMMIT;", nil)
+	}
+
+	d.metrics.observe("InsertConfig", opWrite, err)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return fmt.Errorf("failed to insert config for scope '%s': %w", scope, err)
+	}
+
+	d.invalidateConfig(scope)
+	return nil
+}
+
+// InsertConfigIfChanged inserts a new config version for scope only if
+// content or format differ from the latest config, so periodic syncs do not
+// fill the history with identical rows. The comparison is done on the
+// decrypted content, in the same transaction as the insert.
+func (d *Db) InsertConfigIfChanged(scope string, content []byte, format, description string) (inserted bool, err error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return false, fmt.Errorf("failed to get db connection for config insert: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err = d.exec(conn, "BEGIN IMMEDIATE;", nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction for config insert: %w", err)
+	}
+
+	latest, latestFormat, found, err := d.latestConfigConn(conn, scope)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return false, err
+	}
+	if found && latestFormat == format && bytes.Equal(latest, content) {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return false, nil
+	}
+
+	prepared, preparedFormat, err := d.prepareConfig(scope, content, format)
+	if err == nil {
+		err = d.insertConfigVersion(conn, scope, prepared, preparedFormat, description)
+	}
+	if err == nil {
+		err = d.exec(conn, "COMMIT;", nil)
+	}
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return false, fmt.Errorf("failed to insert config for scope '%s': %w", scope, err)
+	}
+
+	d.invalidateConfig(scope)
+	return true, nil
+}
+
+// RegisterConfigValidator sets fn as the validator of scope, replacing any
+// previous one; a nil fn removes it. InsertConfig, InsertConfigIfChanged and
+// PatchConfig run the validator on the plain content before writing and
+// return its error, e.g. to reject a config missing required keys. Scopes
+// without a validator are not checked.
+func (d *Db) RegisterConfigValidator(scope string, fn func([]byte) error) {
+	d.validatorsMu.Lock()
+	defer d.validatorsMu.Unlock()
+
+	if fn == nil {
+		delete(d.configValidators, scope)
+		return
+	}
+	if d.configValidators == nil {
+		d.configValidators = make(map[string]func([]byte) error)
+	}
+	d.configValidators[scope] = fn
+}
+
+// validateConfig runs the validator registered for scope, if any.
+func (d *Db) validateConfig(scope string, contentData []byte) error {
+	d.validatorsMu.RLock()
+	fn := d.configValidators[scope]
+	d.validatorsMu.RUnlock()
+
+	if fn == nil {
+		return nil
+	}
+	if err := fn(contentData); err != nil {
+		return fmt.Errorf("invalid config for scope '%s': %w", scope, err)
+	}
+	return nil
+}
+
+// prepareConfig checks the content size limit, runs the scope validator,
+// takes a token from the scope's rate limit and encrypts the content of
+// encrypted scopes, returning the content and format to store.
+func (d *Db) prepareConfig(scope string, contentData []byte, format string) ([]byte, string, error) {
+	if strings.HasSuffix(format, ageFormatSuffix) {
+		return nil, "", fmt.Errorf("config format '%s' for scope '%s' must not end in '%s'", format, scope, ageFormatSuffix)
+	}
+	if err := d.checkConfigSize(scope, contentData); err != nil {
+		return nil, "", err
+	}
+	if err := d.validateConfig(scope, contentData); err != nil {
+		return nil, "", err
+	}
+
+	if d.encryptedScopes[scope] {
+		var err error
+		contentData, err = d.encryptConfig(scope, contentData)
+		if err != nil {
+			return nil, "", err
+		}
+		format += ageFormatSuffix
+		// The limit bounds the stored bytes, which include the age overhead.
+		if err := d.checkConfigSize(scope, contentData); err != nil {
+			return nil, "", err
+		}
+	}
 
-	err := sqlitex.Exec(conn,
+	if err := d.allowConfigWrite(scope); err != nil {
+		return nil, "", err
+	}
+	return contentData, format, nil
+}
+
+// checkConfigSize enforces the maximum config size on contentData.
+func (d *Db) checkConfigSize(scope string, contentData []byte) error {
+	limit := d.maxConfigSize
+	if limit == 0 {
+		limit = defaultMaxConfigSize
+	}
+	if limit > 0 && len(contentData) > limit {
+		return fmt.Errorf("config content for scope '%s' is %d bytes, exceeds limit of %d bytes", scope, len(contentData), limit)
+	}
+	return nil
+}
+
+// insertConfigVersion inserts a prepared config version within the caller's
+// transaction. A new version becomes the active one, so any pointer set with
+// SetActiveConfig is dropped.
+func (d *Db) insertConfigVersion(conn *sqlite.Conn, scope string, contentData []byte, format string, description string) error {
+	err := d.exec(conn,
 		`INSERT INTO app_config (
 			scope,
 			content,
@@ -63,12 +393,305 @@ func (d *Db) InsertConfig(scope string, contentData []byte, format string, descr
 		contentData,
 		format,
 		description,
-		now,
+		db.TimeFormat(d.clock()),
+	)
+	if err != nil {
+		return err
+	}
+
+	return d.exec(conn, `DELETE FROM crawshaw_config_active WHERE scope = ?`, nil, scope)
+}
+
+// PatchConfig applies an RFC 7386 JSON merge patch to the latest config of
+// scope and stores the result as a new version, in one transaction: patch
+// members replace or add fields, null members remove them.
+// Returns ErrNotFound if the scope has no config, and an error if the latest
+// config or the patch is not valid JSON.
+func (d *Db) PatchConfig(scope string, patch []byte) error {
+	var patchDoc any
+	if err := json.Unmarshal(patch, &patchDoc); err != nil {
+		return fmt.Errorf("invalid JSON merge patch for scope '%s': %w", scope, err)
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for scope '%s': %w", scope, d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn, "BEGIN IMMEDIATE;", nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for config patch: %w", err)
+	}
+
+	err = d.patchConfig(conn, scope, patchDoc)
+	if err == nil {
+		err = d.exec(conn, "COMMIT;", nil)
+	}
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return err
+	}
+
+	d.invalidateConfig(scope)
+	return nil
+}
+
+// patchConfig reads, merges and re-inserts the latest config of scope within
+// the caller's transaction.
+func (d *Db) patchConfig(conn *sqlite.Conn, scope string, patchDoc any) error {
+	contentData, format, found, err := d.latestConfigConn(conn, scope)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+
+	var doc any
+	if err := json.Unmarshal(contentData, &doc); err != nil {
+		return fmt.Errorf("latest config for scope '%s' is not valid JSON: %w", scope, err)
+	}
+
+	merged, err := json.Marshal(mergePatch(doc, patchDoc))
+	if err != nil {
+		return fmt.Errorf("failed to marshal patched config for scope '%s': %w", scope, err)
+	}
+
+	merged, format, err = d.prepareConfig(scope, merged, format)
+	if err != nil {
+		return err
+	}
+
+	if err := d.insertConfigVersion(conn, scope, merged, format, "merge patch"); err != nil {
+		return fmt.Errorf("failed to insert patched config for scope '%s': %w", scope, err)
+	}
+	return nil
+}
+
+// latestConfigConn reads and decrypts the latest config of scope on conn,
+// returning the format without the encryption suffix.
+func (d *Db) latestConfigConn(conn *sqlite.Conn, scope string) ([]byte, string, bool, error) {
+	var contentData []byte
+	var format string
+	found := false
+	err := d.exec(conn, latestConfigSQL,
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			format = stmt.GetText("format")
+			var readErr error
+			contentData, readErr = io.ReadAll(stmt.ColumnReader(0))
+			return readErr
+		},
+		scope,
+		scope,
 	)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to get latest config content for scope '%s': %w", scope, err)
+	}
+	if !found {
+		return nil, "", false, nil
+	}
 
+	contentData, err = d.decryptConfig(scope, contentData, format)
 	if err != nil {
-		return fmt.Errorf("failed to insert config for scope '%s': %w", scope, err)
+		return nil, "", false, err
+	}
+	return contentData, strings.TrimSuffix(format, ageFormatSuffix), true, nil
+}
+
+// mergePatch applies patch to target as defined by RFC 7386.
+func mergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+	return targetObj
+}
+
+// DeleteConfigScope deletes every stored version of the config for scope,
+// e.g. when retiring a feature. Returns the number of rows deleted.
+func (d *Db) DeleteConfigScope(scope string) (int64, error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for config delete: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn, `DELETE FROM app_config WHERE scope = ?`, nil, scope)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete config for scope '%s': %w", scope, err)
+	}
+	deleted := int64(conn.Changes())
+	d.invalidateConfig(scope)
+
+	err = d.exec(conn, `DELETE FROM crawshaw_config_active WHERE scope = ?`, nil, scope)
+	if err != nil {
+		return deleted, fmt.Errorf("failed to delete active config pointer for scope '%s': %w", scope, err)
+	}
+
+	return deleted, nil
+}
+
+// SetActiveConfig makes the stored version id the config returned by
+// LatestConfig for scope, e.g. to roll back without copying the content into
+// a new row. The pointer is dropped by the next InsertConfig for the scope.
+// Returns ErrNotFound if id is not a version of scope.
+func (d *Db) SetActiveConfig(scope string, id int64) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for scope '%s': %w", scope, d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`INSERT INTO crawshaw_config_active (scope, version_id)
+		SELECT scope, id FROM app_config WHERE scope = ? AND id = ?
+		ON CONFLICT(scope) DO UPDATE SET version_id = excluded.version_id`,
+		nil,
+		scope,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set active config %d for scope '%s': %w", id, scope, err)
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+
+	d.invalidateConfig(scope)
+	return nil
+}
+
+// ClearActiveConfig drops the pointer set by SetActiveConfig, so LatestConfig
+// returns the newest version of scope again.
+func (d *Db) ClearActiveConfig(scope string) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for scope '%s': %w", scope, d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn, `DELETE FROM crawshaw_config_active WHERE scope = ?`, nil, scope)
+	if err != nil {
+		return fmt.Errorf("failed to clear active config for scope '%s': %w", scope, err)
 	}
 
+	d.invalidateConfig(scope)
 	return nil
 }
+
+// ConfigVersion is the metadata of a stored config version, without its
+// content. Format is the stored format, with the "+age" suffix for encrypted
+// scopes.
+type ConfigVersion struct {
+	ID          int64
+	Scope       string
+	Format      string
+	Description string
+	CreatedAt   time.Time
+}
+
+// ListAllConfigChanges returns the config versions of every scope, newest
+// first, for audit feeds. The pagination arguments are clamped by
+// normalizeLimitOffset.
+func (d *Db) ListAllConfigChanges(limit, offset int) ([]ConfigVersion, error) {
+	limit, offset = normalizeLimitOffset(limit, offset)
+
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for list all config changes: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	versions := []ConfigVersion{}
+	err := d.exec(conn,
+		`SELECT id, scope, format, description, created_at
+		FROM app_config
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?`,
+		func(stmt *sqlite.Stmt) error {
+			createdAt, err := db.TimeParse(stmt.GetText("created_at"))
+			if err != nil {
+				return fmt.Errorf("error parsing created_at time: %w", err)
+			}
+			versions = append(versions, ConfigVersion{
+				ID:          stmt.GetInt64("id"),
+				Scope:       stmt.GetText("scope"),
+				Format:      stmt.GetText("format"),
+				Description: stmt.GetText("description"),
+				CreatedAt:   createdAt,
+			})
+			return nil
+		},
+		limit,
+		offset,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list config changes: %w", err)
+	}
+	return versions, nil
+}
+
+// DiffConfig fetches the content of two stored versions of the config for scope
+// and reports whether they are byte-identical. Textual diffing is left to the
+// caller. Returns ErrNotFound if either id does not exist in scope.
+func (d *Db) DiffConfig(scope string, idA, idB int64) (a, b []byte, equal bool, err error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, nil, false, fmt.Errorf("failed to get db connection for scope '%s': %w", scope, d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	a, err = d.configContentByID(conn, scope, idA)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	b, err = d.configContentByID(conn, scope, idB)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return a, b, bytes.Equal(a, b), nil
+}
+
+// configContentByID returns the content of one config version of scope,
+// or ErrNotFound if there is no such version.
+func (d *Db) configContentByID(conn *sqlite.Conn, scope string, id int64) ([]byte, error) {
+	var contentData []byte
+	var format string
+	found := false
+	err := d.exec(conn,
+		`SELECT content, format FROM app_config WHERE scope = ? AND id = ?`,
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			format = stmt.GetText("format")
+			var readErr error
+			contentData, readErr = io.ReadAll(stmt.ColumnReader(0))
+			return readErr
+		},
+		scope,
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config %d for scope '%s': %w", id, scope, err)
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	return d.decryptConfig(scope, contentData, format)
+}
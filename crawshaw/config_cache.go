@@ -0,0 +1,61 @@
+package crawshaw
+
+// EnableConfigCache makes LatestConfig keep the latest config of each scope
+// in memory, so repeated reads do not query the database. Entries are
+// invalidated by the writes of this Db (InsertConfig, PatchConfig,
+// DeleteConfigScope, SetActiveConfig and ClearActiveConfig); changes made by
+// other processes or Db instances are not seen until then.
+// The cache is disabled by default.
+func (d *Db) EnableConfigCache() {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+
+	if d.configCache == nil {
+		d.configCache = make(map[string][]byte)
+	}
+}
+
+// cachedConfig returns a copy of the cached config of scope, if any, and the
+// cache generation to pass to storeConfig after a miss.
+func (d *Db) cachedConfig(scope string) ([]byte, uint64, bool) {
+	d.configMu.RLock()
+	defer d.configMu.RUnlock()
+
+	content, ok := d.configCache[scope]
+	if !ok {
+		return nil, d.configGen, false
+	}
+	return cloneBytes(content), d.configGen, true
+}
+
+// storeConfig caches the config of scope read at generation gen. It is
+// dropped if an invalidation happened since, as the read may be stale.
+func (d *Db) storeConfig(scope string, content []byte, gen uint64) {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+
+	if d.configCache == nil || d.configGen != gen {
+		return
+	}
+	d.configCache[scope] = cloneBytes(content)
+}
+
+// invalidateConfig drops the cached config of scope.
+func (d *Db) invalidateConfig(scope string) {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+
+	if d.configCache == nil {
+		return
+	}
+	delete(d.configCache, scope)
+	d.configGen++
+}
+
+// cloneBytes copies b, keeping nil as nil.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,46 @@
+package crawshaw
+
+import (
+	"fmt"
+
+	"golang.org/x/time/rate"
+)
+
+// WithConfigRateLimit caps the config writes of each scope with a token
+// bucket refilled at perSecond tokens per second and holding up to burst
+// tokens. InsertConfig, InsertConfigIfChanged and PatchConfig take a token
+// before writing a new version and return an error wrapping ErrRateLimited
+// when the bucket of the scope is empty, so a client spamming config writes
+// cannot flood the app_config history. InsertConfigIfChanged takes no token
+// for unchanged content. The buckets follow the clock set with WithClock.
+// A perSecond <= 0 disables the limit, the default.
+func WithConfigRateLimit(perSecond float64, burst int) Option {
+	return func(d *Db) {
+		d.configLimit = rate.Limit(perSecond)
+		d.configBurst = burst
+	}
+}
+
+// allowConfigWrite takes a token from the bucket of scope, returning an
+// error wrapping ErrRateLimited if it is empty.
+func (d *Db) allowConfigWrite(scope string) error {
+	if d.configLimit <= 0 {
+		return nil
+	}
+
+	d.limitersMu.Lock()
+	limiter, ok := d.configLimiters[scope]
+	if !ok {
+		if d.configLimiters == nil {
+			d.configLimiters = make(map[string]*rate.Limiter)
+		}
+		limiter = rate.NewLimiter(d.configLimit, d.configBurst)
+		d.configLimiters[scope] = limiter
+	}
+	d.limitersMu.Unlock()
+
+	if !limiter.AllowN(d.clock(), 1) {
+		return fmt.Errorf("config writes for scope '%s': %w", scope, ErrRateLimited)
+	}
+	return nil
+}
@@ -0,0 +1,753 @@
+package crawshaw
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"filippo.io/age"
+)
+
+func TestInsertConfigMaxSize(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+	testDB.maxConfigSize = 1024
+
+	t.Run("just under limit", func(t *testing.T) {
+		content := bytes.Repeat([]byte("a"), 1024)
+		if err := testDB.InsertConfig("app", content, "toml", "under"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		got, err := testDB.LatestConfig("app")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("content mismatch: got %d bytes, want %d", len(got), len(content))
+		}
+	})
+
+	t.Run("just over limit", func(t *testing.T) {
+		content := bytes.Repeat([]byte("b"), 1025)
+		if err := testDB.InsertConfig("app", content, "toml", "over"); err == nil {
+			t.Fatal("expected error but got none")
+		}
+
+		got, err := testDB.LatestConfig("app")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		if len(got) != 1024 {
+			t.Errorf("oversized config was stored: got %d bytes", len(got))
+		}
+	})
+}
+
+func TestDeleteConfigScope(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if err := testDB.InsertConfig("retired", []byte(content), "toml", content); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+	}
+	if err := testDB.InsertConfig("kept", []byte("k1"), "toml", "k1"); err != nil {
+		t.Fatalf("InsertConfig failed: %v", err)
+	}
+
+	deleted, err := testDB.DeleteConfigScope("retired")
+	if err != nil {
+		t.Fatalf("DeleteConfigScope failed: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("deleted count mismatch: got %d, want %d", deleted, 3)
+	}
+
+	got, err := testDB.LatestConfig("retired")
+	if err != nil {
+		t.Fatalf("LatestConfig failed: %v", err)
+	}
+	if got != nil {
+		t.Errorf("expected no config for deleted scope, got %q", got)
+	}
+
+	got, err = testDB.LatestConfig("kept")
+	if err != nil {
+		t.Fatalf("LatestConfig failed: %v", err)
+	}
+	if string(got) != "k1" {
+		t.Errorf("other scope affected: got %q, want %q", got, "k1")
+	}
+}
+
+// configIDs returns the ids of all config versions of scope, oldest first.
+func configIDs(t *testing.T, testDB *Db, scope string) []int64 {
+	t.Helper()
+
+	conn := testDB.pool.Get(nil)
+	defer testDB.pool.Put(conn)
+
+	var ids []int64
+	err := sqlitex.Exec(conn, `SELECT id FROM app_config WHERE scope = ? ORDER BY id`,
+		func(stmt *sqlite.Stmt) error {
+			ids = append(ids, stmt.GetInt64("id"))
+			return nil
+		}, scope)
+	if err != nil {
+		t.Fatalf("failed to query config ids: %v", err)
+	}
+	return ids
+}
+
+func TestDiffConfig(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	for _, content := range []string{"same", "same", "different"} {
+		if err := testDB.InsertConfig("app", []byte(content), "toml", ""); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+	}
+	ids := configIDs(t, testDB, "app")
+
+	t.Run("identical content", func(t *testing.T) {
+		a, b, equal, err := testDB.DiffConfig("app", ids[0], ids[1])
+		if err != nil {
+			t.Fatalf("DiffConfig failed: %v", err)
+		}
+		if !equal {
+			t.Error("expected versions to be equal")
+		}
+		if string(a) != "same" || string(b) != "same" {
+			t.Errorf("content mismatch: got %q and %q", a, b)
+		}
+	})
+
+	t.Run("different content", func(t *testing.T) {
+		a, b, equal, err := testDB.DiffConfig("app", ids[1], ids[2])
+		if err != nil {
+			t.Fatalf("DiffConfig failed: %v", err)
+		}
+		if equal {
+			t.Error("expected versions to differ")
+		}
+		if string(a) != "same" || string(b) != "different" {
+			t.Errorf("content mismatch: got %q and %q", a, b)
+		}
+	})
+
+	t.Run("missing id", func(t *testing.T) {
+		_, _, _, err := testDB.DiffConfig("app", ids[0], 9999)
+		if err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestInsertConfigEncrypted(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate age identity: %v", err)
+	}
+	WithConfigEncryption(identity, "secrets")(testDB)
+
+	content := []byte(`{"api_key":"very-secret-value"}`)
+	if err := testDB.InsertConfig("secrets", content, "json", "encrypted"); err != nil {
+		t.Fatalf("InsertConfig failed: %v", err)
+	}
+	if err := testDB.InsertConfig("public", content, "json", "plain"); err != nil {
+		t.Fatalf("InsertConfig failed: %v", err)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		got, err := testDB.LatestConfig("secrets")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("content mismatch: got %q, want %q", got, content)
+		}
+	})
+
+	t.Run("stored bytes are not plaintext", func(t *testing.T) {
+		conn := testDB.pool.Get(nil)
+		defer testDB.pool.Put(conn)
+
+		var stored []byte
+		var format string
+		err := sqlitex.Exec(conn, `SELECT content, format FROM app_config WHERE scope = ?`,
+			func(stmt *sqlite.Stmt) error {
+				stored = make([]byte, stmt.ColumnLen(0))
+				stmt.ColumnBytes(0, stored)
+				format = stmt.GetText("format")
+				return nil
+			}, "secrets")
+		if err != nil {
+			t.Fatalf("failed to read stored config: %v", err)
+		}
+
+		if bytes.Contains(stored, []byte("very-secret-value")) {
+			t.Error("stored content contains plaintext")
+		}
+		if format != "json+age" {
+			t.Errorf("format mismatch: got %q, want %q", format, "json+age")
+		}
+	})
+
+	t.Run("unencrypted scope unchanged", func(t *testing.T) {
+		got, err := testDB.LatestConfig("public")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("content mismatch: got %q, want %q", got, content)
+		}
+	})
+}
+
+func TestConfigEncryptionChecks(t *testing.T) {
+	t.Run("nil identity", func(t *testing.T) {
+		testDB := setupDB(t)
+		defer testDB.pool.Close()
+
+		if _, err := New(testDB.pool, WithConfigEncryption(nil, "secrets")); err == nil {
+			t.Fatal("expected error for nil identity but got none")
+		}
+	})
+
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate age identity: %v", err)
+	}
+	WithConfigEncryption(identity, "secrets")(testDB)
+
+	t.Run("age format rejected", func(t *testing.T) {
+		for _, scope := range []string{"secrets", "public"} {
+			if err := testDB.InsertConfig(scope, []byte(`{}`), "json+age", "forged"); err == nil {
+				t.Errorf("scope %s: expected error for +age format but got none", scope)
+			}
+		}
+	})
+
+	t.Run("limit bounds stored bytes", func(t *testing.T) {
+		testDB.maxConfigSize = 1024
+		defer func() { testDB.maxConfigSize = 0 }()
+
+		content := bytes.Repeat([]byte("a"), 1000)
+		if err := testDB.InsertConfig("secrets", content, "toml", "over"); err == nil {
+			t.Fatal("expected error for encrypted content over the limit but got none")
+		}
+		if err := testDB.InsertConfig("public", content, "toml", "under"); err != nil {
+			t.Fatalf("unexpected error for plaintext under the limit: %v", err)
+		}
+	})
+}
+
+func TestLatestConfigStream(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate age identity: %v", err)
+	}
+	WithConfigEncryption(identity, "secrets")(testDB)
+
+	content := bytes.Repeat([]byte("key = \"value\"\n"), 4096)
+	for _, scope := range []string{"application", "secrets"} {
+		if err := testDB.InsertConfig(scope, content, "toml", ""); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+
+		t.Run(scope, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := testDB.LatestConfigStream(scope, &buf)
+			if err != nil {
+				t.Fatalf("LatestConfigStream failed: %v", err)
+			}
+			if n != int64(len(content)) {
+				t.Errorf("byte count mismatch: got %d, want %d", n, len(content))
+			}
+			if !bytes.Equal(buf.Bytes(), content) {
+				t.Error("streamed content does not match inserted content")
+			}
+		})
+	}
+
+	t.Run("missing scope", func(t *testing.T) {
+		var buf bytes.Buffer
+		if _, err := testDB.LatestConfigStream("missing", &buf); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestSetActiveConfig(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	// Distinct created_at values so newest-by-created_at is well defined.
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	})(testDB)
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if err := testDB.InsertConfig("app", []byte(content), "toml", ""); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+	}
+	ids := configIDs(t, testDB, "app")
+
+	latest := func() string {
+		t.Helper()
+		content, err := testDB.LatestConfig("app")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		return string(content)
+	}
+
+	if got := latest(); got != "v3" {
+		t.Fatalf("LatestConfig without pointer: got %q, want %q", got, "v3")
+	}
+
+	t.Run("point at older version", func(t *testing.T) {
+		if err := testDB.SetActiveConfig("app", ids[0]); err != nil {
+			t.Fatalf("SetActiveConfig failed: %v", err)
+		}
+		if got := latest(); got != "v1" {
+			t.Errorf("LatestConfig mismatch: got %q, want %q", got, "v1")
+		}
+
+		var buf bytes.Buffer
+		if _, err := testDB.LatestConfigStream("app", &buf); err != nil {
+			t.Fatalf("LatestConfigStream failed: %v", err)
+		}
+		if buf.String() != "v1" {
+			t.Errorf("LatestConfigStream mismatch: got %q, want %q", buf.String(), "v1")
+		}
+
+		if got := configIDs(t, testDB, "app"); len(got) != len(ids) {
+			t.Errorf("rollback must not add rows: got %d versions, want %d", len(got), len(ids))
+		}
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		if err := testDB.SetActiveConfig("other", ids[1]); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound for a version of another scope, got %v", err)
+		}
+	})
+
+	t.Run("clear falls back to newest", func(t *testing.T) {
+		if err := testDB.ClearActiveConfig("app"); err != nil {
+			t.Fatalf("ClearActiveConfig failed: %v", err)
+		}
+		if got := latest(); got != "v3" {
+			t.Errorf("LatestConfig mismatch: got %q, want %q", got, "v3")
+		}
+	})
+
+	t.Run("insert drops pointer", func(t *testing.T) {
+		if err := testDB.SetActiveConfig("app", ids[0]); err != nil {
+			t.Fatalf("SetActiveConfig failed: %v", err)
+		}
+		if err := testDB.InsertConfig("app", []byte("v4"), "toml", ""); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+		if got := latest(); got != "v4" {
+			t.Errorf("LatestConfig mismatch: got %q, want %q", got, "v4")
+		}
+	})
+}
+
+func TestPatchConfig(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	base := `{"server":{"addr":":8080","timeout":30},"debug":true}`
+	if err := testDB.InsertConfig("app", []byte(base), "json", ""); err != nil {
+		t.Fatalf("InsertConfig failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{
+			name:  "add field",
+			patch: `{"server":{"tls":true}}`,
+			want:  `{"debug":true,"server":{"addr":":8080","timeout":30,"tls":true}}`,
+		},
+		{
+			name:  "change field",
+			patch: `{"server":{"addr":":9090"}}`,
+			want:  `{"debug":true,"server":{"addr":":9090","timeout":30,"tls":true}}`,
+		},
+		{
+			name:  "remove field",
+			patch: `{"debug":null}`,
+			want:  `{"server":{"addr":":9090","timeout":30,"tls":true}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(configIDs(t, testDB, "app"))
+			if err := testDB.PatchConfig("app", []byte(tt.patch)); err != nil {
+				t.Fatalf("PatchConfig failed: %v", err)
+			}
+
+			got, err := testDB.LatestConfig("app")
+			if err != nil {
+				t.Fatalf("LatestConfig failed: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("patched config mismatch:\ngot  %s\nwant %s", got, tt.want)
+			}
+			if after := len(configIDs(t, testDB, "app")); after != before+1 {
+				t.Errorf("expected one new version, got %d -> %d", before, after)
+			}
+		})
+	}
+
+	t.Run("latest not JSON", func(t *testing.T) {
+		if err := testDB.InsertConfig("toml", []byte(`addr = ":8080"`), "toml", ""); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+		if err := testDB.PatchConfig("toml", []byte(`{"addr":":9090"}`)); err == nil {
+			t.Error("expected error patching a non JSON config")
+		}
+		if n := len(configIDs(t, testDB, "toml")); n != 1 {
+			t.Errorf("rejected patch must not add a version, got %d versions", n)
+		}
+	})
+
+	t.Run("missing scope", func(t *testing.T) {
+		if err := testDB.PatchConfig("missing", []byte(`{}`)); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestConfigCache(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+	testDB.EnableConfigCache()
+
+	if err := testDB.InsertConfig("app", []byte("v1"), "toml", "first"); err != nil {
+		t.Fatalf("InsertConfig failed: %v", err)
+	}
+	if got, err := testDB.LatestConfig("app"); err != nil || string(got) != "v1" {
+		t.Fatalf("LatestConfig mismatch: got %q, %v, want v1", got, err)
+	}
+
+	// A version written behind the Db's back is not seen: reads hit the cache.
+	conn := testDB.pool.Get(nil)
+	err := sqlitex.Exec(conn,
+		`INSERT INTO app_config (scope, content, format, description) VALUES ('app', 'direct', 'toml', '')`, nil)
+	testDB.pool.Put(conn)
+	if err != nil {
+		t.Fatalf("direct insert failed: %v", err)
+	}
+
+	t.Run("cached read", func(t *testing.T) {
+		got, err := testDB.LatestConfig("app")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		if string(got) != "v1" {
+			t.Errorf("expected cached v1, got %q", got)
+		}
+	})
+
+	t.Run("insert invalidates", func(t *testing.T) {
+		if err := testDB.InsertConfig("app", []byte("v2"), "toml", "second"); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+		got, err := testDB.LatestConfig("app")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		if string(got) != "v2" {
+			t.Errorf("expected v2 after insert, got %q", got)
+		}
+	})
+
+	t.Run("delete invalidates", func(t *testing.T) {
+		if _, err := testDB.DeleteConfigScope("app"); err != nil {
+			t.Fatalf("DeleteConfigScope failed: %v", err)
+		}
+		got, err := testDB.LatestConfig("app")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		if got != nil {
+			t.Errorf("expected no config after delete, got %q", got)
+		}
+	})
+}
+
+func TestInsertConfigIfChanged(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	steps := []struct {
+		name     string
+		content  string
+		format   string
+		inserted bool
+	}{
+		{"first version", "a = 1", "toml", true},
+		{"unchanged", "a = 1", "toml", false},
+		{"changed content", "a = 2", "toml", true},
+		{"changed format", "a = 2", "yaml", true},
+	}
+	for _, step := range steps {
+		inserted, err := testDB.InsertConfigIfChanged("app", []byte(step.content), step.format, step.name)
+		if err != nil {
+			t.Fatalf("%s: InsertConfigIfChanged failed: %v", step.name, err)
+		}
+		if inserted != step.inserted {
+			t.Errorf("%s: inserted mismatch: got %v, want %v", step.name, inserted, step.inserted)
+		}
+	}
+
+	if ids := configIDs(t, testDB, "app"); len(ids) != 3 {
+		t.Errorf("versions mismatch: got %d, want 3", len(ids))
+	}
+}
+
+func TestRegisterConfigValidator(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	errMissingName := errors.New("missing required key: name")
+	testDB.RegisterConfigValidator("app", func(content []byte) error {
+		var cfg map[string]any
+		if err := json.Unmarshal(content, &cfg); err != nil {
+			return err
+		}
+		if _, ok := cfg["name"]; !ok {
+			return errMissingName
+		}
+		return nil
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		if err := testDB.InsertConfig("app", []byte(`{"name":"svc"}`), "json", "valid"); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		err := testDB.InsertConfig("app", []byte(`{"port":8080}`), "json", "invalid")
+		if !errors.Is(err, errMissingName) {
+			t.Fatalf("expected validator error, got %v", err)
+		}
+		if ids := configIDs(t, testDB, "app"); len(ids) != 1 {
+			t.Errorf("versions mismatch: got %d, want 1", len(ids))
+		}
+	})
+
+	t.Run("unvalidated scope", func(t *testing.T) {
+		if err := testDB.InsertConfig("other", []byte(`{"port":8080}`), "json", "free"); err != nil {
+			t.Errorf("InsertConfig failed: %v", err)
+		}
+	})
+
+	t.Run("removed validator", func(t *testing.T) {
+		testDB.RegisterConfigValidator("app", nil)
+		if err := testDB.InsertConfig("app", []byte(`{"port":8080}`), "json", "unchecked"); err != nil {
+			t.Errorf("InsertConfig failed: %v", err)
+		}
+	})
+}
+
+func TestConfigRateLimit(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+	WithConfigRateLimit(1, 2)(testDB)
+
+	insert := func(scope string, n int) error {
+		return testDB.InsertConfig(scope, []byte(fmt.Sprintf("a = %d", n)), "toml", "")
+	}
+
+	t.Run("burst then rejected", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if err := insert("app", i); err != nil {
+				t.Fatalf("insert %d failed: %v", i, err)
+			}
+		}
+		if err := insert("app", 2); !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("expected ErrRateLimited, got %v", err)
+		}
+		if ids := configIDs(t, testDB, "app"); len(ids) != 2 {
+			t.Errorf("versions mismatch: got %d, want 2", len(ids))
+		}
+	})
+
+	t.Run("other scope unaffected", func(t *testing.T) {
+		if err := insert("other", 0); err != nil {
+			t.Errorf("insert failed: %v", err)
+		}
+	})
+
+	t.Run("refills over time", func(t *testing.T) {
+		clock = clock.Add(time.Second)
+		if err := insert("app", 3); err != nil {
+			t.Fatalf("insert after refill failed: %v", err)
+		}
+		if err := insert("app", 4); !errors.Is(err, ErrRateLimited) {
+			t.Errorf("expected ErrRateLimited, got %v", err)
+		}
+	})
+}
+
+func TestListAllConfigChanges(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	})(testDB)
+
+	inserts := []struct{ scope, description string }{
+		{"app", "app v1"},
+		{"plugin", "plugin v1"},
+		{"app", "app v2"},
+		{"mail", "mail v1"},
+	}
+	for _, in := range inserts {
+		if err := testDB.InsertConfig(in.scope, []byte("content"), "toml", in.description); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+	}
+
+	t.Run("merged feed", func(t *testing.T) {
+		versions, err := testDB.ListAllConfigChanges(10, 0)
+		if err != nil {
+			t.Fatalf("ListAllConfigChanges failed: %v", err)
+		}
+		want := []string{"mail v1", "app v2", "plugin v1", "app v1"}
+		if len(versions) != len(want) {
+			t.Fatalf("versions mismatch: got %d, want %d", len(versions), len(want))
+		}
+		for i, v := range versions {
+			if v.Description != want[i] {
+				t.Errorf("version %d mismatch: got %q, want %q", i, v.Description, want[i])
+			}
+			if i > 0 && v.CreatedAt.After(versions[i-1].CreatedAt) {
+				t.Errorf("version %d is newer than the previous one", i)
+			}
+		}
+		if versions[0].Scope != "mail" || versions[0].Format != "toml" {
+			t.Errorf("unexpected metadata: %+v", versions[0])
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		versions, err := testDB.ListAllConfigChanges(2, 1)
+		if err != nil {
+			t.Fatalf("ListAllConfigChanges failed: %v", err)
+		}
+		if len(versions) != 2 || versions[0].Description != "app v2" || versions[1].Description != "plugin v1" {
+			t.Errorf("unexpected page: %+v", versions)
+		}
+	})
+}
+
+func TestExportLatestConfigs(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate age identity: %v", err)
+	}
+	WithConfigEncryption(identity, "secrets")(testDB)
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	versions := []struct{ scope, content string }{
+		{"application", "v = 1"},
+		{"secrets", "token = \"old\""},
+		{"application", "v = 2"},
+		{"mail", "host = \"smtp\""},
+		{"secrets", "token = \"new\""},
+		{"binary", "\xff\xfe\x00raw"},
+	}
+	for _, v := range versions {
+		clock = clock.Add(time.Second)
+		if err := testDB.InsertConfig(v.scope, []byte(v.content), "toml", ""); err != nil {
+			t.Fatalf("InsertConfig failed: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := testDB.ExportLatestConfigs(&buf); err != nil {
+		t.Fatalf("ExportLatestConfigs failed: %v", err)
+	}
+
+	want := []exportedConfig{
+		{Scope: "application", Format: "toml", Content: []byte("v = 2")},
+		{Scope: "binary", Format: "toml", Content: []byte("\xff\xfe\x00raw")},
+		{Scope: "mail", Format: "toml", Content: []byte("host = \"smtp\"")},
+		{Scope: "secrets", Format: "toml", Content: []byte("token = \"new\"")},
+	}
+	dec := json.NewDecoder(&buf)
+	var got []exportedConfig
+	for dec.More() {
+		var line exportedConfig
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("failed to decode export line: %v", err)
+		}
+		got = append(got, line)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("exported scopes mismatch: got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Scope != want[i].Scope || got[i].Format != want[i].Format || !bytes.Equal(got[i].Content, want[i].Content) {
+			t.Errorf("line %d mismatch: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	t.Run("restore non-UTF-8 content", func(t *testing.T) {
+		restoreDB := setupDB(t)
+		defer restoreDB.pool.Close()
+
+		for _, line := range got {
+			if err := restoreDB.InsertConfig(line.Scope, line.Content, line.Format, "restored"); err != nil {
+				t.Fatalf("InsertConfig failed: %v", err)
+			}
+		}
+		content, err := restoreDB.LatestConfig("binary")
+		if err != nil {
+			t.Fatalf("LatestConfig failed: %v", err)
+		}
+		if !bytes.Equal(content, []byte("\xff\xfe\x00raw")) {
+			t.Errorf("content mismatch: got %q, want %q", content, "\xff\xfe\x00raw")
+		}
+	})
+}
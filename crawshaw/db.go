@@ -1,14 +1,309 @@
 package crawshaw
 
 import (
+	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"filippo.io/age"
 	"github.com/caasmo/restinpieces/db"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/time/rate"
 )
 
+// Errors returned by methods not covered by the restinpieces db interfaces.
+// The db package only defines errors for the interface methods.
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+
+	// ErrClosed is wrapped by the errors of the methods called after Close.
+	ErrClosed = errors.New("db is closed")
+
+	// ErrRateLimited is wrapped by the config writes rejected by the limit
+	// set with WithConfigRateLimit.
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// errNilConn is returned when the pool hands out no connection, e.g. because
+// it was closed by its owner.
+var errNilConn = errors.New("connection is nil")
+
 type Db struct {
 	pool *sqlitex.Pool
+
+	// closed is set by Close. Connections are no longer acquired after it.
+	closed atomic.Bool
+
+	// rwCh holds the single connection used by all write methods when
+	// singleWriter is set (see WithSingleWriter), nil otherwise. It is set
+	// once by New and never reassigned. rwDone is closed by Close to release
+	// the writers waiting on rwCh.
+	singleWriter bool
+	rwCh         chan *sqlite.Conn
+	rwDone       chan struct{}
+
+	// ownsPool is set when the Db opened the pool itself and closes it in Close.
+	ownsPool bool
+
+	// maxConfigSize is the maximum content size in bytes accepted by InsertConfig.
+	// Zero means defaultMaxConfigSize, a negative value disables the check.
+	maxConfigSize int
+
+	// maxJobPayloadSize is the maximum payload plus payload_extra size in
+	// bytes accepted by the job inserts. Zero means defaultMaxJobPayloadSize,
+	// a negative value disables the check.
+	maxJobPayloadSize int
+
+	// recurrentJitter is the fraction of the interval MarkRecurrentCompleted
+	// may add at random to the next scheduled_for, 0 when disabled.
+	recurrentJitter float64
+
+	// ageIdentity decrypts, and its recipient encrypts, the config content of
+	// the scopes in encryptedScopes.
+	ageIdentity     *age.X25519Identity
+	encryptedScopes map[string]bool
+
+	// oauth2Backfill makes CreateUserWithOauth2 fill an existing user's empty
+	// name and avatar with the ones from the provider.
+	oauth2Backfill bool
+
+	// oauth2Conflict decides whether CreateUserWithOauth2 may link oauth2
+	// onto an existing password user.
+	oauth2Conflict Oauth2ConflictPolicy
+
+	// now is the clock for the timestamps written by the Db. When nil,
+	// timestamps are computed by SQLite with 'now'.
+	now func() time.Time
+
+	// metrics counts operations per method, nil when disabled.
+	metrics *metrics
+
+	// queryLogger logs failed statements, nil when disabled.
+	queryLogger *slog.Logger
+
+	// configCache holds the latest config per scope when enabled with
+	// EnableConfigCache, nil otherwise. configGen is bumped on every
+	// invalidation.
+	configMu    sync.RWMutex
+	configCache map[string][]byte
+	configGen   uint64
+
+	// userCache holds the users read by GetUserById for userTTL when enabled
+	// with EnableUserCache, nil otherwise. userGen is bumped on every
+	// invalidation.
+	userMu    sync.RWMutex
+	userCache map[string]userCacheEntry
+	userTTL   time.Duration
+	userGen   uint64
+
+	// configValidators holds the validators registered per scope with
+	// RegisterConfigValidator, jobSchemas the payload schemas registered per
+	// job type with RegisterJobSchema.
+	validatorsMu     sync.RWMutex
+	configValidators map[string]func([]byte) error
+	jobSchemas       map[string]*jsonschema.Schema
+
+	// configLimit and configBurst size the per scope token buckets of
+	// config writes, see WithConfigRateLimit. configLimit is 0 when disabled.
+	configLimit    rate.Limit
+	configBurst    int
+	limitersMu     sync.Mutex
+	configLimiters map[string]*rate.Limiter
+
+	// emailNormalized caches whether the users table has the email_normalized
+	// column, see hasEmailNormalized. Migrate resets it to columnUnknown.
+	emailNormalized atomic.Int32
+
+	// jobNotify is closed by NotifyNewJob to wake WaitForJob callers.
+	jobMu     sync.Mutex
+	jobNotify chan struct{}
+}
+
+// Option configures optional behavior of a Db created with New.
+type Option func(*Db)
+
+// WithMaxConfigSize sets the maximum config content size in bytes accepted by
+// InsertConfig. Defaults to 1MB. A negative value disables the check.
+func WithMaxConfigSize(bytes int) Option {
+	return func(d *Db) {
+		d.maxConfigSize = bytes
+	}
+}
+
+// WithMaxJobPayloadSize sets the maximum size in bytes of a job's payload and
+// payload extra combined accepted by InsertJob and the other job inserts.
+// Defaults to 1MB. A negative value disables the check.
+func WithMaxJobPayloadSize(bytes int) Option {
+	return func(d *Db) {
+		d.maxJobPayloadSize = bytes
+	}
+}
+
+// WithRecurrentJitter makes MarkRecurrentCompleted delay the scheduled_for of
+// the re-inserted job by a random duration up to fraction of its interval,
+// e.g. 0.1 for up to 10%. Recurrent jobs sharing an interval then spread over
+// a window instead of all becoming due at the same instant and hitting Claim
+// at once. Jobs without a scheduled_for or interval are not delayed. A
+// fraction <= 0 disables the jitter, the default.
+func WithRecurrentJitter(fraction float64) Option {
+	return func(d *Db) {
+		d.recurrentJitter = fraction
+	}
+}
+
+// WithConfigEncryption stores the config content of the given scopes encrypted
+// at rest with the age identity. InsertConfig encrypts to the identity's
+// recipient and appends "+age" to the stored format (e.g. "json+age"),
+// LatestConfig decrypts any content stored in such a format.
+// Other scopes are stored in plaintext as before. Callers must not pass formats
+// ending in "+age" themselves. The identity must not be nil, New fails otherwise.
+func WithConfigEncryption(identity *age.X25519Identity, scopes ...string) Option {
+	return func(d *Db) {
+		d.ageIdentity = identity
+		d.encryptedScopes = make(map[string]bool, len(scopes))
+		for _, scope := range scopes {
+			d.encryptedScopes[scope] = true
+		}
+	}
+}
+
+// WithOauth2ProfileBackfill makes CreateUserWithOauth2 set the name and avatar
+// given by the provider on an existing user whose name or avatar is empty.
+// By default an existing user keeps its profile untouched.
+func WithOauth2ProfileBackfill() Option {
+	return func(d *Db) {
+		d.oauth2Backfill = true
+	}
+}
+
+// Oauth2ConflictPolicy decides what CreateUserWithOauth2 does when the email
+// belongs to an existing user without oauth2.
+type Oauth2ConflictPolicy int
+
+const (
+	// Oauth2LinkIfExists adds oauth2 to the existing user. The default.
+	Oauth2LinkIfExists Oauth2ConflictPolicy = iota
+	// Oauth2FailIfExists returns db.ErrConstraintUnique, leaving the user
+	// untouched, e.g. to require the user to log in with the password first.
+	Oauth2FailIfExists
+)
+
+// WithOauth2ConflictPolicy sets the Oauth2ConflictPolicy of
+// CreateUserWithOauth2. Existing oauth2 users are never rejected, so they
+// can log in again under any policy.
+func WithOauth2ConflictPolicy(policy Oauth2ConflictPolicy) Option {
+	return func(d *Db) {
+		d.oauth2Conflict = policy
+	}
+}
+
+// WithClock makes the Db compute the timestamps it writes from now, passed as
+// binds, instead of SQLite's 'now'. Meant for tests asserting exact times.
+func WithClock(now func() time.Time) Option {
+	return func(d *Db) {
+		d.now = now
+	}
+}
+
+// sqlNow returns the time value bound to strftime in place of 'now':
+// "now" itself by default, or the clock's time when one is set.
+func (d *Db) sqlNow() string {
+	if d.now == nil {
+		return "now"
+	}
+	return db.TimeFormat(d.now())
+}
+
+// clock returns the current time from the Db clock, or time.Now.
+func (d *Db) clock() time.Time {
+	if d.now == nil {
+		return time.Now()
+	}
+	return d.now()
+}
+
+// WithMetrics enables counting of reads, writes and errors for the methods of
+// the restinpieces db interfaces. See MetricsSnapshot.
+func WithMetrics() Option {
+	return func(d *Db) {
+		d.metrics = &metrics{}
+	}
+}
+
+// WithOwnedPool transfers ownership of the pool to the Db, so Close also
+// closes the pool. Use it when the pool is not shared with the application.
+func WithOwnedPool() Option {
+	return func(d *Db) {
+		d.ownsPool = true
+	}
+}
+
+// WithSingleWriter serializes all write methods through one connection taken
+// from the pool, instead of each write using any pooled connection.
+// Use it with shared-cache databases (e.g. file:name?mode=memory&cache=shared),
+// where concurrent writers on different connections fail with table locks.
+// The connection is returned to the pool by Close, which must be called
+// before closing the pool. The pool needs at least two connections.
+func WithSingleWriter() Option {
+	return func(d *Db) {
+		d.singleWriter = true
+	}
+}
+
+// getWriteConn returns the connection for a write method: the single writer
+// connection if enabled, waiting for it to be free, else a pooled one.
+func (d *Db) getWriteConn() *sqlite.Conn {
+	if d.closed.Load() {
+		return nil
+	}
+	if d.rwCh == nil {
+		return d.pool.Get(nil)
+	}
+	select {
+	case conn := <-d.rwCh:
+		if d.closed.Load() {
+			// Close is waiting for the connection to return it to the pool.
+			d.rwCh <- conn
+			return nil
+		}
+		return conn
+	case <-d.rwDone:
+		return nil
+	}
+}
+
+// getConn acquires a pooled connection for a read, or returns nil once the
+// Db is closed. Release it with d.pool.Put.
+func (d *Db) getConn() *sqlite.Conn {
+	if d.closed.Load() {
+		return nil
+	}
+	return d.pool.Get(nil)
+}
+
+// connErr explains why no connection was acquired: ErrClosed after Close,
+// errNilConn otherwise.
+func (d *Db) connErr() error {
+	if d.closed.Load() {
+		return ErrClosed
+	}
+	return errNilConn
+}
+
+// putWriteConn releases a connection obtained with getWriteConn.
+func (d *Db) putWriteConn(conn *sqlite.Conn) {
+	if d.rwCh == nil {
+		d.pool.Put(conn)
+		return
+	}
+	d.rwCh <- conn
 }
 
 // Verify interface implementations
@@ -19,14 +314,145 @@ var _ db.DbConfig = (*Db)(nil)
 // var _ db.DbLifecycle = (*Db)(nil) // Removed
 
 // New creates a new Db instance using an existing pool provided by the user.
-// Note: The lifecycle of the provided pool (*sqlitex.Pool) is managed externally.
-// This Db type does not close the pool.
-func New(pool *sqlitex.Pool) (*Db, error) {
+// Note: The lifecycle of the provided pool (*sqlitex.Pool) is managed externally,
+// unless WithOwnedPool is given. New does not change the schema, see Migrate.
+func New(pool *sqlitex.Pool, opts ...Option) (*Db, error) {
 	if pool == nil {
 		return nil, fmt.Errorf("provided pool cannot be nil")
 	}
 	// The pool is managed externally, just store it.
-	return &Db{pool: pool}, nil
+	d := &Db{pool: pool}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if len(d.encryptedScopes) > 0 && d.ageIdentity == nil {
+		return nil, fmt.Errorf("config encryption requires a non-nil age identity")
+	}
+
+	if d.singleWriter {
+		conn := pool.Get(nil)
+		if conn == nil {
+			return nil, fmt.Errorf("failed to get db connection for single writer: %w", d.connErr())
+		}
+		d.rwCh = make(chan *sqlite.Conn, 1)
+		d.rwCh <- conn
+		d.rwDone = make(chan struct{})
+	}
+	return d, nil
+}
+
+// requiredTables are the restinpieces tables the methods of Db query.
+// There is no ACME table in the schema this package targets.
+var requiredTables = []string{"users", "job_queue", "app_config"}
+
+// NewStrict is New, but first checks that the database is in WAL journal
+// mode and that the required restinpieces tables exist, so a misconfigured
+// database fails at startup instead of degrading concurrency or failing on
+// the first query. In-memory databases cannot use WAL and are accepted.
+func NewStrict(pool *sqlitex.Pool, opts ...Option) (*Db, error) {
+	d, err := New(pool, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.checkJournalMode(); err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	if err := d.checkTables(); err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// JournalMode returns the journal mode of the database as reported by
+// PRAGMA journal_mode, e.g. "wal" for a pool from NewCrawshawPool or "delete"
+// for a pool opened without SQLITE_OPEN_WAL.
+func (d *Db) JournalMode() (string, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return "", fmt.Errorf("failed to get db connection for journal mode: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var mode string
+	err := d.exec(conn, "PRAGMA journal_mode;", func(stmt *sqlite.Stmt) error {
+		mode = stmt.ColumnText(0)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read journal mode: %w", err)
+	}
+	return mode, nil
 }
 
-// Close method removed as the pool lifecycle is managed externally.
+// checkJournalMode returns an error if the database is not in WAL mode,
+// where readers block the single writer and the other way around.
+func (d *Db) checkJournalMode() error {
+	mode, err := d.JournalMode()
+	if err != nil {
+		return err
+	}
+	if mode != "wal" && mode != "memory" {
+		return fmt.Errorf("database journal mode is %q, want \"wal\": open the pool with SQLITE_OPEN_WAL, e.g. with NewCrawshawPool", mode)
+	}
+	return nil
+}
+
+// checkTables returns an error naming the required tables missing from the
+// database.
+func (d *Db) checkTables() error {
+	conn := d.getConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for table check: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var missing []string
+	for _, name := range requiredTables {
+		found := false
+		err := d.exec(conn,
+			`SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?`,
+			func(stmt *sqlite.Stmt) error {
+				found = true
+				return nil
+			},
+			name,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to check table %s: %w", name, err)
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required tables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Close returns the single writer connection to the pool, if any, and closes
+// the pool if it is owned by the Db (see WithOwnedPool).
+// A pool managed externally is left open. Close is idempotent: calls after the
+// first return nil. The methods called after Close return an error wrapping
+// ErrClosed, whoever owns the pool.
+func (d *Db) Close() error {
+	if !d.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if d.rwCh != nil {
+		close(d.rwDone)
+		// Wait for an in-flight writer to hand the connection back.
+		d.pool.Put(<-d.rwCh)
+	}
+	if !d.ownsPool {
+		return nil
+	}
+	if err := d.pool.Close(); err != nil {
+		return fmt.Errorf("failed to close db pool: %w", err)
+	}
+	return nil
+}
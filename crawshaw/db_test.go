@@ -0,0 +1,493 @@
+package crawshaw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/caasmo/restinpieces/db"
+)
+
+// TestMethodsNilConnection checks that every method returns an error instead
+// of panicking when the pool hands out no connection.
+func TestMethodsNilConnection(t *testing.T) {
+	testDB := setupDB(t)
+	// A closed pool returns a nil connection from Get.
+	if err := testDB.pool.Close(); err != nil {
+		t.Fatalf("failed to close pool: %v", err)
+	}
+
+	job := db.Job{JobType: "test_job", Payload: json.RawMessage(`{"key":"value"}`), MaxAttempts: 3}
+	user := db.User{Email: "test@example.com", Password: "hash"}
+
+	methods := map[string]func() error{
+		"GetById":        func() error { _, err := testDB.GetById(context.Background(), 1); return err },
+		"InsertWithPool": func() error { return testDB.InsertWithPool(context.Background(), 1, 1) },
+		"KVSetMany":      func() error { return testDB.KVSetMany(map[string][]byte{"k": []byte("v")}) },
+		"LatestConfig":   func() error { _, err := testDB.LatestConfig("application"); return err },
+		"InsertConfig": func() error {
+			return testDB.InsertConfig("application", []byte("a = 1"), "toml", "")
+		},
+		"InsertConfigIfChanged": func() error {
+			_, err := testDB.InsertConfigIfChanged("application", []byte("a = 1"), "toml", "")
+			return err
+		},
+		"ListAllConfigChanges":     func() error { _, err := testDB.ListAllConfigChanges(10, 0); return err },
+		"DeleteConfigScope":        func() error { _, err := testDB.DeleteConfigScope("application"); return err },
+		"PatchConfig":              func() error { return testDB.PatchConfig("application", []byte(`{}`)) },
+		"SetActiveConfig":          func() error { return testDB.SetActiveConfig("application", 1) },
+		"ClearActiveConfig":        func() error { return testDB.ClearActiveConfig("application") },
+		"LatestConfigStream":       func() error { _, err := testDB.LatestConfigStream("application", io.Discard); return err },
+		"ExportLatestConfigs":      func() error { return testDB.ExportLatestConfigs(io.Discard) },
+		"DiffConfig":               func() error { _, _, _, err := testDB.DiffConfig("application", 1, 2); return err },
+		"Migrate":                  func() error { return testDB.Migrate() },
+		"InsertJob":                func() error { return testDB.InsertJob(job) },
+		"InsertJobWithDedupKey":    func() error { return testDB.InsertJobWithDedupKey(job, "key") },
+		"InsertJobUnique":          func() error { _, err := testDB.InsertJobUnique(job); return err },
+		"MarkCompleted":            func() error { return testDB.MarkCompleted(1) },
+		"MarkFailed":               func() error { return testDB.MarkFailed(1, "failed") },
+		"FailJob":                  func() error { _, err := testDB.FailJob(1, "boom"); return err },
+		"Claim":                    func() error { _, err := testDB.Claim(1); return err },
+		"ClaimableCount":           func() error { _, err := testDB.ClaimableCount(); return err },
+		"ClaimFair":                func() error { _, err := testDB.ClaimFair(10, 2); return err },
+		"ClaimOne":                 func() error { _, err := testDB.ClaimOne("worker", time.Minute); return err },
+		"LockExpiresAt":            func() error { _, err := testDB.LockExpiresAt(1); return err },
+		"ClaimLeased":              func() error { _, err := testDB.ClaimLeased("worker", 1, time.Minute); return err },
+		"CountJobsByErrorLike":     func() error { _, err := testDB.CountJobsByErrorLike("timeout"); return err },
+		"LeaseJobs":                func() error { _, err := testDB.LeaseJobs(1); return err },
+		"BeginAttempt":             func() error { return testDB.BeginAttempt(1) },
+		"MarkFailedNoAttempt":      func() error { return testDB.MarkFailedNoAttempt(1, "x") },
+		"MarkRecurrentCompleted":   func() error { return testDB.MarkRecurrentCompleted(1, job) },
+		"CountJobsByType":          func() error { _, err := testDB.CountJobsByType(); return err },
+		"DistinctJobTypes":         func() error { _, err := testDB.DistinctJobTypes(); return err },
+		"UpdateJobScheduledFor":    func() error { return testDB.UpdateJobScheduledFor(1, time.Now()) },
+		"SetMaxAttemptsForPending": func() error { _, err := testDB.SetMaxAttemptsForPending("test_job", 1); return err },
+		"ShiftPendingSchedule":     func() error { _, err := testDB.ShiftPendingSchedule(time.Hour); return err },
+		"RequeueDeadJobs":          func() error { _, err := testDB.RequeueDeadJobs("test_job"); return err },
+		"SetJobResult":             func() error { return testDB.SetJobResult(1, json.RawMessage(`{}`)) },
+		"JobResult":                func() error { _, err := testDB.JobResult(1); return err },
+		"TruncateJobQueue":         func() error { return testDB.TruncateJobQueue() },
+		"HeartbeatJob":             func() error { return testDB.HeartbeatJob(1, "worker") },
+		"RetypeJob":                func() error { return testDB.RetypeJob(1, "x") },
+		"Exec":                     func() error { return testDB.Exec(context.Background(), "SELECT 1") },
+		"PurgeCompletedJobs":       func() error { _, err := testDB.PurgeCompletedJobs(time.Now(), 10); return err },
+		"PurgeCompletedJobsContext": func() error {
+			_, err := testDB.PurgeCompletedJobsContext(context.Background(), time.Now(), 0)
+			return err
+		},
+		"ReleaseJobsLockedBy":   func() error { _, err := testDB.ReleaseJobsLockedBy("worker"); return err },
+		"RecoverOrphanedJobs":   func() error { _, err := testDB.RecoverOrphanedJobs(); return err },
+		"GetJobsByPayloadField": func() error { _, err := testDB.GetJobsByPayloadField("user_id", "1", 10); return err },
+		"ExportJobsCSV":         func() error { return testDB.ExportJobsCSV(io.Discard, "", 10) },
+		"GetJobsLockedBy":       func() error { _, err := testDB.GetJobsLockedBy("worker"); return err },
+		"RecentFailures":        func() error { _, err := testDB.RecentFailures(10); return err },
+		"Analyze":               func() error { return testDB.Analyze() },
+		"Flush":                 func() error { return testDB.Flush() },
+		"Vacuum":                func() error { return testDB.Vacuum() },
+		"DatabaseSizeBytes":     func() error { _, err := testDB.DatabaseSizeBytes(); return err },
+		"JournalMode":           func() error { _, err := testDB.JournalMode(); return err },
+		"WithConn":              func() error { return testDB.WithConn(context.Background(), func(*sqlite.Conn) error { return nil }) },
+		"CountTable":            func() error { _, err := testDB.CountTable("users"); return err },
+		"ExplainQueryPlan":      func() error { _, err := testDB.ExplainQueryPlan("SELECT 1"); return err },
+		"SetJobStatus":          func() error { return testDB.SetJobStatus(1, JobStatusPending, JobStatusProcessing) },
+		"GetJobByPayload": func() error {
+			_, err := testDB.GetJobByPayload(job.JobType, job.Payload)
+			return err
+		},
+		"GetUserByEmail":              func() error { _, err := testDB.GetUserByEmail(user.Email); return err },
+		"VerifyEmail":                 func() error { return testDB.VerifyEmail("1") },
+		"GetUserByEmailPasswordAuth":  func() error { _, err := testDB.GetUserByEmailPasswordAuth(user.Email); return err },
+		"GetUserByEmailOauth2":        func() error { _, err := testDB.GetUserByEmailOauth2(user.Email); return err },
+		"VerifyEmails":                func() error { _, err := testDB.VerifyEmails([]string{"1"}); return err },
+		"AuthMethodStats":             func() error { _, _, _, err := testDB.AuthMethodStats(); return err },
+		"UserVerificationCounts":      func() error { _, _, err := testDB.UserVerificationCounts(); return err },
+		"RewriteAvatarPrefix":         func() error { _, err := testDB.RewriteAvatarPrefix("https://old/", "https://new/"); return err },
+		"FindDuplicateEmails":         func() error { _, err := testDB.FindDuplicateEmails(); return err },
+		"ListUsersCreatedBetween":     func() error { _, err := testDB.ListUsersCreatedBetween(time.Time{}, time.Now(), 10, 0); return err },
+		"GetUserById":                 func() error { _, err := testDB.GetUserById("1"); return err },
+		"CreateUserWithPassword":      func() error { _, err := testDB.CreateUserWithPassword(user); return err },
+		"CreateUserWithOauth2":        func() error { _, err := testDB.CreateUserWithOauth2(user); return err },
+		"UpsertUserWithOauth2":        func() error { _, _, err := testDB.UpsertUserWithOauth2(user); return err },
+		"UpdatePassword":              func() error { return testDB.UpdatePassword("1", "hash") },
+		"ClearPassword":               func() error { return testDB.ClearPassword("1") },
+		"RecordLogin":                 func() error { return testDB.RecordLogin("user1", time.Now()) },
+		"LastLoginAt":                 func() error { _, err := testDB.LastLoginAt("user1"); return err },
+		"ListInactiveUsers":           func() error { _, err := testDB.ListInactiveUsers(time.Now(), 10, 0); return err },
+		"RegisterNewUserWithPassword": func() error { _, err := testDB.RegisterNewUserWithPassword(user); return err },
+		"UpdateEmail":                 func() error { return testDB.UpdateEmail("1", "new@example.com") },
+		"ChangeEmail":                 func() error { return testDB.ChangeEmail("1", "new@example.com") },
+		"UpdatePasswordIfMatches":     func() error { _, err := testDB.UpdatePasswordIfMatches("1", "hash", "new"); return err },
+	}
+
+	for name, method := range methods {
+		t.Run(name, func(t *testing.T) {
+			if err := method(); err == nil {
+				t.Error("expected error for nil connection, got nil")
+			}
+		})
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	fixed := time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)
+	WithClock(func() time.Time { return fixed })(testDB)
+	want := db.TimeFormat(fixed)
+
+	t.Run("job timestamps", func(t *testing.T) {
+		payload := json.RawMessage(`{"key":"clock"}`)
+		if err := testDB.InsertJob(db.Job{JobType: "test_job", Payload: payload, MaxAttempts: 3}); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+		claimed, err := testDB.Claim(1)
+		if err != nil {
+			t.Fatalf("Claim failed: %v", err)
+		}
+		if len(claimed) != 1 {
+			t.Fatalf("claimed jobs mismatch: got %d, want 1", len(claimed))
+		}
+		if err := testDB.MarkCompleted(claimed[0].ID); err != nil {
+			t.Fatalf("MarkCompleted failed: %v", err)
+		}
+
+		job, err := testDB.GetJobByPayload("test_job", payload)
+		if err != nil {
+			t.Fatalf("GetJobByPayload failed: %v", err)
+		}
+		for name, got := range map[string]time.Time{
+			"created_at":   job.CreatedAt,
+			"updated_at":   job.UpdatedAt,
+			"locked_at":    claimed[0].LockedAt,
+			"completed_at": job.CompletedAt,
+		} {
+			if !got.Equal(fixed) {
+				t.Errorf("%s mismatch: got %v, want %v", name, got, fixed)
+			}
+		}
+	})
+
+	t.Run("user timestamps", func(t *testing.T) {
+		user, err := testDB.CreateUserWithPassword(db.User{Email: "clock@example.com", Password: "hash"})
+		if err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+		if db.TimeFormat(user.Created) != want || db.TimeFormat(user.Updated) != want {
+			t.Errorf("user timestamps mismatch: got created %v updated %v, want %s", user.Created, user.Updated, want)
+		}
+	})
+
+	t.Run("scheduling", func(t *testing.T) {
+		// A job due after the clock's time is not claimable, whatever the wall time.
+		job := db.Job{
+			JobType:      "test_job",
+			Payload:      json.RawMessage(`{"key":"later"}`),
+			MaxAttempts:  3,
+			ScheduledFor: fixed.Add(time.Minute),
+		}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+		claimed, err := testDB.Claim(10)
+		if err != nil {
+			t.Fatalf("Claim failed: %v", err)
+		}
+		if len(claimed) != 0 {
+			t.Errorf("expected no claimable job before its schedule, got %d", len(claimed))
+		}
+	})
+}
+
+func TestWithSingleWriter(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	// setupDB uses a shared-cache in-memory database: concurrent writes on
+	// different connections fail with table locks unless serialized.
+	writerDB, err := New(testDB.pool, WithSingleWriter())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer writerDB.Close()
+
+	const workers, perWorker = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*perWorker*2)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				job := db.Job{
+					JobType:     "test_job",
+					Payload:     json.RawMessage(fmt.Sprintf(`{"worker":%d,"i":%d}`, w, i)),
+					MaxAttempts: 3,
+				}
+				if err := writerDB.InsertJob(job); err != nil {
+					errs <- fmt.Errorf("InsertJob: %w", err)
+				}
+				user := db.User{Email: fmt.Sprintf("writer%d-%d@example.com", w, i), Password: "hash"}
+				if _, err := writerDB.CreateUserWithPassword(user); err != nil {
+					errs <- fmt.Errorf("CreateUserWithPassword: %w", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent write failed: %v", err)
+	}
+
+	counts, err := writerDB.CountJobsByType()
+	if err != nil {
+		t.Fatalf("CountJobsByType failed: %v", err)
+	}
+	if counts["test_job"] != workers*perWorker {
+		t.Errorf("job count mismatch: got %d, want %d", counts["test_job"], workers*perWorker)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	// assertClosed checks that methods of each kind of connection acquisition
+	// fail with ErrClosed instead of panicking or blocking.
+	assertClosed := func(t *testing.T, d *Db) {
+		t.Helper()
+
+		methods := map[string]func() error{
+			"GetUserById": func() error { _, err := d.GetUserById("1"); return err },
+			"InsertJob": func() error {
+				return d.InsertJob(db.Job{JobType: "test_job", Payload: json.RawMessage(`{}`), MaxAttempts: 1})
+			},
+			"Claim":   func() error { _, err := d.Claim(1); return err },
+			"Exec":    func() error { return d.Exec(context.Background(), "SELECT 1") },
+			"GetById": func() error { _, err := d.GetById(context.Background(), 1); return err },
+			"PurgeCompletedJobsContext": func() error {
+				_, err := d.PurgeCompletedJobsContext(context.Background(), time.Now(), 10)
+				return err
+			},
+		}
+		for name, method := range methods {
+			if err := method(); !errors.Is(err, ErrClosed) {
+				t.Errorf("%s: expected ErrClosed, got %v", name, err)
+			}
+		}
+	}
+
+	t.Run("owned pool", func(t *testing.T) {
+		pool, err := sqlitex.Open("file:closetest?mode=memory&cache=shared", 0, 2)
+		if err != nil {
+			t.Fatalf("failed to open pool: %v", err)
+		}
+		d, err := New(pool, WithOwnedPool(), WithSingleWriter())
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := d.Close(); err != nil {
+				t.Fatalf("Close %d failed: %v", i+1, err)
+			}
+		}
+		assertClosed(t, d)
+	})
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		testDB := setupDB(t)
+		defer testDB.pool.Close()
+
+		d, err := New(testDB.pool, WithSingleWriter())
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+
+		// Writers racing Close must all return, either having written or
+		// with ErrClosed, instead of blocking on the writer connection.
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					payload := json.RawMessage(fmt.Sprintf(`{"worker":%d,"i":%d}`, w, i))
+					err := d.InsertJob(db.Job{JobType: "test_job", Payload: payload, MaxAttempts: 1})
+					if errors.Is(err, ErrClosed) {
+						return
+					}
+					if err != nil {
+						t.Errorf("InsertJob failed: %v", err)
+						return
+					}
+				}
+			}(w)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := d.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		wg.Wait()
+		assertClosed(t, d)
+	})
+
+	t.Run("external pool", func(t *testing.T) {
+		testDB := setupDB(t)
+		defer testDB.pool.Close()
+
+		d, err := New(testDB.pool)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		assertClosed(t, d)
+
+		// The pool itself stays usable by its owner.
+		if _, err := testDB.GetUserById("1"); err != nil {
+			t.Errorf("GetUserById on the open pool failed: %v", err)
+		}
+	})
+}
+
+func TestReadOnlyDb(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	ro, err := NewReadOnly(testDB.pool)
+	if err != nil {
+		t.Fatalf("NewReadOnly failed: %v", err)
+	}
+
+	t.Run("forwards Db signatures", func(t *testing.T) {
+		roType := reflect.TypeOf(ro)
+		dbType := reflect.TypeOf(testDB)
+		for i := 0; i < roType.NumMethod(); i++ {
+			method := roType.Method(i)
+			dbMethod, ok := dbType.MethodByName(method.Name)
+			if !ok {
+				t.Errorf("%s: no such method on Db", method.Name)
+				continue
+			}
+			// Compare without the receiver.
+			roFunc, dbFunc := method.Type, dbMethod.Type
+			if roFunc.NumIn() != dbFunc.NumIn() || roFunc.NumOut() != dbFunc.NumOut() {
+				t.Errorf("%s: signature mismatch: %v vs %v", method.Name, roFunc, dbFunc)
+				continue
+			}
+			for j := 1; j < roFunc.NumIn(); j++ {
+				if roFunc.In(j) != dbFunc.In(j) {
+					t.Errorf("%s: argument %d mismatch: %v vs %v", method.Name, j, roFunc.In(j), dbFunc.In(j))
+				}
+			}
+			for j := 0; j < roFunc.NumOut(); j++ {
+				if roFunc.Out(j) != dbFunc.Out(j) {
+					t.Errorf("%s: result %d mismatch: %v vs %v", method.Name, j, roFunc.Out(j), dbFunc.Out(j))
+				}
+			}
+		}
+	})
+
+	t.Run("no write methods", func(t *testing.T) {
+		for _, name := range []string{"InsertJob", "InsertConfig", "CreateUserWithPassword", "Claim", "Exec", "Close"} {
+			if _, ok := reflect.TypeOf(ro).MethodByName(name); ok {
+				t.Errorf("ReadOnlyDb exposes write method %s", name)
+			}
+		}
+	})
+
+	t.Run("reads", func(t *testing.T) {
+		if _, err := ro.ClaimableCount(); err != nil {
+			t.Errorf("ClaimableCount failed: %v", err)
+		}
+		if _, err := ro.DistinctJobTypes(); err != nil {
+			t.Errorf("DistinctJobTypes failed: %v", err)
+		}
+		if _, err := ro.ListAllConfigChanges(10, 0); err != nil {
+			t.Errorf("ListAllConfigChanges failed: %v", err)
+		}
+		if user, err := ro.GetUserByEmailPasswordAuth("nobody@example.com"); err != nil || user != nil {
+			t.Errorf("GetUserByEmailPasswordAuth: expected no user, got %v, %v", user, err)
+		}
+	})
+}
+
+func TestNewStrict(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	t.Run("complete schema", func(t *testing.T) {
+		if _, err := NewStrict(testDB.pool); err != nil {
+			t.Errorf("NewStrict failed: %v", err)
+		}
+	})
+
+	t.Run("missing tables", func(t *testing.T) {
+		conn := testDB.pool.Get(context.TODO())
+		err := sqlitex.ExecScript(conn, "DROP TABLE job_queue; DROP TABLE app_config;")
+		testDB.pool.Put(conn)
+		if err != nil {
+			t.Fatalf("failed to drop tables: %v", err)
+		}
+
+		_, err = NewStrict(testDB.pool)
+		if err == nil {
+			t.Fatal("expected an error for missing tables")
+		}
+		if !strings.Contains(err.Error(), "job_queue, app_config") {
+			t.Errorf("error should list the missing tables, got %v", err)
+		}
+	})
+}
+
+func TestJournalMode(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("wal pool", func(t *testing.T) {
+		pool, err := sqlitex.Open(filepath.Join(dir, "wal.db"), 0, 2)
+		if err != nil {
+			t.Fatalf("failed to open pool: %v", err)
+		}
+		defer pool.Close()
+
+		mode, err := (&Db{pool: pool}).JournalMode()
+		if err != nil {
+			t.Fatalf("JournalMode failed: %v", err)
+		}
+		if mode != "wal" {
+			t.Errorf("journal mode mismatch: got %q, want %q", mode, "wal")
+		}
+	})
+
+	t.Run("rollback journal pool", func(t *testing.T) {
+		flags := sqlite.SQLITE_OPEN_READWRITE | sqlite.SQLITE_OPEN_CREATE | sqlite.SQLITE_OPEN_URI | sqlite.SQLITE_OPEN_NOMUTEX
+		pool, err := sqlitex.Open(filepath.Join(dir, "delete.db"), flags, 2)
+		if err != nil {
+			t.Fatalf("failed to open pool: %v", err)
+		}
+		defer pool.Close()
+
+		mode, err := (&Db{pool: pool}).JournalMode()
+		if err != nil {
+			t.Fatalf("JournalMode failed: %v", err)
+		}
+		if mode == "wal" {
+			t.Errorf("expected a non-wal journal mode, got %q", mode)
+		}
+
+		_, err = NewStrict(pool)
+		if err == nil || !strings.Contains(err.Error(), "journal mode") {
+			t.Errorf("expected NewStrict journal mode error, got %v", err)
+		}
+	})
+}
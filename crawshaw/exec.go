@@ -0,0 +1,102 @@
+package crawshaw
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"crawshaw.io/sqlite"
+)
+
+// identifierPattern matches the names accepted where a table or JSON field
+// name is spliced into SQL: a plain identifier, so it cannot carry SQL.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// interruptOn makes statements run on conn abort with SQLITE_INTERRUPT once ctx
+// is done. The returned func restores the previous interrupt and must be
+// called before the connection is put back in the pool.
+func interruptOn(conn *sqlite.Conn, ctx context.Context) (restore func()) {
+	prev := conn.SetInterrupt(ctx.Done())
+	return func() {
+		conn.SetInterrupt(prev)
+	}
+}
+
+// Exec runs a statement that returns no rows on a pooled connection.
+// Canceling ctx interrupts the statement instead of letting it run to
+// completion.
+func (d *Db) Exec(ctx context.Context, query string, args ...any) error {
+	return d.Query(ctx, query, nil, args...)
+}
+
+// Query runs query on a pooled connection, calling fn for each result row.
+// Canceling ctx interrupts the query instead of letting it run to completion.
+func (d *Db) Query(ctx context.Context, query string, fn func(stmt *sqlite.Stmt) error, args ...any) error {
+	if d.closed.Load() {
+		return fmt.Errorf("failed to get db connection for query: %w", ErrClosed)
+	}
+	conn := d.pool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for query: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	restore := interruptOn(conn, ctx)
+	defer restore()
+
+	if err := d.exec(conn, query, fn, args...); err != nil {
+		return fmt.Errorf("failed to run query: %w", err)
+	}
+	return nil
+}
+
+// WithConn runs fn with a single pooled connection, for several statements
+// that must share it, e.g. a temp table used across queries. No transaction
+// is started. The ctx deadline bounds connection acquisition, defaultTimeout
+// applies without one, and only canceling ctx interrupts the statements of
+// fn: the default timeout does not. fn must not keep the connection, and
+// should drop the temp objects it creates: the connection goes back to the
+// pool when fn returns.
+func (d *Db) WithConn(ctx context.Context, fn func(*sqlite.Conn) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	conn, cancel := d.getWithTimeout(ctx)
+	defer cancel()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for with conn: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	// The pool tied the interrupt to the acquisition timeout, tie it to ctx.
+	restore := interruptOn(conn, ctx)
+	defer restore()
+
+	return fn(conn)
+}
+
+// CountTable returns the number of rows of table, for applications sharing
+// the pool with their own tables. The name must be a plain identifier, it is
+// rejected otherwise as it cannot be bound as a parameter.
+func (d *Db) CountTable(table string) (int64, error) {
+	if !identifierPattern.MatchString(table) {
+		return 0, fmt.Errorf("invalid table name %q: must be a simple identifier", table)
+	}
+
+	conn := d.getConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for count table: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var count int64
+	err := d.exec(conn, `SELECT COUNT(*) FROM "`+table+`"`,
+		func(stmt *sqlite.Stmt) error {
+			count = stmt.ColumnInt64(0)
+			return nil
+		})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count rows of table %s: %w", table, err)
+	}
+	return count, nil
+}
@@ -0,0 +1,144 @@
+package crawshaw
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+func TestQueryInterruptedByContext(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	slow := `WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 1000000000)
+		SELECT COUNT(*) FROM n`
+
+	start := time.Now()
+	err := testDB.Query(ctx, slow, func(stmt *sqlite.Stmt) error { return nil })
+	var sqlErr sqlite.Error
+	if !errors.As(err, &sqlErr) || sqlErr.Code != sqlite.SQLITE_INTERRUPT {
+		t.Fatalf("expected SQLITE_INTERRUPT, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("query was not interrupted promptly, took %v", elapsed)
+	}
+
+	// The connection is usable again once back in the pool.
+	var one int64
+	err = testDB.Query(context.Background(), "SELECT 1", func(stmt *sqlite.Stmt) error {
+		one = stmt.ColumnInt64(0)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Query after interrupt failed: %v", err)
+	}
+	if one != 1 {
+		t.Errorf("result mismatch: got %d, want 1", one)
+	}
+
+	if err := testDB.Exec(context.Background(), "CREATE TEMP TABLE exec_test (id INTEGER)"); err != nil {
+		t.Errorf("Exec failed: %v", err)
+	}
+}
+
+func TestWithConn(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	var total int64
+	err := testDB.WithConn(context.Background(), func(conn *sqlite.Conn) error {
+		script := `CREATE TEMP TABLE scratch (n INTEGER);
+			INSERT INTO scratch (n) VALUES (1), (2), (3);`
+		if err := sqlitex.ExecScript(conn, script); err != nil {
+			return err
+		}
+		err := sqlitex.Exec(conn, `SELECT SUM(n) FROM scratch`, func(stmt *sqlite.Stmt) error {
+			total = stmt.ColumnInt64(0)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return sqlitex.ExecScript(conn, `DROP TABLE scratch;`)
+	})
+	if err != nil {
+		t.Fatalf("WithConn failed: %v", err)
+	}
+	if total != 6 {
+		t.Errorf("sum mismatch: got %d, want 6", total)
+	}
+
+	wantErr := errors.New("fn failed")
+	if err := testDB.WithConn(context.Background(), func(*sqlite.Conn) error { return wantErr }); err != wantErr {
+		t.Errorf("expected the error of fn, got %v", err)
+	}
+}
+
+func TestWithConnInterrupt(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	t.Run("outlives default timeout", func(t *testing.T) {
+		err := testDB.WithConn(context.Background(), func(conn *sqlite.Conn) error {
+			time.Sleep(defaultTimeout + 200*time.Millisecond)
+			return sqlitex.Exec(conn, "SELECT 1", nil)
+		})
+		if err != nil {
+			t.Errorf("statement after the default timeout failed: %v", err)
+		}
+	})
+
+	t.Run("canceled ctx", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := testDB.WithConn(ctx, func(conn *sqlite.Conn) error {
+			cancel()
+			return sqlitex.Exec(conn, "SELECT 1", nil)
+		})
+		var sqlErr sqlite.Error
+		if !errors.As(err, &sqlErr) || sqlErr.Code != sqlite.SQLITE_INTERRUPT {
+			t.Errorf("expected SQLITE_INTERRUPT, got %v", err)
+		}
+	})
+}
+
+func TestCountTable(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	conn := testDB.pool.Get(context.TODO())
+	err := sqlitex.ExecScript(conn, `CREATE TABLE IF NOT EXISTS app_items (n INTEGER);
+		DELETE FROM app_items;
+		INSERT INTO app_items (n) VALUES (1), (2), (3);`)
+	testDB.pool.Put(conn)
+	if err != nil {
+		t.Fatalf("failed to create app table: %v", err)
+	}
+
+	t.Run("valid table", func(t *testing.T) {
+		count, err := testDB.CountTable("app_items")
+		if err != nil {
+			t.Fatalf("CountTable failed: %v", err)
+		}
+		if count != 3 {
+			t.Errorf("count mismatch: got %d, want 3", count)
+		}
+	})
+
+	t.Run("injection attempt", func(t *testing.T) {
+		for _, table := range []string{`users; DROP TABLE users`, `users" WHERE 1=1 --`, "", "main.users"} {
+			if _, err := testDB.CountTable(table); err == nil {
+				t.Errorf("expected table name %q to be rejected", table)
+			}
+		}
+		if _, err := testDB.CountTable("users"); err != nil {
+			t.Errorf("users table should be intact: %v", err)
+		}
+	})
+}
@@ -0,0 +1,31 @@
+package crawshaw
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+)
+
+// ExplainQueryPlan runs EXPLAIN QUERY PLAN for sql with the given arguments
+// and returns the detail column of each plan row, e.g.
+// "SEARCH users USING INDEX idx_users_email_normalized (email_normalized=?)".
+// Use it to confirm a statement hits the expected index when tuning.
+func (d *Db) ExplainQueryPlan(sql string, args ...any) ([]string, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for explain query plan: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var plan []string
+	err := d.exec(conn, "EXPLAIN QUERY PLAN "+sql,
+		func(stmt *sqlite.Stmt) error {
+			plan = append(plan, stmt.GetText("detail"))
+			return nil
+		}, args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to explain query plan: %w", err)
+	}
+	return plan, nil
+}
@@ -0,0 +1,28 @@
+package crawshaw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExplainQueryPlan(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	plan, err := testDB.ExplainQueryPlan(userByEmailSQL, "test@example.com")
+	if err != nil {
+		t.Fatalf("ExplainQueryPlan failed: %v", err)
+	}
+	if len(plan) == 0 {
+		t.Fatal("expected at least one plan row")
+	}
+
+	joined := strings.Join(plan, "\n")
+	if !strings.Contains(joined, "idx_users_email_normalized") {
+		t.Errorf("expected GetUserByEmail to use idx_users_email_normalized, got plan:\n%s", joined)
+	}
+
+	if _, err := testDB.ExplainQueryPlan("SELECT * FROM no_such_table"); err == nil {
+		t.Error("expected error for invalid sql, got nil")
+	}
+}
@@ -0,0 +1,96 @@
+package crawshaw
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Analyze runs ANALYZE so the query planner has up-to-date statistics for the
+// indexes used by Claim and the user lookups. Run it after large imports or
+// bulk deletes, when the table sizes change significantly.
+func (d *Db) Analyze() error {
+	conn := d.getConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for analyze: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	if err := sqlitex.ExecTransient(conn, "ANALYZE;", nil); err != nil {
+		return fmt.Errorf("failed to analyze: %w", err)
+	}
+	return nil
+}
+
+// Flush checkpoints the WAL into the main database file with a FULL
+// checkpoint, so writes committed before the call no longer depend on the
+// WAL file, e.g. after a critical write. It waits for concurrent writers to
+// finish and for readers to move past the checkpointed frames, and rewrites
+// the pages into the main file with an fsync: use it sparingly, not after
+// every write. Returns an error if the checkpoint could not complete.
+func (d *Db) Flush() error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for flush: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	var busy, logFrames, checkpointed int64
+	err := sqlitex.ExecTransient(conn, "PRAGMA wal_checkpoint(FULL);",
+		func(stmt *sqlite.Stmt) error {
+			busy = stmt.ColumnInt64(0)
+			logFrames = stmt.ColumnInt64(1)
+			checkpointed = stmt.ColumnInt64(2)
+			return nil
+		})
+	if err != nil {
+		return fmt.Errorf("failed to flush: %w", err)
+	}
+	if busy != 0 {
+		return fmt.Errorf("failed to flush: checkpoint blocked, %d of %d wal frames checkpointed", checkpointed, logFrames)
+	}
+	return nil
+}
+
+// Vacuum rebuilds the database file to return the space freed by large
+// deletes, e.g. after PurgeCompletedJobs, to the filesystem. VACUUM needs
+// exclusive access: it waits for, and then blocks, every other writer and
+// reader for its whole duration, and needs up to twice the database size of
+// free disk. Run it in maintenance windows.
+func (d *Db) Vacuum() error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for vacuum: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	if err := sqlitex.ExecTransient(conn, "VACUUM;", nil); err != nil {
+		return fmt.Errorf("failed to vacuum: %w", err)
+	}
+	return nil
+}
+
+// DatabaseSizeBytes returns the size of the main database file as reported by
+// SQLite, page_count * page_size, e.g. for storage monitoring where the file
+// path is not reachable. The WAL file is not included, and pages freed by
+// deletes are counted until Vacuum runs.
+func (d *Db) DatabaseSizeBytes() (int64, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for database size: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var size int64
+	err := d.exec(conn,
+		`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`,
+		func(stmt *sqlite.Stmt) error {
+			size = stmt.ColumnInt64(0)
+			return nil
+		})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read database size: %w", err)
+	}
+	return size, nil
+}
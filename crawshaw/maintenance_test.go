@@ -0,0 +1,182 @@
+package crawshaw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/caasmo/restinpieces/db"
+)
+
+func TestAnalyze(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	for i := 0; i < 50; i++ {
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+		if _, err := testDB.CreateUserWithPassword(db.User{Email: fmt.Sprintf("user%d@example.com", i), Password: "hash"}); err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+	}
+
+	if err := testDB.Analyze(); err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	conn := testDB.pool.Get(nil)
+	defer testDB.pool.Put(conn)
+
+	var stats int64
+	err := sqlitex.Exec(conn, "SELECT COUNT(*) FROM sqlite_stat1 WHERE tbl = 'job_queue'",
+		func(stmt *sqlite.Stmt) error {
+			stats = stmt.ColumnInt64(0)
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("failed to query sqlite_stat1: %v", err)
+	}
+	if stats == 0 {
+		t.Error("expected statistics for job_queue after Analyze")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "app.db")
+
+	// Flags 0 open the pool in WAL mode.
+	pool, err := sqlitex.Open(dbPath, 0, 2)
+	if err != nil {
+		t.Fatalf("failed to open pool: %v", err)
+	}
+	defer pool.Close()
+
+	conn := pool.Get(context.TODO())
+	for _, tbl := range tables {
+		if err := sqlitex.ExecScript(conn, tbl.schema); err != nil {
+			t.Fatalf("failed to create %s table: %v", tbl.name, err)
+		}
+	}
+	pool.Put(conn)
+
+	testDB, err := New(pool)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := testDB.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if err := testDB.InsertConfig("acme", []byte("cert"), "pem", "critical write"); err != nil {
+		t.Fatalf("InsertConfig failed: %v", err)
+	}
+	if err := testDB.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// Simulate a crash losing the WAL: reopen a copy of the main file alone.
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("failed to read db file: %v", err)
+	}
+	copyPath := filepath.Join(dir, "copy.db")
+	if err := os.WriteFile(copyPath, data, 0o600); err != nil {
+		t.Fatalf("failed to write db copy: %v", err)
+	}
+
+	copyConn, err := sqlite.OpenConn(copyPath, 0)
+	if err != nil {
+		t.Fatalf("failed to open db copy: %v", err)
+	}
+	defer copyConn.Close()
+
+	var content string
+	err = sqlitex.Exec(copyConn, `SELECT content FROM app_config WHERE scope = 'acme'`,
+		func(stmt *sqlite.Stmt) error {
+			content = stmt.ColumnText(0)
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("failed to read config from copy: %v", err)
+	}
+	if content != "cert" {
+		t.Errorf("flushed config mismatch: got %q, want %q", content, "cert")
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	for i := 0; i < 200; i++ {
+		payload := json.RawMessage(fmt.Sprintf(`{"n":%d,"pad":"%0512d"}`, i, 0))
+		if err := testDB.InsertJob(db.Job{JobType: "test_job", Payload: payload, MaxAttempts: 3}); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+	if err := testDB.TruncateJobQueue(); err != nil {
+		t.Fatalf("TruncateJobQueue failed: %v", err)
+	}
+
+	freePages := func() int64 {
+		t.Helper()
+		conn := testDB.pool.Get(context.TODO())
+		defer testDB.pool.Put(conn)
+		var n int64
+		err := sqlitex.Exec(conn, "PRAGMA freelist_count;", func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to read freelist_count: %v", err)
+		}
+		return n
+	}
+
+	if freePages() == 0 {
+		t.Fatal("expected free pages after the delete")
+	}
+	if err := testDB.Vacuum(); err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+	if n := freePages(); n != 0 {
+		t.Errorf("expected no free pages after vacuum, got %d", n)
+	}
+}
+
+func TestDatabaseSizeBytes(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	before, err := testDB.DatabaseSizeBytes()
+	if err != nil {
+		t.Fatalf("DatabaseSizeBytes failed: %v", err)
+	}
+	if before <= 0 {
+		t.Fatalf("expected a positive size, got %d", before)
+	}
+
+	payload := strings.Repeat("x", 1024)
+	for i := 0; i < 100; i++ {
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(fmt.Sprintf(`{"n":%d,"pad":%q}`, i, payload)), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+
+	after, err := testDB.DatabaseSizeBytes()
+	if err != nil {
+		t.Fatalf("DatabaseSizeBytes failed: %v", err)
+	}
+	if after <= before {
+		t.Errorf("expected size to grow after inserts: before %d, after %d", before, after)
+	}
+}
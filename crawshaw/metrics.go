@@ -0,0 +1,62 @@
+package crawshaw
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Operation kinds counted by the metrics collector.
+const (
+	opRead  = "read"
+	opWrite = "write"
+	opError = "error"
+)
+
+// metricKey identifies a counter. A struct rather than a joined string, so
+// recording does not allocate.
+type metricKey struct {
+	method, kind string
+}
+
+// metrics counts operations per Db method with atomic counters, so recording
+// takes no lock once a counter exists.
+type metrics struct {
+	counters sync.Map // metricKey -> *atomic.Uint64
+}
+
+// observe counts one operation of kind for method, plus an error if err is not nil.
+// It is a no-op on a nil collector, so methods can call it unconditionally.
+func (m *metrics) observe(method, kind string, err error) {
+	if m == nil {
+		return
+	}
+	m.inc(metricKey{method, kind})
+	if err != nil {
+		m.inc(metricKey{method, opError})
+	}
+}
+
+func (m *metrics) inc(key metricKey) {
+	c, ok := m.counters.Load(key)
+	if !ok {
+		c, _ = m.counters.LoadOrStore(key, new(atomic.Uint64))
+	}
+	c.(*atomic.Uint64).Add(1)
+}
+
+// MetricsSnapshot returns the current operation counters keyed by
+// "<method>.<kind>", where kind is "read", "write" or "error",
+// e.g. "GetUserByEmail.read". Only counters that have advanced are present.
+// Returns an empty map when metrics are not enabled with WithMetrics.
+func (d *Db) MetricsSnapshot() map[string]uint64 {
+	snapshot := make(map[string]uint64)
+	if d.metrics == nil {
+		return snapshot
+	}
+	d.metrics.counters.Range(func(key, value any) bool {
+		k := key.(metricKey)
+		snapshot[k.method+"."+k.kind] = value.(*atomic.Uint64).Load()
+		return true
+	})
+	return snapshot
+}
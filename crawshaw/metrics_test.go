@@ -0,0 +1,63 @@
+package crawshaw
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/caasmo/restinpieces/db"
+)
+
+func TestMetricsSnapshot(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	if got := testDB.MetricsSnapshot(); len(got) != 0 {
+		t.Errorf("expected empty snapshot with metrics disabled, got %v", got)
+	}
+
+	WithMetrics()(testDB)
+
+	if _, err := testDB.CreateUserWithPassword(db.User{Email: "metrics@test.com", Password: "hash"}); err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := testDB.GetUserByEmail("metrics@test.com"); err != nil {
+			t.Fatalf("GetUserByEmail failed: %v", err)
+		}
+	}
+
+	job := db.Job{JobType: "test_job", Payload: json.RawMessage(`{"key":"metrics"}`), MaxAttempts: 3}
+	if err := testDB.InsertJob(job); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+	if err := testDB.InsertJob(job); err == nil {
+		t.Fatal("expected duplicate insert to fail")
+	}
+
+	want := map[string]uint64{
+		"CreateUserWithPassword.write": 1,
+		"GetUserByEmail.read":          2,
+		"InsertJob.write":              2,
+		"InsertJob.error":              1,
+	}
+	got := testDB.MetricsSnapshot()
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("counter %s mismatch: got %d, want %d", key, got[key], value)
+		}
+	}
+	if _, ok := got["GetUserByEmail.error"]; ok {
+		t.Error("unexpected error counter for GetUserByEmail")
+	}
+}
+
+func TestMetricsObserveNoAlloc(t *testing.T) {
+	m := &metrics{}
+	m.observe("GetUserByEmail", opRead, nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		m.observe("GetUserByEmail", opRead, nil)
+	})
+	if allocs != 0 {
+		t.Errorf("observe allocated %.1f times per call, want 0", allocs)
+	}
+}
@@ -0,0 +1,98 @@
+package crawshaw
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Values of Db.emailNormalized.
+const (
+	columnUnknown int32 = iota
+	columnPresent
+	columnMissing
+)
+
+// schemaMigrations extend the restinpieces schema (see migrations.Schema())
+// with the columns, indexes and tables used by this package. They are applied
+// in order by Migrate, each exactly once per database. Append new migrations,
+// never edit or reorder applied ones.
+var schemaMigrations = []string{
+	// 1: case and whitespace insensitive email lookups for GetUserByEmail.
+	`ALTER TABLE users ADD COLUMN email_normalized TEXT
+		GENERATED ALWAYS AS (lower(trim(email, ' ' || char(9, 10, 13)))) VIRTUAL;
+	CREATE INDEX IF NOT EXISTS idx_users_email_normalized ON users(email_normalized);`,
+
+	// 2: per scope pointer to the active app_config version, see SetActiveConfig.
+	`CREATE TABLE IF NOT EXISTS crawshaw_config_active (
+		scope TEXT PRIMARY KEY,
+		version_id INTEGER NOT NULL
+	);`,
+
+	// 3: caller provided idempotency key of a job, see InsertJobWithDedupKey.
+	`ALTER TABLE job_queue ADD COLUMN dedup_key TEXT NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_job_queue_dedup_key ON job_queue(job_type, dedup_key) WHERE dedup_key != '';`,
+
+	// 4: time of the last successful authentication, see RecordLogin.
+	`ALTER TABLE users ADD COLUMN last_login_at TEXT;`,
+
+	// 5: key-value store, see KVSetMany.
+	`CREATE TABLE IF NOT EXISTS crawshaw_kv (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL
+	);`,
+
+	// 6: output of a job read back by the enqueuer, see SetJobResult.
+	`ALTER TABLE job_queue ADD COLUMN result TEXT NOT NULL DEFAULT '';`,
+
+	// 7: end of the lease of a processing job, empty without lease, see ClaimOne.
+	`ALTER TABLE job_queue ADD COLUMN lock_expires_at TEXT NOT NULL DEFAULT '';`,
+}
+
+// Migrate applies the pending schema migrations of this package. The
+// restinpieces tables must already exist. Applied versions are recorded in
+// the crawshaw_schema_migrations table, so Migrate is safe to call on every
+// startup.
+//
+// Besides creating its own tables, Migrate ALTERs the users and job_queue
+// tables owned by restinpieces to add columns and indexes. New does not
+// migrate: WithDbCrawshaw and WithDbCrawshawPath do, other callers must call
+// Migrate themselves to use the methods that need the added columns.
+func (d *Db) Migrate() error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for migrate: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := sqlitex.ExecScript(conn, `CREATE TABLE IF NOT EXISTS crawshaw_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+	);`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var current int
+	err = d.exec(conn, `SELECT COALESCE(MAX(version), 0) FROM crawshaw_schema_migrations`,
+		func(stmt *sqlite.Stmt) error {
+			current = stmt.ColumnInt(0)
+			return nil
+		})
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(schemaMigrations); i++ {
+		version := i + 1
+		script := fmt.Sprintf("%s\nINSERT INTO crawshaw_schema_migrations (version) VALUES (%d);",
+			schemaMigrations[i], version)
+		if err := sqlitex.ExecScript(conn, script); err != nil {
+			return fmt.Errorf("failed to apply schema migration %d: %w", version, err)
+		}
+	}
+	d.emailNormalized.Store(columnUnknown)
+
+	return nil
+}
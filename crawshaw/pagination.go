@@ -0,0 +1,24 @@
+package crawshaw
+
+// Limits applied by normalizeLimitOffset to the list methods.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// normalizeLimitOffset clamps the pagination arguments of a list method before
+// they reach SQL, where a negative LIMIT means no limit at all. A limit <= 0
+// becomes defaultListLimit, a limit above maxListLimit becomes maxListLimit,
+// and a negative offset becomes 0.
+func normalizeLimitOffset(limit, offset int) (int, int) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
@@ -0,0 +1,32 @@
+package crawshaw
+
+import "testing"
+
+func TestNormalizeLimitOffset(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int
+		offset     int
+		wantLimit  int
+		wantOffset int
+	}{
+		{name: "within bounds", limit: 50, offset: 10, wantLimit: 50, wantOffset: 10},
+		{name: "zero limit", limit: 0, offset: 0, wantLimit: defaultListLimit, wantOffset: 0},
+		{name: "negative limit", limit: -1, offset: 0, wantLimit: defaultListLimit, wantOffset: 0},
+		{name: "limit at max", limit: maxListLimit, offset: 0, wantLimit: maxListLimit, wantOffset: 0},
+		{name: "limit above max", limit: 1 << 30, offset: 0, wantLimit: maxListLimit, wantOffset: 0},
+		{name: "negative offset", limit: 10, offset: -5, wantLimit: 10, wantOffset: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, offset := normalizeLimitOffset(tt.limit, tt.offset)
+			if limit != tt.wantLimit {
+				t.Errorf("limit mismatch: got %d, want %d", limit, tt.wantLimit)
+			}
+			if offset != tt.wantOffset {
+				t.Errorf("offset mismatch: got %d, want %d", offset, tt.wantOffset)
+			}
+		})
+	}
+}
@@ -6,17 +6,74 @@ import (
 	"time"
 )
 
-const defaultTimeout = 1 * time.Second
+// Connection acquisition timeouts per operation class, applied when the
+// caller's context has no deadline. Point reads and writes should fail fast
+// on an exhausted pool; bulk operations such as purges legitimately wait
+// longer for a connection.
+const (
+	defaultTimeout      = 1 * time.Second
+	defaultHeavyTimeout = 30 * time.Second
+)
 
-// getWithTimeout attempts to acquire a connection from the pool with a timeout.
-// Returns the connection or error if context deadline is exceeded.
-func (db *Db) getWithTimeout(ctx context.Context) *sqlite.Conn {
+// withDefaultTimeout returns ctx bounded by timeout if it has no deadline.
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
-		ctx, _ = context.WithTimeout(ctx, defaultTimeout) // Ignore the cancel func
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// getWithTimeout attempts to acquire a connection from the pool with a timeout.
+// Returns the connection, or nil if the context deadline is exceeded, and a
+// cancel func the caller must call once the connection is back in the pool.
+// The pool ties the connection's interrupt to ctx, so canceling earlier would
+// abort the statements run on it.
+func (db *Db) getWithTimeout(ctx context.Context) (*sqlite.Conn, context.CancelFunc) {
+	if db.closed.Load() {
+		return nil, func() {}
+	}
+	ctx, cancel := withDefaultTimeout(ctx, defaultTimeout)
+	return db.pool.Get(ctx), cancel
+}
+
+// getWriteConnContext is getWriteConn for heavy operations: it waits for a
+// connection until ctx is done, or defaultHeavyTimeout if ctx has no
+// deadline, and returns ctx's error on timeout. The deadline only governs
+// acquisition, statements run on the connection are not interrupted by it.
+// Release the connection with putWriteConn.
+func (d *Db) getWriteConnContext(ctx context.Context) (*sqlite.Conn, error) {
+	if d.closed.Load() {
+		return nil, ErrClosed
+	}
+	ctx, cancel := withDefaultTimeout(ctx, defaultHeavyTimeout)
+	defer cancel()
+
+	if d.rwCh != nil {
+		select {
+		case conn := <-d.rwCh:
+			if d.closed.Load() {
+				// Close is waiting for the connection to return it to the pool.
+				d.rwCh <- conn
+				return nil, ErrClosed
+			}
+			return conn, nil
+		case <-d.rwDone:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	return db.pool.Get(ctx)
+	conn := d.pool.Get(ctx)
+	if conn == nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errNilConn
+	}
+	conn.SetInterrupt(nil)
+	return conn, nil
 }
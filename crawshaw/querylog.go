@@ -0,0 +1,89 @@
+package crawshaw
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// sensitiveColumns are the columns whose values must never be logged. When a
+// failed statement references one of them, none of its text arguments are
+// logged, as the position of a bind cannot be tied to a column reliably.
+var sensitiveColumns = []string{"password", "private_key"}
+
+// WithQueryErrorLogger logs every failed statement run by the Db at error
+// level, with the calling method, the SQL, the placeholder count and a
+// redacted view of the arguments: []byte values are logged as their length
+// only, and text values are redacted for statements referencing a
+// sensitive column. Disabled by default.
+func WithQueryErrorLogger(logger *slog.Logger) Option {
+	return func(d *Db) {
+		d.queryLogger = logger
+	}
+}
+
+// exec is sqlitex.Exec, logging failures with the query error logger.
+func (d *Db) exec(conn *sqlite.Conn, query string, fn func(stmt *sqlite.Stmt) error, args ...any) error {
+	err := sqlitex.Exec(conn, query, fn, args...)
+	if err != nil && d.queryLogger != nil {
+		d.logQueryError(callerMethod(2), query, err, args)
+	}
+	return err
+}
+
+// logQueryError logs a failed statement with its arguments redacted.
+func (d *Db) logQueryError(method, query string, err error, args []any) {
+	d.queryLogger.Error("sqlite query failed",
+		slog.String("method", method),
+		slog.String("sql", query),
+		slog.Int("placeholders", len(args)),
+		slog.Any("args", redactArgs(query, args)),
+		slog.String("error", err.Error()),
+	)
+}
+
+// redactArgs returns a loggable view of the bound arguments of query.
+func redactArgs(query string, args []any) []string {
+	lower := strings.ToLower(query)
+	sensitive := false
+	for _, column := range sensitiveColumns {
+		if strings.Contains(lower, column) {
+			sensitive = true
+			break
+		}
+	}
+
+	view := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case []byte:
+			view[i] = fmt.Sprintf("[%d bytes]", len(v))
+		case string:
+			if sensitive {
+				view[i] = "[REDACTED]"
+			} else {
+				view[i] = v
+			}
+		default:
+			view[i] = fmt.Sprint(v)
+		}
+	}
+	return view
+}
+
+// callerMethod returns the name of the function skip frames up the stack,
+// without the package path and receiver, e.g. "InsertJob".
+func callerMethod(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	name := runtime.FuncForPC(pc).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.TrimPrefix(name, "crawshaw.")
+	return strings.TrimPrefix(name, "(*Db).")
+}
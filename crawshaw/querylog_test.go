@@ -0,0 +1,57 @@
+package crawshaw
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+func TestQueryErrorLogger(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	var buf bytes.Buffer
+	WithQueryErrorLogger(slog.New(slog.NewJSONHandler(&buf, nil)))(testDB)
+
+	conn := testDB.pool.Get(context.TODO())
+	err := sqlitex.ExecScript(conn, "DROP TABLE users;")
+	testDB.pool.Put(conn)
+	if err != nil {
+		t.Fatalf("failed to drop users: %v", err)
+	}
+
+	t.Run("sensitive binds redacted", func(t *testing.T) {
+		buf.Reset()
+		if err := testDB.UpdatePassword("user-1", "s3cret-hash"); err == nil {
+			t.Fatal("expected UpdatePassword to fail without a users table")
+		}
+
+		line := buf.String()
+		if strings.Contains(line, "s3cret-hash") || strings.Contains(line, "user-1") {
+			t.Errorf("log line leaks bound values: %s", line)
+		}
+		for _, want := range []string{`"method":"UpdatePassword"`, "UPDATE users", `"placeholders":3`, "[REDACTED]"} {
+			if !strings.Contains(line, want) {
+				t.Errorf("log line missing %s: %s", want, line)
+			}
+		}
+	})
+
+	t.Run("other binds kept", func(t *testing.T) {
+		buf.Reset()
+		if _, err := testDB.RewriteAvatarPrefix("https://old/", "https://new/"); err == nil {
+			t.Fatal("expected RewriteAvatarPrefix to fail without a users table")
+		}
+
+		line := buf.String()
+		for _, want := range []string{`"method":"RewriteAvatarPrefix"`, "https://old/"} {
+			if !strings.Contains(line, want) {
+				t.Errorf("log line missing %s: %s", want, line)
+			}
+		}
+	})
+}
@@ -1,26 +1,78 @@
 package crawshaw
 
 import (
+	"context"
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"github.com/caasmo/restinpieces/db"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func (d *Db) InsertJob(job db.Job) error {
-	conn := d.pool.Get(nil)
-	defer d.pool.Put(conn)
+	err := d.insertJob(job, "")
+	d.metrics.observe("InsertJob", opWrite, err)
+	return err
+}
+
+// InsertJobWithDedupKey is InsertJob with an explicit idempotency key:
+// inserting a second job of the same type and dedupKey returns
+// db.ErrConstraintUnique whatever the payloads, e.g. when the payload carries
+// a timestamp. An empty dedupKey behaves as InsertJob. The unique constraint
+// on payload and job type of the restinpieces schema still applies.
+func (d *Db) InsertJobWithDedupKey(job db.Job, dedupKey string) error {
+	return d.insertJob(job, dedupKey)
+}
+
+// defaultMaxJobPayloadSize bounds the memory used to load a job.
+const defaultMaxJobPayloadSize = 1 << 20 // 1MB
+
+// checkJobPayloadSize returns an error if the payloads of job exceed the
+// configured limit.
+func (d *Db) checkJobPayloadSize(job db.Job) error {
+	limit := d.maxJobPayloadSize
+	if limit == 0 {
+		limit = defaultMaxJobPayloadSize
+	}
+	if size := len(job.Payload) + len(job.PayloadExtra); limit > 0 && size > limit {
+		return fmt.Errorf("job payload for job type %s is %d bytes, exceeds limit of %d bytes", job.JobType, size, limit)
+	}
+	return nil
+}
+
+func (d *Db) insertJob(job db.Job, dedupKey string) error {
+	if job.JobType == "" || len(job.Payload) == 0 {
+		return db.ErrMissingFields
+	}
+	if err := d.checkJobPayloadSize(job); err != nil {
+		return err
+	}
+	if err := d.checkJobSchema(job.JobType, job.Payload); err != nil {
+		return err
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for insert job: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
 
 	var scheduledForStr string
 	if !job.ScheduledFor.IsZero() {
 		scheduledForStr = db.TimeFormat(job.ScheduledFor)
 	}
 
-	err := sqlitex.Exec(conn, `INSERT INTO job_queue
-		(job_type, payload, payload_extra, attempts, max_attempts, recurrent, interval, scheduled_for)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	err := d.exec(conn, `INSERT INTO job_queue
+		(job_type, payload, payload_extra, attempts, max_attempts, recurrent, interval, scheduled_for, dedup_key, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, strftime('%Y-%m-%dT%H:%M:%SZ', ?), strftime('%Y-%m-%dT%H:%M:%SZ', ?))`,
 		nil,
 		job.JobType,
 		string(job.Payload),
@@ -30,30 +82,102 @@ func (d *Db) InsertJob(job db.Job) error {
 		job.Recurrent,
 		job.Interval.String(),
 		scheduledForStr,
+		dedupKey,
+		now,
+		now,
 	)
 
 	if err != nil {
+		if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_UNIQUE {
+			return db.ErrConstraintUnique
+		}
 		return fmt.Errorf("queue insert failed: %w", err)
 	}
+
+	d.NotifyNewJob()
 	return nil
 }
 
+// InsertJobUnique is an idempotent InsertJob: enqueuing a job with the same
+// payload and job type as an existing one is a no-op returning inserted=false
+// instead of db.ErrConstraintUnique. Use InsertJob to get the error.
+func (d *Db) InsertJobUnique(job db.Job) (inserted bool, err error) {
+	if job.JobType == "" || len(job.Payload) == 0 {
+		return false, db.ErrMissingFields
+	}
+	if err := d.checkJobPayloadSize(job); err != nil {
+		return false, err
+	}
+	if err := d.checkJobSchema(job.JobType, job.Payload); err != nil {
+		return false, err
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return false, fmt.Errorf("failed to get db connection for insert job unique: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
+
+	var scheduledForStr string
+	if !job.ScheduledFor.IsZero() {
+		scheduledForStr = db.TimeFormat(job.ScheduledFor)
+	}
+
+	err = d.exec(conn, `INSERT INTO job_queue
+		(job_type, payload, payload_extra, attempts, max_attempts, recurrent, interval, scheduled_for, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, strftime('%Y-%m-%dT%H:%M:%SZ', ?), strftime('%Y-%m-%dT%H:%M:%SZ', ?))
+		ON CONFLICT DO NOTHING`,
+		nil,
+		job.JobType,
+		string(job.Payload),
+		string(job.PayloadExtra),
+		job.Attempts,
+		job.MaxAttempts,
+		job.Recurrent,
+		job.Interval.String(),
+		scheduledForStr,
+		now,
+		now,
+	)
+
+	if err != nil {
+		return false, fmt.Errorf("queue insert failed: %w", err)
+	}
+
+	inserted = conn.Changes() > 0
+	if inserted {
+		d.NotifyNewJob()
+	}
+	return inserted, nil
+}
+
 func (d *Db) MarkCompleted(jobID int64) error {
-	conn := d.pool.Get(nil)
-	defer d.pool.Put(conn)
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for mark completed: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
 
-	err := sqlitex.Exec(conn,
+	err := d.exec(conn,
 		`UPDATE job_queue
-		SET status = 'completed',
-			completed_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now'),
-			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now'),
+		SET status = `+sqlStatusCompleted+`,
+			completed_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?),
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?),
 			locked_at = '',
+			lock_expires_at = '',
 			last_error = ''
 		WHERE id = ?`,
 		nil,
+		now,
+		now,
 		jobID,
 	)
 
+	d.metrics.observe("MarkCompleted", opWrite, err)
 	if err != nil {
 		return fmt.Errorf("failed to mark job as completed: %w", err)
 	}
@@ -61,143 +185,518 @@ func (d *Db) MarkCompleted(jobID int64) error {
 }
 
 func (d *Db) MarkFailed(jobID int64, errMsg string) error {
-	conn := d.pool.Get(nil)
-	defer d.pool.Put(conn)
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for mark failed: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
 
-	err := sqlitex.Exec(conn,
+	err := d.exec(conn,
 		`UPDATE job_queue
-		SET status = 'failed',
-			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now'),
+		SET status = `+sqlStatusFailed+`,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?),
 			locked_at = '',
+			lock_expires_at = '',
 			last_error = ?
 		WHERE id = ?`,
 		nil,
+		now,
 		errMsg,
 		jobID,
 	)
 
+	d.metrics.observe("MarkFailed", opWrite, err)
 	if err != nil {
 		return fmt.Errorf("failed to mark job as failed: %w", err)
 	}
 	return nil
 }
 
+// jobColumns are the job_queue columns read by newJobFromStmt.
+const jobColumns = `id, job_type, payload, payload_extra, status, attempts, max_attempts, created_at, updated_at,
+			scheduled_for, locked_by, locked_at, completed_at, last_error, recurrent, interval`
+
+// newJobFromStmt creates a Job struct from a SQLite statement row.
+func newJobFromStmt(stmt *sqlite.Stmt) (*db.Job, error) {
+	createdAt, err := db.TimeParse(stmt.GetText("created_at"))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing created_at time: %w", err)
+	}
+
+	updatedAt, err := db.TimeParse(stmt.GetText("updated_at"))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing updated_at time: %w", err)
+	}
+
+	var scheduledFor time.Time
+	if scheduledForStr := stmt.GetText("scheduled_for"); scheduledForStr != "" {
+		scheduledFor, err = db.TimeParse(scheduledForStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing scheduled_for time: %w", err)
+		}
+	}
+
+	var lockedAt time.Time
+	if lockedAtStr := stmt.GetText("locked_at"); lockedAtStr != "" {
+		lockedAt, err = db.TimeParse(lockedAtStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing locked_at time: %w", err)
+		}
+	}
+
+	var completedAt time.Time
+	if completedAtStr := stmt.GetText("completed_at"); completedAtStr != "" {
+		completedAt, err = db.TimeParse(completedAtStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing completed_at time: %w", err)
+		}
+	}
+
+	var interval time.Duration
+	if intervalStr := stmt.GetText("interval"); intervalStr != "" {
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing interval duration '%s': %w", intervalStr, err)
+		}
+	}
+
+	return &db.Job{
+		ID:           stmt.GetInt64("id"),
+		JobType:      stmt.GetText("job_type"),
+		Payload:      json.RawMessage(stmt.GetText("payload")),
+		PayloadExtra: json.RawMessage(stmt.GetText("payload_extra")),
+		Status:       stmt.GetText("status"),
+		Attempts:     int(stmt.GetInt64("attempts")),
+		MaxAttempts:  int(stmt.GetInt64("max_attempts")),
+		CreatedAt:    createdAt,
+		UpdatedAt:    updatedAt,
+		ScheduledFor: scheduledFor,
+		LockedBy:     stmt.GetText("locked_by"),
+		LockedAt:     lockedAt,
+		CompletedAt:  completedAt,
+		LastError:    stmt.GetText("last_error"),
+		Recurrent:    stmt.GetInt64("recurrent") != 0,
+		Interval:     interval,
+	}, nil
+}
+
+// Claim locks and returns up to limit due jobs for processing.
+// See ClaimFor for how concurrent claims are kept disjoint.
 func (d *Db) Claim(limit int) ([]*db.Job, error) {
-	conn := d.pool.Get(nil)
+	jobs, err := d.ClaimFor("", limit)
+	d.metrics.observe("Claim", opWrite, err)
+	return jobs, err
+}
+
+// ClaimFor locks and returns up to limit due jobs for processing, recording
+// workerID in their locked_by column.
+//
+// Claim strategy: SQLite allows a single writer per database, so claims are
+// already serialized by the engine. The risk under many workers is not two
+// workers getting the same row, but a worker failing with SQLITE_BUSY when
+// its read snapshot is outdated by the time it upgrades to a write. The claim
+// therefore runs in a BEGIN IMMEDIATE transaction: the write lock is taken
+// (waiting in the busy handler) before the candidate rows are selected, so
+// every worker selects from the state committed by the previous claim and
+// workers always receive disjoint sets. Partitioning ids per worker (modulo)
+// was rejected, as jobs of a dead worker would never be claimed.
+func (d *Db) ClaimFor(workerID string, limit int) ([]*db.Job, error) {
+	return d.claim(claimSQL, workerID, limit, 0, true, 0)
+}
+
+// ClaimFair locks and returns up to limit due jobs like Claim, but at most
+// maxPerType of each job_type, so a flood of one type cannot starve the
+// others. The jobs are taken round-robin across types, oldest first within
+// each type: a small limit still spreads over the due types.
+func (d *Db) ClaimFair(limit int, maxPerType int) ([]*db.Job, error) {
+	if maxPerType < 1 {
+		return nil, fmt.Errorf("max jobs per type must be at least 1, got %d", maxPerType)
+	}
+	return d.claim(claimFairSQL, "", limit, maxPerType, true, 0)
+}
+
+// ClaimOne locks and returns the next due job for workerID, like ClaimFor
+// with a limit of one, and sets its lock_expires_at to lease from now, in
+// one statement. Once the lease expires the job is claimable again, unless
+// the worker extends the lease with HeartbeatJob; LockExpiresAt tells when.
+// The lease is truncated to whole seconds and must be at least a second.
+// Returns ErrNotFound if no job is due.
+func (d *Db) ClaimOne(workerID string, lease time.Duration) (*db.Job, error) {
+	if lease < time.Second {
+		return nil, fmt.Errorf("lease must be at least a second, got %v", lease)
+	}
+
+	jobs, err := d.claim(claimSQL, workerID, 1, 0, true, lease)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, ErrNotFound
+	}
+	return jobs[0], nil
+}
+
+// LockExpiresAt returns when the lease of a job claimed with ClaimOne expires,
+// or the zero time if the job is not leased. Returns ErrNotFound if the job
+// does not exist.
+func (d *Db) LockExpiresAt(jobID int64) (time.Time, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return time.Time{}, fmt.Errorf("failed to get db connection for lock expires at: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var (
+		found   bool
+		expires string
+	)
+	err := d.exec(conn, `SELECT lock_expires_at FROM job_queue WHERE id = ?`,
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			expires = stmt.ColumnText(0)
+			return nil
+		}, jobID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get lock expiry of job %d: %w", jobID, err)
+	}
+	if !found {
+		return time.Time{}, ErrNotFound
+	}
+	if expires == "" {
+		return time.Time{}, nil
+	}
+	return db.TimeParse(expires)
+}
+
+// LeasedJob is a job claimed with ClaimLeased, with the expiry of its lease.
+// db.Job has no field for it.
+type LeasedJob struct {
+	*db.Job
+	LockExpiresAt time.Time
+}
+
+// ClaimLeased locks and returns up to limit due jobs for workerID like
+// ClaimFor, each with its lock_expires_at set to lease from now, as ClaimOne
+// does for a single job. Claim cannot report a lease: it is bound by the
+// restinpieces queue interface and locks without one.
+// The lease is truncated to whole seconds and must be at least a second.
+func (d *Db) ClaimLeased(workerID string, limit int, lease time.Duration) ([]*LeasedJob, error) {
+	if lease < time.Second {
+		return nil, fmt.Errorf("lease must be at least a second, got %v", lease)
+	}
+
+	jobs, err := d.claim(claimSQL, workerID, limit, 0, true, lease)
+	d.metrics.observe("ClaimLeased", opWrite, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// lock_expires_at is locked_at plus the lease, see claimSQL.
+	leased := make([]*LeasedJob, len(jobs))
+	for i, job := range jobs {
+		leased[i] = &LeasedJob{Job: job, LockExpiresAt: job.LockedAt.Add(lease.Truncate(time.Second))}
+	}
+	return leased, nil
+}
+
+// LeaseJobs locks up to limit due jobs like Claim, but without counting an
+// attempt. Workers call BeginAttempt when processing of a leased job actually
+// starts, so leases released on a fast shutdown do not burn attempts.
+func (d *Db) LeaseJobs(limit int) ([]*db.Job, error) {
+	return d.claim(claimSQL, "", limit, 0, false, 0)
+}
+
+// BeginAttempt counts an attempt for a job leased with LeaseJobs.
+// Returns ErrNotFound if the job does not exist or is not processing.
+func (d *Db) BeginAttempt(jobID int64) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for begin attempt: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET attempts = attempts + 1,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE id = ? AND status = `+sqlStatusProcessing,
+		nil,
+		d.sqlNow(),
+		jobID,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to begin attempt for job %d: %w", jobID, err)
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MarkFailedNoAttempt records errMsg for a processing job that failed
+// through no fault of its own, e.g. a transient database error, and
+// reschedules it as pending after failJobBaseBackoff. The attempt counted
+// when the job was claimed is given back, so infrastructure failures do not
+// push the job towards dead. Jobs leased with LeaseJobs must have begun an
+// attempt with BeginAttempt. Returns ErrNotFound if the job does not exist
+// or is not processing.
+func (d *Db) MarkFailedNoAttempt(jobID int64, errMsg string) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for mark failed no attempt: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.clock()
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET status = `+sqlStatusPending+`,
+			attempts = MAX(attempts - 1, 0),
+			updated_at = ?,
+			scheduled_for = ?,
+			locked_by = '',
+			locked_at = '',
+			lock_expires_at = '',
+			last_error = ?
+		WHERE id = ? AND status = `+sqlStatusProcessing,
+		nil,
+		db.TimeFormat(now),
+		db.TimeFormat(now.Add(failJobBaseBackoff)),
+		errMsg,
+		jobID,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to mark job %d as failed without attempt: %w", jobID, err)
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// claimableWhere selects the jobs due for claiming, with the current time as
+// its only parameter, $now: pending or failed jobs that are scheduled, and
+// processing jobs whose ClaimOne lease has expired. Shared by claim and
+// ClaimableCount.
+const claimableWhere = `((status IN (` + sqlStatusPending + `, ` + sqlStatusFailed + `)
+			  AND scheduled_for <= strftime('%Y-%m-%dT%H:%M:%SZ', $now))
+			  OR (status = ` + sqlStatusProcessing + ` AND lock_expires_at != ''
+			  AND lock_expires_at <= strftime('%Y-%m-%dT%H:%M:%SZ', $now)))`
+
+// ClaimableCount returns the number of jobs Claim could lock right now,
+// e.g. for a worker to size its next batch.
+func (d *Db) ClaimableCount() (int64, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for claimable count: %w", d.connErr())
+	}
 	defer d.pool.Put(conn)
 
-	var jobs []*db.Job
-	sql := `UPDATE job_queue
-		SET status = 'processing',
-			locked_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now'),
-			attempts = attempts + 1
+	var count int64
+	err := d.exec(conn,
+		`SELECT COUNT(*) FROM job_queue WHERE `+claimableWhere,
+		func(stmt *sqlite.Stmt) error {
+			count = stmt.ColumnInt64(0)
+			return nil
+		},
+		d.sqlNow(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count claimable jobs: %w", err)
+	}
+	return count, nil
+}
+
+// likeEscaper escapes the LIKE wildcards, and the escape character itself,
+// for use with ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// CountJobsByErrorLike returns the number of jobs whose last_error contains
+// pattern, e.g. to measure the impact of a downstream outage. The pattern is
+// matched literally: % and _ are not wildcards. The match follows LIKE and is
+// case-insensitive for ASCII letters.
+func (d *Db) CountJobsByErrorLike(pattern string) (int64, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for count jobs by error: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var count int64
+	err := d.exec(conn,
+		`SELECT COUNT(*) FROM job_queue WHERE last_error LIKE ? ESCAPE '\'`,
+		func(stmt *sqlite.Stmt) error {
+			count = stmt.ColumnInt64(0)
+			return nil
+		},
+		"%"+likeEscaper.Replace(pattern)+"%",
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count jobs by error %q: %w", pattern, err)
+	}
+	return count, nil
+}
+
+// claimSQL locks up to $limit due jobs for $worker, adding $increment to
+// their attempts. It runs on every poll of every worker, so claim binds its
+// named parameters directly instead of going through the reflection based
+// binding of sqlitex.Exec.
+const claimSQL = `UPDATE job_queue
+		SET status = ` + sqlStatusProcessing + `,
+			locked_by = $worker,
+			locked_at = strftime('%Y-%m-%dT%H:%M:%SZ', $now),
+			attempts = attempts + $increment,
+			lock_expires_at = IIF($lease = '', '', strftime('%Y-%m-%dT%H:%M:%SZ', $now, $lease))
 		WHERE id IN (
 			SELECT id
 			FROM job_queue
-			WHERE status IN ('pending', 'failed')
-			  AND scheduled_for <= strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+			WHERE ` + claimableWhere + `
 			ORDER BY id ASC
-			LIMIT ?
+			LIMIT $limit
 		)
-		RETURNING id, job_type, payload, payload_extra, status, attempts, max_attempts, created_at, updated_at,
-			scheduled_for, locked_by, locked_at, completed_at, last_error, recurrent, interval`
-
-	err := sqlitex.Exec(conn, sql,
-		func(stmt *sqlite.Stmt) error {
-			createdAt, err := db.TimeParse(stmt.GetText("created_at"))
-			if err != nil {
-				return fmt.Errorf("error parsing created_at time: %w", err)
-			}
+		RETURNING ` + jobColumns
 
-			updatedAt, err := db.TimeParse(stmt.GetText("updated_at"))
-			if err != nil {
-				return fmt.Errorf("error parsing updated_at time: %w", err)
-			}
-
-			var scheduledFor time.Time
-			if scheduledForStr := stmt.GetText("scheduled_for"); scheduledForStr != "" {
-				scheduledFor, err = db.TimeParse(scheduledForStr)
-				if err != nil {
-					return fmt.Errorf("error parsing scheduled_for time: %w", err)
-				}
-			}
+// claimFairSQL is claimSQL selecting at most $maxPerType jobs of each
+// job_type, interleaving the types, see ClaimFair.
+const claimFairSQL = `UPDATE job_queue
+		SET status = ` + sqlStatusProcessing + `,
+			locked_by = $worker,
+			locked_at = strftime('%Y-%m-%dT%H:%M:%SZ', $now),
+			attempts = attempts + $increment,
+			lock_expires_at = IIF($lease = '', '', strftime('%Y-%m-%dT%H:%M:%SZ', $now, $lease))
+		WHERE id IN (
+			SELECT id
+			FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY job_type ORDER BY id ASC) AS type_rank
+				FROM job_queue
+				WHERE ` + claimableWhere + `
+			)
+			WHERE type_rank <= $maxPerType
+			ORDER BY type_rank ASC, id ASC
+			LIMIT $limit
+		)
+		RETURNING ` + jobColumns
 
-			var lockedAt time.Time
-			if lockedAtStr := stmt.GetText("locked_at"); lockedAtStr != "" {
-				lockedAt, err = db.TimeParse(lockedAtStr)
-				if err != nil {
-					return fmt.Errorf("error parsing locked_at time: %w", err)
-				}
-			}
+// claim runs query, claimSQL or claimFairSQL, to lock up to limit due jobs
+// for workerID, incrementing their attempts if countAttempt is set.
+// maxPerType is only bound for claimFairSQL, when greater than 0. A lease
+// of at least a second sets lock_expires_at, truncated to whole seconds.
+func (d *Db) claim(query string, workerID string, limit, maxPerType int, countAttempt bool, lease time.Duration) ([]*db.Job, error) {
+	attemptIncrement := 0
+	if countAttempt {
+		attemptIncrement = 1
+	}
+	leaseModifier := ""
+	if lease >= time.Second {
+		leaseModifier = fmt.Sprintf("+%d seconds", int64(lease/time.Second))
+	}
 
-			var completedAt time.Time
-			if completedAtStr := stmt.GetText("completed_at"); completedAtStr != "" {
-				completedAt, err = db.TimeParse(completedAtStr)
-				if err != nil {
-					return fmt.Errorf("error parsing completed_at time: %w", err)
-				}
-			}
+	conn := d.getWriteConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for claim: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
 
-			var interval time.Duration
-			if intervalStr := stmt.GetText("interval"); intervalStr != "" {
-				interval, err = time.ParseDuration(intervalStr)
-				if err != nil {
-					return fmt.Errorf("error parsing interval duration '%s': %w", intervalStr, err)
-				}
-			}
+	now := d.sqlNow()
 
-			job := &db.Job{
-				ID:           stmt.GetInt64("id"),
-				JobType:      stmt.GetText("job_type"),
-				Payload:      json.RawMessage(stmt.GetText("payload")),
-				PayloadExtra: json.RawMessage(stmt.GetText("payload_extra")),
-				Status:       stmt.GetText("status"),
-				Attempts:     int(stmt.GetInt64("attempts")),
-				MaxAttempts:  int(stmt.GetInt64("max_attempts")),
-				CreatedAt:    createdAt,
-				UpdatedAt:    updatedAt,
-				ScheduledFor: scheduledFor,
-				LockedBy:     stmt.GetText("locked_by"),
-				LockedAt:     lockedAt,
-				CompletedAt:  completedAt,
-				LastError:    stmt.GetText("last_error"),
-				Recurrent:    stmt.GetInt64("recurrent") != 0,
-				Interval:     interval,
-			}
-			jobs = append(jobs, job)
-			return nil
-		}, limit)
+	err := d.exec(conn, "BEGIN IMMEDIATE;", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction for claim: %w", err)
+	}
 
+	jobs, err := claimJobs(conn, query, workerID, now, leaseModifier, attemptIncrement, limit, maxPerType)
 	if err != nil {
+		if d.queryLogger != nil {
+			d.logQueryError(callerMethod(1), query, err, []any{workerID, now, attemptIncrement, leaseModifier, limit, maxPerType})
+		}
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
 		return nil, fmt.Errorf("failed to claim jobs: %w", err)
 	}
-	if jobs == nil {
-		jobs = []*db.Job{}
+
+	err = d.exec(conn, "COMMIT;", nil)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return nil, fmt.Errorf("failed to commit transaction for claim: %w", err)
 	}
+
 	return jobs, nil
 }
 
+// claimJobs runs a claim query on the statement cached by conn for it.
+func claimJobs(conn *sqlite.Conn, query, workerID, now, leaseModifier string, attemptIncrement, limit, maxPerType int) (jobs []*db.Job, err error) {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if resetErr := stmt.Reset(); err == nil {
+			err = resetErr
+		}
+	}()
+
+	stmt.SetText("$worker", workerID)
+	stmt.SetText("$now", now)
+	stmt.SetInt64("$increment", int64(attemptIncrement))
+	stmt.SetText("$lease", leaseModifier)
+	stmt.SetInt64("$limit", int64(limit))
+	if maxPerType > 0 {
+		stmt.SetInt64("$maxPerType", int64(maxPerType))
+	}
+
+	jobs = []*db.Job{}
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			return jobs, nil
+		}
+		job, err := newJobFromStmt(stmt)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+}
+
 func (d *Db) MarkRecurrentCompleted(completedJobID int64, newJob db.Job) error {
-	conn := d.pool.Get(nil)
+	err := d.markRecurrentCompleted(completedJobID, newJob)
+	d.metrics.observe("MarkRecurrentCompleted", opWrite, err)
+	return err
+}
+
+func (d *Db) markRecurrentCompleted(completedJobID int64, newJob db.Job) error {
+	conn := d.getWriteConn()
 	if conn == nil {
-		return fmt.Errorf("failed to get connection for mark recurrent completed: connection is nil")
+		return fmt.Errorf("failed to get db connection for mark recurrent completed: %w", d.connErr())
 	}
-	defer d.pool.Put(conn)
+	defer d.putWriteConn(conn)
 
-	err := sqlitex.Exec(conn, "BEGIN IMMEDIATE;", nil)
+	now := d.sqlNow()
+
+	err := d.exec(conn, "BEGIN IMMEDIATE;", nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction for mark recurrent completed: %w", err)
 	}
 
-	err = sqlitex.Exec(conn,
+	err = d.exec(conn,
 		`UPDATE job_queue
-		SET status = 'completed',
-			completed_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now'),
-			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now'),
+		SET status = `+sqlStatusCompleted+`,
+			completed_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?),
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?),
 			locked_at = '',
+			lock_expires_at = '',
 			last_error = ''
 		WHERE id = ?`,
 		nil,
+		now,
+		now,
 		completedJobID,
 	)
 	if err != nil {
@@ -207,12 +706,12 @@ func (d *Db) MarkRecurrentCompleted(completedJobID int64, newJob db.Job) error {
 
 	var scheduledForStr string
 	if !newJob.ScheduledFor.IsZero() {
-		scheduledForStr = db.TimeFormat(newJob.ScheduledFor)
+		scheduledForStr = db.TimeFormat(newJob.ScheduledFor.Add(d.recurrentJitterFor(newJob.Interval)))
 	}
 
-	err = sqlitex.Exec(conn, `INSERT INTO job_queue
-		(job_type, payload, payload_extra, attempts, max_attempts, recurrent, interval, scheduled_for)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	err = d.exec(conn, `INSERT INTO job_queue
+		(job_type, payload, payload_extra, attempts, max_attempts, recurrent, interval, scheduled_for, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, strftime('%Y-%m-%dT%H:%M:%SZ', ?), strftime('%Y-%m-%dT%H:%M:%SZ', ?))`,
 		nil,
 		newJob.JobType,
 		string(newJob.Payload),
@@ -222,16 +721,644 @@ func (d *Db) MarkRecurrentCompleted(completedJobID int64, newJob db.Job) error {
 		newJob.Recurrent,
 		newJob.Interval.String(),
 		scheduledForStr,
+		now,
+		now,
 	)
 	if err != nil {
 		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
 		return fmt.Errorf("failed to re-insert job in transaction: %w", err)
 	}
 
-	err = sqlitex.Exec(conn, "COMMIT;", nil)
+	err = d.exec(conn, "COMMIT;", nil)
 	if err != nil {
 		return fmt.Errorf("failed to commit transaction for mark recurrent completed: %w", err)
 	}
 
 	return nil
 }
+
+// recurrentJitterFor returns a random delay in [0, recurrentJitter*interval]
+// for the next run of a recurrent job, see WithRecurrentJitter.
+func (d *Db) recurrentJitterFor(interval time.Duration) time.Duration {
+	window := time.Duration(d.recurrentJitter * float64(interval))
+	if window <= 0 {
+		return 0
+	}
+	return rand.N(window + 1)
+}
+
+// CountJobsByType returns the number of jobs per job_type, across all statuses.
+// Returns an empty map for an empty queue.
+func (d *Db) CountJobsByType() (map[string]int64, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for count jobs by type: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	counts := make(map[string]int64)
+	err := d.exec(conn,
+		`SELECT job_type, COUNT(*) AS count FROM job_queue GROUP BY job_type`,
+		func(stmt *sqlite.Stmt) error {
+			counts[stmt.GetText("job_type")] = stmt.GetInt64("count")
+			return nil
+		})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to count jobs by type: %w", err)
+	}
+	return counts, nil
+}
+
+// DistinctJobTypes returns the job types present in the queue, across all
+// statuses, sorted. Returns an empty slice for an empty queue.
+func (d *Db) DistinctJobTypes() ([]string, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for distinct job types: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	types := []string{}
+	err := d.exec(conn,
+		`SELECT DISTINCT job_type FROM job_queue ORDER BY job_type`,
+		func(stmt *sqlite.Stmt) error {
+			types = append(types, stmt.ColumnText(0))
+			return nil
+		})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list distinct job types: %w", err)
+	}
+	return types, nil
+}
+
+// UpdateJobScheduledFor reschedules a job that has not started yet.
+// Returns ErrNotFound if the job does not exist or is not pending or failed.
+func (d *Db) UpdateJobScheduledFor(jobID int64, when time.Time) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for update scheduled_for: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET scheduled_for = ?,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE id = ? AND status IN (`+sqlStatusPending+`, `+sqlStatusFailed+`)`,
+		nil,
+		db.TimeFormat(when),
+		d.sqlNow(),
+		jobID,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to update scheduled_for of job %d: %w", jobID, err)
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetMaxAttemptsForPending sets max_attempts of the pending jobs of jobType,
+// e.g. after changing the retry budget, and returns how many were updated.
+// Jobs already processing or finished keep their value.
+func (d *Db) SetMaxAttemptsForPending(jobType string, maxAttempts int) (int64, error) {
+	if maxAttempts < 1 {
+		return 0, fmt.Errorf("max attempts must be at least 1, got %d", maxAttempts)
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for set max attempts: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET max_attempts = ?,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE job_type = ? AND status = `+sqlStatusPending,
+		nil,
+		maxAttempts,
+		d.sqlNow(),
+		jobType,
+	)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to set max attempts for job type %s: %w", jobType, err)
+	}
+	return int64(conn.Changes()), nil
+}
+
+// ShiftPendingSchedule moves scheduled_for of every pending job by offset,
+// e.g. to push all queued work back during maintenance, and returns how many
+// were moved. A negative offset brings jobs forward. Jobs with no
+// scheduled_for, due immediately, are shifted from the current time. The
+// offset is truncated to whole seconds, the precision of scheduled_for.
+func (d *Db) ShiftPendingSchedule(offset time.Duration) (int64, error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for shift pending schedule: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
+	modifier := fmt.Sprintf("%+d seconds", int64(offset/time.Second))
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET scheduled_for = strftime('%Y-%m-%dT%H:%M:%SZ',
+				CASE WHEN scheduled_for = '' THEN ? ELSE scheduled_for END, ?),
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE status = `+sqlStatusPending,
+		nil,
+		now,
+		modifier,
+		now,
+	)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to shift pending schedule by %s: %w", offset, err)
+	}
+	return int64(conn.Changes()), nil
+}
+
+// RequeueDeadJobs moves every dead job of jobType back to pending with a
+// fresh attempt budget, due now, and returns how many were requeued. Dead
+// jobs are never retried on their own: call it explicitly once the handler
+// that killed them is fixed. last_error is kept until the next attempt.
+func (d *Db) RequeueDeadJobs(jobType string) (int64, error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for requeue dead jobs: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET status = `+sqlStatusPending+`,
+			attempts = 0,
+			scheduled_for = strftime('%Y-%m-%dT%H:%M:%SZ', ?),
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?),
+			locked_by = '',
+			locked_at = '',
+			lock_expires_at = ''
+		WHERE job_type = ? AND status = ?`,
+		nil,
+		now,
+		now,
+		jobType,
+		string(JobStatusDead),
+	)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue dead jobs of type %s: %w", jobType, err)
+	}
+	return int64(conn.Changes()), nil
+}
+
+// GetJobByPayload returns the job of the given type with exactly this payload,
+// so callers can check for an equivalent job before enqueueing.
+// Returns ErrNotFound if none matches.
+func (d *Db) GetJobByPayload(jobType string, payload json.RawMessage) (*db.Job, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for get job by payload: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var job *db.Job
+	err := d.exec(conn,
+		`SELECT `+jobColumns+`
+		FROM job_queue
+		WHERE job_type = ? AND payload = ?
+		LIMIT 1`,
+		func(stmt *sqlite.Stmt) error {
+			var err error
+			job, err = newJobFromStmt(stmt)
+			return err
+		},
+		jobType,
+		string(payload),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job by payload: %w", err)
+	}
+	if job == nil {
+		return nil, ErrNotFound
+	}
+	return job, nil
+}
+
+// TruncateJobQueue deletes every job, whatever its status, and resets the id
+// sequence so new jobs start at 1 again.
+// DESTRUCTIVE: meant for tests and maintenance, never for a running queue.
+func (d *Db) TruncateJobQueue() error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for truncate job queue: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := sqlitex.ExecScript(conn, `DELETE FROM job_queue;
+		DELETE FROM sqlite_sequence WHERE name = 'job_queue';`)
+
+	if err != nil {
+		return fmt.Errorf("failed to truncate job queue: %w", err)
+	}
+	return nil
+}
+
+// GetJobsByPayloadField returns up to limit jobs, oldest first, whose JSON
+// payload has the top level field set to value, e.g. all the jobs of a
+// user_id. Numeric field values match their decimal text. field must be a
+// simple identifier. The limit is clamped by normalizeLimitOffset.
+// The filter uses json_extract from the JSON1 extension, built into
+// crawshaw.io/sqlite, and cannot use an index: it scans the queue.
+func (d *Db) GetJobsByPayloadField(field, value string, limit int) ([]*db.Job, error) {
+	if !identifierPattern.MatchString(field) {
+		return nil, fmt.Errorf("invalid payload field %q: must be a simple identifier", field)
+	}
+	limit, _ = normalizeLimitOffset(limit, 0)
+
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for get jobs by payload field: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	jobs := []*db.Job{}
+	err := d.exec(conn,
+		`SELECT `+jobColumns+`
+		FROM job_queue
+		WHERE CAST(CASE WHEN json_valid(payload) THEN json_extract(payload, '$.' || ?) END AS TEXT) = ?
+		ORDER BY id ASC
+		LIMIT ?`,
+		func(stmt *sqlite.Stmt) error {
+			job, err := newJobFromStmt(stmt)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		},
+		field,
+		value,
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jobs by payload field %q: %w", field, err)
+	}
+	return jobs, nil
+}
+
+// ExportJobsCSV writes the most recent jobs, newest first, as CSV to w: a
+// header then one row per job with id, job_type, status, attempts,
+// scheduled_for and last_error. An empty status exports every status. Rows
+// are written as they are read, so memory stays bounded. The limit is
+// clamped by normalizeLimitOffset.
+func (d *Db) ExportJobsCSV(w io.Writer, status string, limit int) error {
+	limit, _ = normalizeLimitOffset(limit, 0)
+
+	conn := d.getConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for export jobs csv: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "job_type", "status", "attempts", "scheduled_for", "last_error"}); err != nil {
+		return fmt.Errorf("failed to write csv header: %w", err)
+	}
+
+	err := d.exec(conn,
+		`SELECT id, job_type, status, attempts, scheduled_for, last_error
+		FROM job_queue
+		WHERE ? = '' OR status = ?
+		ORDER BY id DESC
+		LIMIT ?`,
+		func(stmt *sqlite.Stmt) error {
+			return cw.Write([]string{
+				strconv.FormatInt(stmt.GetInt64("id"), 10),
+				stmt.GetText("job_type"),
+				stmt.GetText("status"),
+				strconv.FormatInt(stmt.GetInt64("attempts"), 10),
+				stmt.GetText("scheduled_for"),
+				stmt.GetText("last_error"),
+			})
+		},
+		status,
+		status,
+		limit,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to export jobs: %w", err)
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to write csv: %w", err)
+	}
+	return nil
+}
+
+// GetJobsLockedBy returns the processing jobs claimed by workerID with
+// ClaimFor, e.g. to hand them off when the worker shuts down.
+func (d *Db) GetJobsLockedBy(workerID string) ([]*db.Job, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for get jobs locked by: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	jobs := []*db.Job{}
+	err := d.exec(conn,
+		`SELECT `+jobColumns+`
+		FROM job_queue
+		WHERE status = `+sqlStatusProcessing+` AND locked_by = ?
+		ORDER BY id ASC`,
+		func(stmt *sqlite.Stmt) error {
+			job, err := newJobFromStmt(stmt)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		},
+		workerID,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jobs locked by %q: %w", workerID, err)
+	}
+	return jobs, nil
+}
+
+// RecentFailures returns up to limit failed jobs, most recently failed first,
+// e.g. for an error dashboard. The limit is clamped by normalizeLimitOffset.
+func (d *Db) RecentFailures(limit int) ([]*db.Job, error) {
+	limit, _ = normalizeLimitOffset(limit, 0)
+
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for recent failures: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	jobs := []*db.Job{}
+	err := d.exec(conn,
+		`SELECT `+jobColumns+`
+		FROM job_queue
+		WHERE status = `+sqlStatusFailed+`
+		ORDER BY updated_at DESC, id DESC
+		LIMIT ?`,
+		func(stmt *sqlite.Stmt) error {
+			job, err := newJobFromStmt(stmt)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		},
+		limit,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recent failures: %w", err)
+	}
+	return jobs, nil
+}
+
+// ReleaseJobsLockedBy puts the processing jobs claimed by workerID back to
+// pending so other workers can claim them right away, and returns how many
+// were released. A worker calls it on graceful shutdown.
+func (d *Db) ReleaseJobsLockedBy(workerID string) (int64, error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for release jobs locked by: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET status = `+sqlStatusPending+`,
+			locked_by = '',
+			locked_at = '',
+			lock_expires_at = '',
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE status = `+sqlStatusProcessing+` AND locked_by = ?`,
+		nil,
+		d.sqlNow(),
+		workerID,
+	)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to release jobs locked by %q: %w", workerID, err)
+	}
+	return int64(conn.Changes()), nil
+}
+
+// RecoverOrphanedJobs puts every processing job back to pending and returns
+// how many were recovered. It is meant to run once at startup, before any
+// worker claims: the workers holding those locks died with the previous
+// process, so locks are released whatever their age or owner.
+func (d *Db) RecoverOrphanedJobs() (int64, error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for recover orphaned jobs: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET status = `+sqlStatusPending+`,
+			locked_by = '',
+			locked_at = '',
+			lock_expires_at = '',
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE status = `+sqlStatusProcessing,
+		nil,
+		d.sqlNow(),
+	)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to recover orphaned jobs: %w", err)
+	}
+	return int64(conn.Changes()), nil
+}
+
+// defaultPurgeBatchSize is the number of jobs deleted per statement by
+// PurgeCompletedJobs when no batch size is given.
+const defaultPurgeBatchSize = 1000
+
+// PurgeCompletedJobs deletes the completed jobs with completed_at before
+// olderThan and returns how many were deleted. Rows are deleted in batches of
+// batchSize, each in its own transaction on a connection acquired for the
+// batch, so the write lock, and the single writer connection with
+// WithSingleWriter, are released between batches and workers are not blocked
+// for the whole cleanup. A batchSize <= 0 uses defaultPurgeBatchSize.
+func (d *Db) PurgeCompletedJobs(olderThan time.Time, batchSize int) (int64, error) {
+	return d.PurgeCompletedJobsContext(context.Background(), olderThan, batchSize)
+}
+
+// PurgeCompletedJobsContext is PurgeCompletedJobs waiting for the connection
+// of each batch until ctx is done, or defaultHeavyTimeout if ctx has no
+// deadline. On error it returns the number of jobs already deleted.
+func (d *Db) PurgeCompletedJobsContext(ctx context.Context, olderThan time.Time, batchSize int) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = defaultPurgeBatchSize
+	}
+
+	var total int64
+	for {
+		deleted, err := d.purgeCompletedBatch(ctx, olderThan, batchSize)
+		total += int64(deleted)
+		if err != nil {
+			return total, err
+		}
+		if deleted < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// purgeCompletedBatch deletes up to batchSize of the jobs purged by
+// PurgeCompletedJobs on its own write connection.
+func (d *Db) purgeCompletedBatch(ctx context.Context, olderThan time.Time, batchSize int) (int, error) {
+	conn, err := d.getWriteConnContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get db connection for purge completed jobs: %w", err)
+	}
+	defer d.putWriteConn(conn)
+
+	err = d.exec(conn,
+		`DELETE FROM job_queue
+		WHERE id IN (
+			SELECT id
+			FROM job_queue
+			WHERE status = `+sqlStatusCompleted+` AND completed_at < ?
+			ORDER BY id ASC
+			LIMIT ?
+		)`,
+		nil,
+		db.TimeFormat(olderThan),
+		batchSize,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge completed jobs: %w", err)
+	}
+	return conn.Changes(), nil
+}
+
+// HeartbeatJob refreshes locked_at of a job still processing under workerID,
+// so a long running job is not taken for stale and reclaimed. The lease of a
+// job claimed with ClaimOne is extended by its original length from now.
+// Returns ErrConflict if another worker holds the lock, and ErrNotFound if the
+// job does not exist or is not processing.
+func (d *Db) HeartbeatJob(jobID int64, workerID string) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for heartbeat job: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET locked_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?),
+			lock_expires_at = IIF(lock_expires_at = '', '', strftime('%Y-%m-%dT%H:%M:%SZ', ?,
+				'+' || (strftime('%s', lock_expires_at) - strftime('%s', locked_at)) || ' seconds'))
+		WHERE id = ? AND status = `+sqlStatusProcessing+` AND locked_by = ?`,
+		nil,
+		now,
+		now,
+		jobID,
+		workerID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to heartbeat job %d: %w", jobID, err)
+	}
+	if conn.Changes() > 0 {
+		return nil
+	}
+
+	processing := false
+	err = d.exec(conn,
+		`SELECT 1 FROM job_queue WHERE id = ? AND status = `+sqlStatusProcessing,
+		func(stmt *sqlite.Stmt) error {
+			processing = true
+			return nil
+		},
+		jobID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to heartbeat job %d: %w", jobID, err)
+	}
+	if processing {
+		return ErrConflict
+	}
+	return ErrNotFound
+}
+
+// RetypeJob moves a pending job to newType, e.g. to reclassify it into a
+// higher priority type. Returns ErrConflict if the job is no longer pending,
+// ErrNotFound if it does not exist, and db.ErrConstraintUnique if newType
+// already has a job with the same payload, the unique constraint of the
+// restinpieces schema, or with the same dedup key.
+func (d *Db) RetypeJob(jobID int64, newType string) error {
+	if newType == "" {
+		return fmt.Errorf("retype job %d: empty job type", jobID)
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for retype job: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET job_type = ?,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE id = ? AND status = ?`,
+		nil,
+		newType,
+		d.sqlNow(),
+		jobID,
+		string(JobStatusPending),
+	)
+	if err != nil {
+		if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_UNIQUE {
+			return db.ErrConstraintUnique
+		}
+		return fmt.Errorf("failed to retype job %d: %w", jobID, err)
+	}
+	if conn.Changes() > 0 {
+		return nil
+	}
+
+	exists := false
+	err = d.exec(conn,
+		`SELECT 1 FROM job_queue WHERE id = ?`,
+		func(stmt *sqlite.Stmt) error {
+			exists = true
+			return nil
+		},
+		jobID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to retype job %d: %w", jobID, err)
+	}
+	if exists {
+		return ErrConflict
+	}
+	return ErrNotFound
+}
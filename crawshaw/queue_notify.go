@@ -0,0 +1,44 @@
+package crawshaw
+
+import (
+	"context"
+)
+
+// jobSignal returns the channel closed by the next NotifyNewJob.
+func (d *Db) jobSignal() <-chan struct{} {
+	d.jobMu.Lock()
+	defer d.jobMu.Unlock()
+
+	if d.jobNotify == nil {
+		d.jobNotify = make(chan struct{})
+	}
+	return d.jobNotify
+}
+
+// NotifyNewJob wakes every goroutine blocked in WaitForJob.
+// InsertJob calls it after each successful insert.
+func (d *Db) NotifyNewJob() {
+	d.jobMu.Lock()
+	defer d.jobMu.Unlock()
+
+	if d.jobNotify != nil {
+		close(d.jobNotify)
+		d.jobNotify = nil
+	}
+}
+
+// WaitForJob blocks until a job is enqueued through this Db or ctx is done,
+// in which case it returns ctx.Err(). Only inserts after the call wake it:
+// notifications sent before WaitForJob subscribes are lost, so callers must
+// Claim after waking and before waiting again. The notification is
+// in-process only: jobs inserted by other processes are not signaled, so
+// workers should still fall back to polling Claim, e.g. by waiting with a
+// context timeout set to their poll interval.
+func (d *Db) WaitForJob(ctx context.Context) error {
+	select {
+	case <-d.jobSignal():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,74 @@
+package crawshaw
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"crawshaw.io/sqlite"
+)
+
+// SetJobResult stores result as the output of the job, e.g. the URL of a
+// generated report, for the enqueuer to read back with JobResult. result must
+// be valid JSON; an empty result clears it. Returns ErrNotFound if the job
+// does not exist.
+func (d *Db) SetJobResult(jobID int64, result json.RawMessage) error {
+	if len(result) > 0 && !json.Valid(result) {
+		return fmt.Errorf("result of job %d is not valid JSON", jobID)
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for set job result: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`UPDATE job_queue
+		SET result = ?,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE id = ?`,
+		nil,
+		string(result),
+		d.sqlNow(),
+		jobID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set result of job %d: %w", jobID, err)
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// JobResult returns the result stored with SetJobResult, or nil if the job
+// has none yet, so a request can poll for the output of its job. Returns
+// ErrNotFound if the job does not exist.
+func (d *Db) JobResult(jobID int64) (json.RawMessage, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for job result: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var (
+		found  bool
+		result string
+	)
+	err := d.exec(conn, `SELECT result FROM job_queue WHERE id = ?`,
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			result = stmt.ColumnText(0)
+			return nil
+		}, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get result of job %d: %w", jobID, err)
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	if result == "" {
+		return nil, nil
+	}
+	return json.RawMessage(result), nil
+}
@@ -0,0 +1,102 @@
+package crawshaw
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// ErrSchemaViolation is wrapped by the job inserts rejecting a payload that
+// does not match the schema registered for its job type.
+var ErrSchemaViolation = errors.New("job payload violates schema")
+
+// jobSchemaURL is the location a job schema is compiled at. Each schema is
+// compiled alone, so the location only serves to resolve its internal $refs.
+const jobSchemaURL = "urn:restinpieces:job-schema"
+
+// RegisterJobSchema sets schema as the JSON schema the payload of jobType
+// must match, replacing any previous one; a nil schema removes it. The job
+// inserts then reject a non-matching payload with an error wrapping
+// ErrSchemaViolation that names the offending location, so malformed jobs
+// fail at enqueue time instead of in the worker. Job types without a schema
+// are not validated.
+//
+// Schemas are JSON Schema documents, draft 2020-12 unless $schema says
+// otherwise. A schema that is not valid against its draft is rejected. A
+// schema must be self-contained: $refs to other documents are not loaded.
+func (d *Db) RegisterJobSchema(jobType string, schema []byte) error {
+	if schema == nil {
+		d.validatorsMu.Lock()
+		delete(d.jobSchemas, jobType)
+		d.validatorsMu.Unlock()
+		return nil
+	}
+
+	compiled, err := compileJobSchema(schema)
+	if err != nil {
+		return fmt.Errorf("invalid schema for job type %s: %w", jobType, err)
+	}
+
+	d.validatorsMu.Lock()
+	defer d.validatorsMu.Unlock()
+	if d.jobSchemas == nil {
+		d.jobSchemas = make(map[string]*jsonschema.Schema)
+	}
+	d.jobSchemas[jobType] = compiled
+	return nil
+}
+
+// compileJobSchema compiles a JSON schema document without a URL loader, so
+// compiling never reads files or the network.
+func compileJobSchema(schema []byte) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return nil, err
+	}
+
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	if err := c.AddResource(jobSchemaURL, doc); err != nil {
+		return nil, err
+	}
+	return c.Compile(jobSchemaURL)
+}
+
+// checkJobSchema validates the payload against the schema of its job type,
+// if any.
+func (d *Db) checkJobSchema(jobType string, payload json.RawMessage) error {
+	d.validatorsMu.RLock()
+	schema := d.jobSchemas[jobType]
+	d.validatorsMu.RUnlock()
+
+	if schema == nil {
+		return nil
+	}
+
+	value, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("%w: payload of job type %s is not valid JSON: %v", ErrSchemaViolation, jobType, err)
+	}
+	if err := schema.Validate(value); err != nil {
+		return fmt.Errorf("%w: job type %s: %s", ErrSchemaViolation, jobType, schemaErrorDetails(err))
+	}
+	return nil
+}
+
+// schemaErrorDetails returns the causes listed by a validation error on one
+// line, e.g. "at '/attempt': got number, want integer", without the schema
+// location heading them.
+func schemaErrorDetails(err error) string {
+	var details []string
+	for _, line := range strings.Split(err.Error(), "\n")[1:] {
+		details = append(details, strings.TrimPrefix(strings.TrimSpace(line), "- "))
+	}
+	if len(details) == 0 {
+		return err.Error()
+	}
+	return strings.Join(details, "; ")
+}
@@ -0,0 +1,244 @@
+package crawshaw
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/caasmo/restinpieces/db"
+	"github.com/caasmo/restinpieces/queue"
+)
+
+// JobStatus is the status of a job in the job_queue table.
+type JobStatus string
+
+// Job statuses, matching the restinpieces queue package.
+const (
+	JobStatusPending    JobStatus = queue.StatusPending
+	JobStatusProcessing JobStatus = queue.StatusProcessing
+	JobStatusCompleted  JobStatus = queue.StatusCompleted
+	JobStatusFailed     JobStatus = queue.StatusFailed
+
+	// JobStatusDead is set by FailJob on a job out of attempts. Dead jobs
+	// are never claimed again.
+	JobStatusDead JobStatus = "dead"
+)
+
+// Job statuses quoted as SQL string literals, to build the queue SQL.
+const (
+	sqlStatusPending    = `'` + string(JobStatusPending) + `'`
+	sqlStatusProcessing = `'` + string(JobStatusProcessing) + `'`
+	sqlStatusCompleted  = `'` + string(JobStatusCompleted) + `'`
+	sqlStatusFailed     = `'` + string(JobStatusFailed) + `'`
+)
+
+// ErrInvalidTransition is returned by SetJobStatus for a status change the
+// queue does not allow.
+var ErrInvalidTransition = errors.New("invalid job status transition")
+
+// jobTransitions lists the statuses each status can move to.
+// Completed is final; dead jobs only go back to pending, see RequeueDeadJobs.
+var jobTransitions = map[JobStatus][]JobStatus{
+	JobStatusPending:    {JobStatusProcessing, JobStatusFailed},
+	JobStatusProcessing: {JobStatusPending, JobStatusCompleted, JobStatusFailed, JobStatusDead},
+	JobStatusFailed:     {JobStatusPending, JobStatusProcessing},
+	JobStatusDead:       {JobStatusPending},
+}
+
+// jobStatusColumns are the columns SetJobStatus updates along with moving a
+// job to a status, as the queue methods reaching that status do. They may use
+// the current time, $now. Only processing holds a lock.
+var jobStatusColumns = map[JobStatus]string{
+	JobStatusPending: `locked_by = '', locked_at = '', lock_expires_at = ''`,
+	JobStatusProcessing: `locked_by = '',
+			locked_at = strftime('%Y-%m-%dT%H:%M:%SZ', $now),
+			lock_expires_at = ''`,
+	JobStatusCompleted: `completed_at = strftime('%Y-%m-%dT%H:%M:%SZ', $now),
+			locked_by = '', locked_at = '', lock_expires_at = '',
+			last_error = ''`,
+	JobStatusFailed: `locked_by = '', locked_at = '', lock_expires_at = ''`,
+	JobStatusDead:   `locked_by = '', locked_at = '', lock_expires_at = ''`,
+}
+
+// validTransition reports whether a job may move from one status to another.
+func validTransition(from, to JobStatus) bool {
+	for _, allowed := range jobTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// SetJobStatus moves a job from status from to status to, with the columns
+// going with the new status: completed sets completed_at, processing locks the
+// job like Claim without counting an attempt, and the others release the lock.
+// It returns ErrInvalidTransition if the queue does not allow the change, and
+// ErrNotFound if the job does not exist or is no longer in status from.
+func (d *Db) SetJobStatus(jobID int64, from, to JobStatus) error {
+	if !validTransition(from, to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for set job status: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	query := `UPDATE job_queue
+		SET status = $to,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', $now),
+			` + jobStatusColumns[to] + `
+		WHERE id = $id AND status = $from`
+	now := d.sqlNow()
+
+	err := setJobStatus(conn, query, jobID, from, to, now)
+	if err != nil {
+		if d.queryLogger != nil {
+			d.logQueryError(callerMethod(1), query, err, []any{string(to), now, jobID, string(from)})
+		}
+		return fmt.Errorf("failed to set status of job %d: %w", jobID, err)
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// setJobStatus runs the SetJobStatus query on the statement cached by conn
+// for it. The parameters are bound by name, as jobStatusColumns may use $now.
+func setJobStatus(conn *sqlite.Conn, query string, jobID int64, from, to JobStatus, now string) (err error) {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if resetErr := stmt.Reset(); err == nil {
+			err = resetErr
+		}
+	}()
+
+	stmt.SetText("$to", string(to))
+	stmt.SetText("$now", now)
+	stmt.SetInt64("$id", jobID)
+	stmt.SetText("$from", string(from))
+
+	_, err = stmt.Step()
+	return err
+}
+
+// Retry backoff of FailJob: failJobBaseBackoff after the first attempt,
+// doubling with each further attempt up to failJobMaxBackoff.
+const (
+	failJobBaseBackoff = 30 * time.Second
+	failJobMaxBackoff  = time.Hour
+)
+
+// failJobBackoff returns the delay before retrying a job that failed its
+// attempts-th attempt.
+func failJobBackoff(attempts int) time.Duration {
+	backoff := failJobBaseBackoff
+	for i := 1; i < attempts && backoff < failJobMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > failJobMaxBackoff {
+		backoff = failJobMaxBackoff
+	}
+	return backoff
+}
+
+// FailJob records a failed attempt of a job and applies the retry policy.
+// If the job has attempts left it is rescheduled as pending after an
+// exponential backoff and FailJob returns JobStatusPending; otherwise it is
+// moved to JobStatusDead. The lock is released in both cases.
+// Returns ErrConflict if the job is not processing, so a completed or dead
+// job never runs again, and ErrNotFound if the job does not exist.
+func (d *Db) FailJob(jobID int64, errMsg string) (status string, err error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return "", fmt.Errorf("failed to get db connection for fail job: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	if err := d.exec(conn, "BEGIN IMMEDIATE;", nil); err != nil {
+		return "", fmt.Errorf("failed to begin transaction for fail job: %w", err)
+	}
+
+	found := false
+	var attempts, maxAttempts int
+	err = d.exec(conn,
+		`SELECT attempts, max_attempts FROM job_queue WHERE id = ? AND status = ?`,
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			attempts = int(stmt.GetInt64("attempts"))
+			maxAttempts = int(stmt.GetInt64("max_attempts"))
+			return nil
+		},
+		jobID,
+		string(JobStatusProcessing),
+	)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return "", fmt.Errorf("failed to read attempts of job %d: %w", jobID, err)
+	}
+	if !found {
+		exists := false
+		err = d.exec(conn,
+			`SELECT 1 FROM job_queue WHERE id = ?`,
+			func(stmt *sqlite.Stmt) error {
+				exists = true
+				return nil
+			},
+			jobID,
+		)
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to read job %d: %w", jobID, err)
+		}
+		if exists {
+			return "", ErrConflict
+		}
+		return "", ErrNotFound
+	}
+
+	now := d.clock()
+	next := JobStatusPending
+	scheduledFor := db.TimeFormat(now.Add(failJobBackoff(attempts)))
+	if attempts >= maxAttempts {
+		next = JobStatusDead
+		scheduledFor = ""
+	}
+
+	err = d.exec(conn,
+		`UPDATE job_queue
+		SET status = ?,
+			updated_at = ?,
+			scheduled_for = IIF(? = '', scheduled_for, ?),
+			locked_by = '',
+			locked_at = '',
+			lock_expires_at = '',
+			last_error = ?
+		WHERE id = ? AND status = ?`,
+		nil,
+		string(next),
+		db.TimeFormat(now),
+		scheduledFor,
+		scheduledFor,
+		errMsg,
+		jobID,
+		string(JobStatusProcessing),
+	)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return "", fmt.Errorf("failed to fail job %d: %w", jobID, err)
+	}
+
+	if err := d.exec(conn, "COMMIT;", nil); err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return "", fmt.Errorf("failed to commit transaction for fail job: %w", err)
+	}
+	return string(next), nil
+}
@@ -1,8 +1,18 @@
 package crawshaw
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
@@ -12,16 +22,16 @@ import (
 
 func TestInsertQueueJobValid(t *testing.T) {
 	testDB := setupDB(t)
-	defer testDB.Close()
+	defer testDB.pool.Close()
 
 	tests := []struct {
 		name    string
-		job     queue.Job
+		job     db.Job
 		wantErr bool
 	}{
 		{
 			name: "valid job",
-			job: queue.Job{
+			job: db.Job{
 				JobType:     "test_job",
 				Payload:     json.RawMessage(`{"key":"unique_value"}`),
 				Status:      queue.StatusPending,
@@ -31,7 +41,7 @@ func TestInsertQueueJobValid(t *testing.T) {
 		},
 		{
 			name: "missing job type",
-			job: queue.Job{
+			job: db.Job{
 				JobType:     "",
 				Payload:     json.RawMessage(`{"key":"value"}`),
 				MaxAttempts: 3,
@@ -40,7 +50,7 @@ func TestInsertQueueJobValid(t *testing.T) {
 		},
 		{
 			name: "empty payload",
-			job: queue.Job{
+			job: db.Job{
 				JobType:     "test_job",
 				Payload:     json.RawMessage(``),
 				MaxAttempts: 3,
@@ -50,7 +60,7 @@ func TestInsertQueueJobValid(t *testing.T) {
 		{
 			// TODO
 			name: "invalid max attempts",
-			job: queue.Job{
+			job: db.Job{
 				JobType:     "test_job",
 				Payload:     json.RawMessage(`{"key":"value"}`),
 				MaxAttempts: 0,
@@ -80,13 +90,13 @@ func TestInsertQueueJobValid(t *testing.T) {
 			conn := testDB.pool.Get(nil)
 			defer testDB.pool.Put(conn)
 
-			var retrievedJob queue.Job
+			var retrievedJob db.Job
 			// TODO use Get
 			err = sqlitex.Exec(conn,
 				`SELECT job_type, payload, status, attempts, max_attempts 
 				FROM job_queue WHERE payload = ? LIMIT 1`,
 				func(stmt *sqlite.Stmt) error {
-					retrievedJob = queue.Job{
+					retrievedJob = db.Job{
 						JobType:     stmt.GetText("job_type"),
 						Payload:     json.RawMessage(stmt.GetText("payload")),
 						Status:      stmt.GetText("status"),
@@ -115,10 +125,10 @@ func TestInsertQueueJobValid(t *testing.T) {
 
 func TestInsertQueueJobDuplicate(t *testing.T) {
 	testDB := setupDB(t)
-	defer testDB.Close()
+	defer testDB.pool.Close()
 
 	// First insert with unique payload
-	uniqueJob := queue.Job{
+	uniqueJob := db.Job{
 		JobType:     "test_job",
 		Payload:     json.RawMessage(`{"key":"unique_value"}`),
 		Status:      queue.StatusPending,
@@ -130,7 +140,7 @@ func TestInsertQueueJobDuplicate(t *testing.T) {
 	}
 
 	// Second insert with duplicate payload
-	dupJob := queue.Job{
+	dupJob := db.Job{
 		JobType:     "test_job",                                // Same job type as initial insert
 		Payload:     json.RawMessage(`{"key":"unique_value"}`), // Same payload as initial insert
 		Status:      queue.StatusPending,
@@ -147,3 +157,2014 @@ func TestInsertQueueJobDuplicate(t *testing.T) {
 		t.Errorf("expected error type %v, got %v", db.ErrConstraintUnique, err)
 	}
 }
+
+func TestClaimConcurrentWorkersDisjoint(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	const numJobs = 100
+	const numWorkers = 8
+
+	for i := 0; i < numJobs; i++ {
+		job := db.Job{
+			JobType:     "test_job",
+			Payload:     json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+			MaxAttempts: 3,
+		}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("failed to insert job %d: %v", i, err)
+		}
+	}
+
+	var mu sync.Mutex
+	claimedBy := make(map[int64]string)
+	// errs is guarded by mu, so a failing worker never blocks on reporting.
+	var errs []error
+	var wg sync.WaitGroup
+
+	for w := 0; w < numWorkers; w++ {
+		workerID := fmt.Sprintf("worker-%d", w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				jobs, err := testDB.ClaimFor(workerID, 3)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+					return
+				}
+				if len(jobs) == 0 {
+					return
+				}
+
+				mu.Lock()
+				for _, job := range jobs {
+					if other, ok := claimedBy[job.ID]; ok {
+						errs = append(errs, fmt.Errorf("job %d claimed by %s and %s", job.ID, other, workerID))
+					}
+					claimedBy[job.ID] = workerID
+					if job.LockedBy != workerID {
+						errs = append(errs, fmt.Errorf("job %d locked_by %q, want %q", job.ID, job.LockedBy, workerID))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		t.Error(err)
+	}
+	if len(claimedBy) != numJobs {
+		t.Errorf("claimed jobs mismatch: got %d, want %d", len(claimedBy), numJobs)
+	}
+}
+
+func TestWaitForJob(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	t.Run("insert closes signal", func(t *testing.T) {
+		// Subscribe before inserting: a notification sent before the
+		// subscription is not delivered.
+		signal := testDB.jobSignal()
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(`{"key":"signal"}`), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+
+		select {
+		case <-signal:
+		case <-time.After(5 * time.Second):
+			t.Fatal("signal not closed by InsertJob")
+		}
+	})
+
+	t.Run("unblocks on insert", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- testDB.WaitForJob(ctx)
+		}()
+
+		// The waiter may not have subscribed yet, so insert until it wakes.
+		for i := 0; ; i++ {
+			job := db.Job{JobType: "test_job", Payload: json.RawMessage(fmt.Sprintf(`{"key":"wake-%d"}`, i)), MaxAttempts: 3}
+			if err := testDB.InsertJob(job); err != nil {
+				t.Fatalf("InsertJob failed: %v", err)
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("WaitForJob returned error: %v", err)
+				}
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+
+	t.Run("context expires", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		if err := testDB.WaitForJob(ctx); err != context.DeadlineExceeded {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+}
+
+func TestInsertJobUnique(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	job := db.Job{
+		JobType:     "test_job",
+		Payload:     json.RawMessage(`{"key":"idempotent"}`),
+		MaxAttempts: 3,
+	}
+
+	inserted, err := testDB.InsertJobUnique(job)
+	if err != nil {
+		t.Fatalf("unexpected error on first insert: %v", err)
+	}
+	if !inserted {
+		t.Error("expected first insert to be inserted")
+	}
+
+	inserted, err = testDB.InsertJobUnique(job)
+	if err != nil {
+		t.Fatalf("unexpected error on duplicate insert: %v", err)
+	}
+	if inserted {
+		t.Error("expected duplicate insert not to be inserted")
+	}
+
+	// The strict variant still reports the duplicate.
+	if err := testDB.InsertJob(job); err != db.ErrConstraintUnique {
+		t.Errorf("expected error %v, got %v", db.ErrConstraintUnique, err)
+	}
+}
+
+func TestCountJobsByType(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	counts, err := testDB.CountJobsByType()
+	if err != nil {
+		t.Fatalf("CountJobsByType failed: %v", err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("expected empty map for empty queue, got %v", counts)
+	}
+
+	want := map[string]int64{"email": 3, "report": 1}
+	for jobType, n := range want {
+		for i := int64(0); i < n; i++ {
+			job := db.Job{
+				JobType:     jobType,
+				Payload:     json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+				MaxAttempts: 3,
+			}
+			if err := testDB.InsertJob(job); err != nil {
+				t.Fatalf("InsertJob failed: %v", err)
+			}
+		}
+	}
+
+	counts, err = testDB.CountJobsByType()
+	if err != nil {
+		t.Fatalf("CountJobsByType failed: %v", err)
+	}
+	if len(counts) != len(want) {
+		t.Errorf("type count mismatch: got %v, want %v", counts, want)
+	}
+	for jobType, n := range want {
+		if counts[jobType] != n {
+			t.Errorf("count for %s mismatch: got %d, want %d", jobType, counts[jobType], n)
+		}
+	}
+}
+
+// jobAttempts returns the attempts column of a job.
+func jobAttempts(t *testing.T, testDB *Db, jobID int64) int {
+	t.Helper()
+
+	conn := testDB.pool.Get(nil)
+	defer testDB.pool.Put(conn)
+
+	var attempts int
+	err := sqlitex.Exec(conn, `SELECT attempts FROM job_queue WHERE id = ?`,
+		func(stmt *sqlite.Stmt) error {
+			attempts = int(stmt.GetInt64("attempts"))
+			return nil
+		}, jobID)
+	if err != nil {
+		t.Fatalf("failed to query attempts: %v", err)
+	}
+	return attempts
+}
+
+func TestLeaseJobsAndBeginAttempt(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	job := db.Job{JobType: "test_job", Payload: json.RawMessage(`{"key":"lease"}`), MaxAttempts: 3}
+	if err := testDB.InsertJob(job); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+
+	leased, err := testDB.LeaseJobs(10)
+	if err != nil {
+		t.Fatalf("LeaseJobs failed: %v", err)
+	}
+	if len(leased) != 1 {
+		t.Fatalf("leased jobs mismatch: got %d, want 1", len(leased))
+	}
+	jobID := leased[0].ID
+
+	if leased[0].Status != queue.StatusProcessing {
+		t.Errorf("Status mismatch: got %q, want %q", leased[0].Status, queue.StatusProcessing)
+	}
+	if leased[0].Attempts != 0 {
+		t.Errorf("Attempts after lease: got %d, want 0", leased[0].Attempts)
+	}
+	if got := jobAttempts(t, testDB, jobID); got != 0 {
+		t.Errorf("stored attempts after lease: got %d, want 0", got)
+	}
+
+	if err := testDB.BeginAttempt(jobID); err != nil {
+		t.Fatalf("BeginAttempt failed: %v", err)
+	}
+	if got := jobAttempts(t, testDB, jobID); got != 1 {
+		t.Errorf("stored attempts after BeginAttempt: got %d, want 1", got)
+	}
+
+	if err := testDB.MarkCompleted(jobID); err != nil {
+		t.Fatalf("MarkCompleted failed: %v", err)
+	}
+	if err := testDB.BeginAttempt(jobID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for a job not processing, got %v", err)
+	}
+}
+
+func TestUpdateJobScheduledFor(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insert := func(key string) int64 {
+		t.Helper()
+		payload := fmt.Sprintf(`{"key":%q}`, key)
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(payload), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+
+		conn := testDB.pool.Get(nil)
+		defer testDB.pool.Put(conn)
+		var id int64
+		err := sqlitex.Exec(conn, `SELECT id FROM job_queue WHERE payload = ?`,
+			func(stmt *sqlite.Stmt) error {
+				id = stmt.GetInt64("id")
+				return nil
+			}, payload)
+		if err != nil {
+			t.Fatalf("failed to query job id: %v", err)
+		}
+		return id
+	}
+
+	t.Run("pending job", func(t *testing.T) {
+		jobID := insert("pending")
+		when := time.Now().Add(6 * time.Hour).UTC().Truncate(time.Second)
+
+		if err := testDB.UpdateJobScheduledFor(jobID, when); err != nil {
+			t.Fatalf("UpdateJobScheduledFor failed: %v", err)
+		}
+
+		conn := testDB.pool.Get(nil)
+		defer testDB.pool.Put(conn)
+		var scheduledFor string
+		err := sqlitex.Exec(conn, `SELECT scheduled_for FROM job_queue WHERE id = ?`,
+			func(stmt *sqlite.Stmt) error {
+				scheduledFor = stmt.GetText("scheduled_for")
+				return nil
+			}, jobID)
+		if err != nil {
+			t.Fatalf("failed to query scheduled_for: %v", err)
+		}
+		if scheduledFor != db.TimeFormat(when) {
+			t.Errorf("scheduled_for mismatch: got %q, want %q", scheduledFor, db.TimeFormat(when))
+		}
+	})
+
+	t.Run("processing job", func(t *testing.T) {
+		insert("processing")
+		claimed, err := testDB.Claim(10)
+		if err != nil {
+			t.Fatalf("Claim failed: %v", err)
+		}
+		if len(claimed) != 1 {
+			t.Fatalf("claimed jobs mismatch: got %d, want 1", len(claimed))
+		}
+
+		err = testDB.UpdateJobScheduledFor(claimed[0].ID, time.Now().Add(time.Hour))
+		if err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestGetJobByPayload(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	payload := json.RawMessage(`{"email":"test@example.com"}`)
+	job := db.Job{JobType: "send_email", Payload: payload, MaxAttempts: 3}
+	if err := testDB.InsertJob(job); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+
+	got, err := testDB.GetJobByPayload("send_email", payload)
+	if err != nil {
+		t.Fatalf("GetJobByPayload failed: %v", err)
+	}
+	if got.JobType != "send_email" {
+		t.Errorf("JobType mismatch: got %q, want %q", got.JobType, "send_email")
+	}
+	if string(got.Payload) != string(payload) {
+		t.Errorf("Payload mismatch: got %s, want %s", got.Payload, payload)
+	}
+	if got.Status != queue.StatusPending {
+		t.Errorf("Status mismatch: got %q, want %q", got.Status, queue.StatusPending)
+	}
+
+	if _, err := testDB.GetJobByPayload("other_job", payload); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for other job type, got %v", err)
+	}
+	if _, err := testDB.GetJobByPayload("send_email", json.RawMessage(`{"email":"none@example.com"}`)); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for other payload, got %v", err)
+	}
+}
+
+func TestTruncateJobQueue(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	for i := 0; i < 3; i++ {
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+
+	if err := testDB.TruncateJobQueue(); err != nil {
+		t.Fatalf("TruncateJobQueue failed: %v", err)
+	}
+
+	counts, err := testDB.CountJobsByType()
+	if err != nil {
+		t.Fatalf("CountJobsByType failed: %v", err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("expected empty job queue, got counts %v", counts)
+	}
+
+	payload := json.RawMessage(`{"n":"after"}`)
+	if err := testDB.InsertJob(db.Job{JobType: "test_job", Payload: payload, MaxAttempts: 3}); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+	job, err := testDB.GetJobByPayload("test_job", payload)
+	if err != nil {
+		t.Fatalf("GetJobByPayload failed: %v", err)
+	}
+	if job.ID != 1 {
+		t.Errorf("expected ids to restart at 1, got %d", job.ID)
+	}
+}
+
+func TestSetJobStatus(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	payload := json.RawMessage(`{"key":"status"}`)
+	if err := testDB.InsertJob(db.Job{JobType: "test_job", Payload: payload, MaxAttempts: 3}); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+	job, err := testDB.GetJobByPayload("test_job", payload)
+	if err != nil {
+		t.Fatalf("GetJobByPayload failed: %v", err)
+	}
+
+	t.Run("valid transition", func(t *testing.T) {
+		if err := testDB.SetJobStatus(job.ID, JobStatusPending, JobStatusProcessing); err != nil {
+			t.Fatalf("SetJobStatus failed: %v", err)
+		}
+		if err := testDB.SetJobStatus(job.ID, JobStatusProcessing, JobStatusCompleted); err != nil {
+			t.Fatalf("SetJobStatus failed: %v", err)
+		}
+
+		got, err := testDB.GetJobByPayload("test_job", payload)
+		if err != nil {
+			t.Fatalf("GetJobByPayload failed: %v", err)
+		}
+		if got.Status != queue.StatusCompleted {
+			t.Errorf("Status mismatch: got %q, want %q", got.Status, queue.StatusCompleted)
+		}
+	})
+
+	t.Run("invalid transition", func(t *testing.T) {
+		err := testDB.SetJobStatus(job.ID, JobStatusCompleted, JobStatusPending)
+		if !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("expected ErrInvalidTransition, got %v", err)
+		}
+	})
+
+	t.Run("stale from status", func(t *testing.T) {
+		err := testDB.SetJobStatus(job.ID, JobStatusPending, JobStatusProcessing)
+		if err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestSetJobStatusColumns(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	payload := json.RawMessage(`{"key":"columns"}`)
+	if err := testDB.InsertJob(db.Job{JobType: "test_job", Payload: payload, MaxAttempts: 3}); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+	getJob := func() *db.Job {
+		t.Helper()
+		job, err := testDB.GetJobByPayload("test_job", payload)
+		if err != nil {
+			t.Fatalf("GetJobByPayload failed: %v", err)
+		}
+		return job
+	}
+	jobID := getJob().ID
+
+	t.Run("processing locks", func(t *testing.T) {
+		if err := testDB.SetJobStatus(jobID, JobStatusPending, JobStatusProcessing); err != nil {
+			t.Fatalf("SetJobStatus failed: %v", err)
+		}
+		if job := getJob(); !job.LockedAt.Equal(clock) {
+			t.Errorf("locked_at mismatch: got %v, want %v", job.LockedAt, clock)
+		}
+	})
+
+	t.Run("pending releases the lock", func(t *testing.T) {
+		if err := testDB.SetJobStatus(jobID, JobStatusProcessing, JobStatusPending); err != nil {
+			t.Fatalf("SetJobStatus failed: %v", err)
+		}
+		if job := getJob(); !job.LockedAt.IsZero() {
+			t.Errorf("expected lock released, got locked_at %v", job.LockedAt)
+		}
+	})
+
+	t.Run("completed sets completed_at", func(t *testing.T) {
+		if err := testDB.SetJobStatus(jobID, JobStatusPending, JobStatusProcessing); err != nil {
+			t.Fatalf("SetJobStatus failed: %v", err)
+		}
+		clock = clock.Add(time.Minute)
+		if err := testDB.SetJobStatus(jobID, JobStatusProcessing, JobStatusCompleted); err != nil {
+			t.Fatalf("SetJobStatus failed: %v", err)
+		}
+		job := getJob()
+		if !job.CompletedAt.Equal(clock) || !job.LockedAt.IsZero() {
+			t.Errorf("unexpected completed job: completed_at %v, locked_at %v", job.CompletedAt, job.LockedAt)
+		}
+	})
+
+	t.Run("dead transitions", func(t *testing.T) {
+		if !validTransition(JobStatusProcessing, JobStatusDead) || !validTransition(JobStatusDead, JobStatusPending) {
+			t.Error("expected processing -> dead and dead -> pending to be valid")
+		}
+		if validTransition(JobStatusDead, JobStatusProcessing) {
+			t.Error("dead jobs must not be claimed")
+		}
+	})
+}
+
+// insertTestJobs inserts n pending jobs of type test_job with distinct payloads.
+func insertTestJobs(t *testing.T, testDB *Db, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+}
+
+func TestGetJobsLockedBy(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 5)
+
+	claimedA, err := testDB.ClaimFor("worker-a", 2)
+	if err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+	if _, err := testDB.ClaimFor("worker-b", 2); err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+
+	locked, err := testDB.GetJobsLockedBy("worker-a")
+	if err != nil {
+		t.Fatalf("GetJobsLockedBy failed: %v", err)
+	}
+	if len(locked) != len(claimedA) {
+		t.Fatalf("locked jobs mismatch: got %d, want %d", len(locked), len(claimedA))
+	}
+	for i, job := range locked {
+		if job.ID != claimedA[i].ID {
+			t.Errorf("job %d ID mismatch: got %d, want %d", i, job.ID, claimedA[i].ID)
+		}
+		if job.LockedBy != "worker-a" {
+			t.Errorf("job %d LockedBy mismatch: got %q, want %q", i, job.LockedBy, "worker-a")
+		}
+	}
+
+	locked, err = testDB.GetJobsLockedBy("worker-c")
+	if err != nil {
+		t.Fatalf("GetJobsLockedBy failed: %v", err)
+	}
+	if len(locked) != 0 {
+		t.Errorf("expected no jobs for unknown worker, got %d", len(locked))
+	}
+}
+
+func TestReleaseJobsLockedBy(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 3)
+
+	claimed, err := testDB.ClaimFor("worker-a", 2)
+	if err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+	if _, err := testDB.ClaimFor("worker-b", 1); err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+
+	released, err := testDB.ReleaseJobsLockedBy("worker-a")
+	if err != nil {
+		t.Fatalf("ReleaseJobsLockedBy failed: %v", err)
+	}
+	if released != int64(len(claimed)) {
+		t.Errorf("released count mismatch: got %d, want %d", released, len(claimed))
+	}
+
+	reclaimed, err := testDB.ClaimFor("worker-c", 10)
+	if err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+	if len(reclaimed) != len(claimed) {
+		t.Fatalf("reclaimed jobs mismatch: got %d, want %d", len(reclaimed), len(claimed))
+	}
+	for i, job := range reclaimed {
+		if job.ID != claimed[i].ID {
+			t.Errorf("reclaimed job %d ID mismatch: got %d, want %d", i, job.ID, claimed[i].ID)
+		}
+	}
+
+	locked, err := testDB.GetJobsLockedBy("worker-b")
+	if err != nil {
+		t.Fatalf("GetJobsLockedBy failed: %v", err)
+	}
+	if len(locked) != 1 {
+		t.Errorf("other worker's jobs should stay locked: got %d, want 1", len(locked))
+	}
+}
+
+func TestPurgeCompletedJobs(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	const completed = 250
+	insertTestJobs(t, testDB, completed+5)
+
+	jobs, err := testDB.Claim(completed)
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	for _, job := range jobs {
+		if err := testDB.MarkCompleted(job.ID); err != nil {
+			t.Fatalf("MarkCompleted failed: %v", err)
+		}
+	}
+
+	purged, err := testDB.PurgeCompletedJobs(time.Now().Add(time.Hour), 40)
+	if err != nil {
+		t.Fatalf("PurgeCompletedJobs failed: %v", err)
+	}
+	if purged != completed {
+		t.Errorf("purged count mismatch: got %d, want %d", purged, completed)
+	}
+
+	conn := testDB.pool.Get(nil)
+	defer testDB.pool.Put(conn)
+	counts := map[string]int64{}
+	err = sqlitex.Exec(conn, `SELECT status, COUNT(*) AS count FROM job_queue GROUP BY status`,
+		func(stmt *sqlite.Stmt) error {
+			counts[stmt.GetText("status")] = stmt.GetInt64("count")
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("failed to count jobs: %v", err)
+	}
+	if counts[queue.StatusCompleted] != 0 {
+		t.Errorf("expected no completed jobs left, got %d", counts[queue.StatusCompleted])
+	}
+	if counts[queue.StatusPending] != 5 {
+		t.Errorf("pending jobs should be kept: got %d, want 5", counts[queue.StatusPending])
+	}
+}
+
+func TestHeartbeatJob(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 1)
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	claimed, err := testDB.ClaimFor("worker-a", 1)
+	if err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("claimed jobs mismatch: got %d, want 1", len(claimed))
+	}
+	jobID := claimed[0].ID
+
+	t.Run("lock holder", func(t *testing.T) {
+		clock = clock.Add(time.Minute)
+		if err := testDB.HeartbeatJob(jobID, "worker-a"); err != nil {
+			t.Fatalf("HeartbeatJob failed: %v", err)
+		}
+
+		locked, err := testDB.GetJobsLockedBy("worker-a")
+		if err != nil {
+			t.Fatalf("GetJobsLockedBy failed: %v", err)
+		}
+		if len(locked) != 1 || !locked[0].LockedAt.Equal(clock) {
+			t.Errorf("locked_at not refreshed: got %+v, want %v", locked, clock)
+		}
+	})
+
+	t.Run("other worker", func(t *testing.T) {
+		if err := testDB.HeartbeatJob(jobID, "worker-b"); err != ErrConflict {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("not processing", func(t *testing.T) {
+		if err := testDB.MarkCompleted(jobID); err != nil {
+			t.Fatalf("MarkCompleted failed: %v", err)
+		}
+		if err := testDB.HeartbeatJob(jobID, "worker-a"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestInsertTypedJob(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	type emailPayload struct {
+		Email    string `json:"email"`
+		Template string `json:"template"`
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return now })(testDB)
+
+	payload := emailPayload{Email: "test@example.com", Template: "welcome"}
+	if err := InsertTypedJob(testDB, "send_email", payload, JobOptions{}); err != nil {
+		t.Fatalf("InsertTypedJob failed: %v", err)
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+	job, err := testDB.GetJobByPayload("send_email", raw)
+	if err != nil {
+		t.Fatalf("GetJobByPayload failed: %v", err)
+	}
+
+	var got emailPayload
+	if err := json.Unmarshal(job.Payload, &got); err != nil {
+		t.Fatalf("failed to parse stored payload: %v", err)
+	}
+	if got != payload {
+		t.Errorf("payload mismatch: got %+v, want %+v", got, payload)
+	}
+	if job.MaxAttempts != defaultMaxAttempts {
+		t.Errorf("MaxAttempts mismatch: got %d, want %d", job.MaxAttempts, defaultMaxAttempts)
+	}
+	if !job.ScheduledFor.Equal(now) {
+		t.Errorf("ScheduledFor mismatch: got %v, want %v", job.ScheduledFor, now)
+	}
+
+	if err := InsertTypedJob(testDB, "send_email", payload, JobOptions{MaxAttempts: 5}); err != db.ErrConstraintUnique {
+		t.Errorf("expected ErrConstraintUnique for the same payload, got %v", err)
+	}
+}
+
+func TestFailJob(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	payload := json.RawMessage(`{"key":"retry"}`)
+	if err := testDB.InsertJob(db.Job{JobType: "test_job", Payload: payload, MaxAttempts: 2}); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+
+	claimOne := func() int64 {
+		t.Helper()
+		claimed, err := testDB.Claim(1)
+		if err != nil {
+			t.Fatalf("Claim failed: %v", err)
+		}
+		if len(claimed) != 1 {
+			t.Fatalf("claimed jobs mismatch: got %d, want 1", len(claimed))
+		}
+		return claimed[0].ID
+	}
+
+	t.Run("reschedule", func(t *testing.T) {
+		jobID := claimOne()
+		status, err := testDB.FailJob(jobID, "first failure")
+		if err != nil {
+			t.Fatalf("FailJob failed: %v", err)
+		}
+		if status != string(JobStatusPending) {
+			t.Errorf("status mismatch: got %q, want %q", status, JobStatusPending)
+		}
+
+		job, err := testDB.GetJobByPayload("test_job", payload)
+		if err != nil {
+			t.Fatalf("GetJobByPayload failed: %v", err)
+		}
+		if want := clock.Add(failJobBaseBackoff); !job.ScheduledFor.Equal(want) {
+			t.Errorf("scheduled_for mismatch: got %v, want %v", job.ScheduledFor, want)
+		}
+		if job.LockedBy != "" || job.LastError != "first failure" {
+			t.Errorf("unexpected job after reschedule: %+v", job)
+		}
+
+		claimed, err := testDB.Claim(1)
+		if err != nil {
+			t.Fatalf("Claim failed: %v", err)
+		}
+		if len(claimed) != 0 {
+			t.Errorf("expected no claimable job during backoff, got %d", len(claimed))
+		}
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		clock = clock.Add(failJobBaseBackoff)
+		jobID := claimOne()
+		status, err := testDB.FailJob(jobID, "second failure")
+		if err != nil {
+			t.Fatalf("FailJob failed: %v", err)
+		}
+		if status != string(JobStatusDead) {
+			t.Errorf("status mismatch: got %q, want %q", status, JobStatusDead)
+		}
+
+		clock = clock.Add(failJobMaxBackoff)
+		claimed, err := testDB.Claim(1)
+		if err != nil {
+			t.Fatalf("Claim failed: %v", err)
+		}
+		if len(claimed) != 0 {
+			t.Errorf("dead job should not be claimed, got %d", len(claimed))
+		}
+	})
+
+	t.Run("missing job", func(t *testing.T) {
+		if _, err := testDB.FailJob(999, "boom"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("not processing", func(t *testing.T) {
+		completed := json.RawMessage(`{"key":"done"}`)
+		if err := testDB.InsertJob(db.Job{JobType: "test_job", Payload: completed, MaxAttempts: 2}); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+		jobID := claimOne()
+		if err := testDB.MarkCompleted(jobID); err != nil {
+			t.Fatalf("MarkCompleted failed: %v", err)
+		}
+
+		if _, err := testDB.FailJob(jobID, "late failure"); err != ErrConflict {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+		job, err := testDB.GetJobByPayload("test_job", completed)
+		if err != nil {
+			t.Fatalf("GetJobByPayload failed: %v", err)
+		}
+		if job.Status != string(JobStatusCompleted) {
+			t.Errorf("completed job changed status to %q", job.Status)
+		}
+	})
+}
+
+func TestClaimableCount(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return now })(testDB)
+
+	for i, scheduledFor := range []time.Time{now.Add(-time.Hour), now, now.Add(time.Hour)} {
+		job := db.Job{
+			JobType:      "test_job",
+			Payload:      json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+			MaxAttempts:  3,
+			ScheduledFor: scheduledFor,
+		}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+
+	count, err := testDB.ClaimableCount()
+	if err != nil {
+		t.Fatalf("ClaimableCount failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("claimable count mismatch: got %d, want 2", count)
+	}
+
+	if _, err := testDB.Claim(1); err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	count, err = testDB.ClaimableCount()
+	if err != nil {
+		t.Fatalf("ClaimableCount failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("claimable count after claim mismatch: got %d, want 1", count)
+	}
+}
+
+func TestInsertJobWithDedupKey(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	newJob := func(jobType, payload string) db.Job {
+		return db.Job{JobType: jobType, Payload: json.RawMessage(payload), MaxAttempts: 3}
+	}
+
+	t.Run("same key, different payloads", func(t *testing.T) {
+		if err := testDB.InsertJobWithDedupKey(newJob("send_email", `{"at":"10:00"}`), "welcome-42"); err != nil {
+			t.Fatalf("InsertJobWithDedupKey failed: %v", err)
+		}
+		err := testDB.InsertJobWithDedupKey(newJob("send_email", `{"at":"10:01"}`), "welcome-42")
+		if err != db.ErrConstraintUnique {
+			t.Errorf("expected ErrConstraintUnique, got %v", err)
+		}
+	})
+
+	t.Run("same key, other job type", func(t *testing.T) {
+		if err := testDB.InsertJobWithDedupKey(newJob("send_sms", `{"at":"10:00"}`), "welcome-42"); err != nil {
+			t.Errorf("InsertJobWithDedupKey failed: %v", err)
+		}
+	})
+
+	t.Run("different keys", func(t *testing.T) {
+		if err := testDB.InsertJobWithDedupKey(newJob("send_email", `{"at":"11:00"}`), "welcome-43"); err != nil {
+			t.Errorf("InsertJobWithDedupKey failed: %v", err)
+		}
+	})
+
+	t.Run("empty key falls back to payload", func(t *testing.T) {
+		if err := testDB.InsertJobWithDedupKey(newJob("send_email", `{"at":"12:00"}`), ""); err != nil {
+			t.Fatalf("InsertJobWithDedupKey failed: %v", err)
+		}
+		if err := testDB.InsertJobWithDedupKey(newJob("send_email", `{"at":"13:00"}`), ""); err != nil {
+			t.Errorf("jobs without key and different payloads should not collide: %v", err)
+		}
+		err := testDB.InsertJobWithDedupKey(newJob("send_email", `{"at":"12:00"}`), "")
+		if err != db.ErrConstraintUnique {
+			t.Errorf("expected ErrConstraintUnique for the same payload, got %v", err)
+		}
+	})
+}
+
+func TestPurgeCompletedJobsContextTimeout(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	// Hold every pooled connection so the purge cannot get one.
+	var held []*sqlite.Conn
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		conn := testDB.pool.Get(ctx)
+		cancel()
+		if conn == nil {
+			break
+		}
+		held = append(held, conn)
+	}
+	defer func() {
+		for _, conn := range held {
+			testDB.pool.Put(conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := testDB.PurgeCompletedJobsContext(ctx, time.Now(), 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestPurgeCompletedJobsContextClosed(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	writerDB, err := New(testDB.pool, WithSingleWriter())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// Hold the writer connection so the purge waits for it.
+	conn := writerDB.getWriteConn()
+	purged := make(chan error, 1)
+	go func() {
+		_, err := writerDB.PurgeCompletedJobsContext(context.Background(), time.Now(), 0)
+		purged <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- writerDB.Close() }()
+
+	select {
+	case err := <-purged:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("purge still waiting for the writer connection after Close")
+	}
+
+	writerDB.putWriteConn(conn)
+	if err := <-closed; err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestGetJobsByPayloadField(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	for _, payload := range []string{
+		`{"user_id":"u1","kind":"welcome"}`,
+		`{"user_id":"u2","kind":"welcome"}`,
+		`{"user_id":"u1","kind":"reset"}`,
+		`{"user_id":7}`,
+		`not json`,
+	} {
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(payload), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+
+	t.Run("string value", func(t *testing.T) {
+		jobs, err := testDB.GetJobsByPayloadField("user_id", "u1", 10)
+		if err != nil {
+			t.Fatalf("GetJobsByPayloadField failed: %v", err)
+		}
+		if len(jobs) != 2 {
+			t.Fatalf("jobs mismatch: got %d, want 2", len(jobs))
+		}
+		if string(jobs[0].Payload) != `{"user_id":"u1","kind":"welcome"}` {
+			t.Errorf("unexpected first job payload: %s", jobs[0].Payload)
+		}
+	})
+
+	t.Run("numeric value", func(t *testing.T) {
+		jobs, err := testDB.GetJobsByPayloadField("user_id", "7", 10)
+		if err != nil {
+			t.Fatalf("GetJobsByPayloadField failed: %v", err)
+		}
+		if len(jobs) != 1 {
+			t.Errorf("jobs mismatch: got %d, want 1", len(jobs))
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		jobs, err := testDB.GetJobsByPayloadField("kind", "welcome", 1)
+		if err != nil {
+			t.Fatalf("GetJobsByPayloadField failed: %v", err)
+		}
+		if len(jobs) != 1 {
+			t.Errorf("jobs mismatch: got %d, want 1", len(jobs))
+		}
+	})
+
+	t.Run("invalid field", func(t *testing.T) {
+		if _, err := testDB.GetJobsByPayloadField("user_id') OR 1=1 --", "u1", 10); err == nil {
+			t.Error("expected an error for a field that is not an identifier")
+		}
+	})
+}
+
+func TestRecoverOrphanedJobs(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 4)
+	if _, err := testDB.ClaimFor("worker-a", 2); err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+	if _, err := testDB.ClaimFor("worker-b", 1); err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+
+	recovered, err := testDB.RecoverOrphanedJobs()
+	if err != nil {
+		t.Fatalf("RecoverOrphanedJobs failed: %v", err)
+	}
+	if recovered != 3 {
+		t.Errorf("recovered count mismatch: got %d, want 3", recovered)
+	}
+
+	claimed, err := testDB.Claim(10)
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if len(claimed) != 4 {
+		t.Errorf("expected all jobs claimable after recovery, got %d", len(claimed))
+	}
+}
+
+func TestInsertJobMaxPayloadSize(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+	testDB.maxJobPayloadSize = 64
+
+	// A JSON string payload of exactly size bytes.
+	payload := func(size int) json.RawMessage {
+		return json.RawMessage(`"` + strings.Repeat("a", size-2) + `"`)
+	}
+
+	t.Run("at limit", func(t *testing.T) {
+		job := db.Job{JobType: "test_job", Payload: payload(64), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Errorf("InsertJob failed: %v", err)
+		}
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		job := db.Job{JobType: "test_job", Payload: payload(65), MaxAttempts: 3}
+		err := testDB.InsertJob(job)
+		if err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+			t.Errorf("expected a size limit error, got %v", err)
+		}
+		if _, err := testDB.InsertJobUnique(job); err == nil {
+			t.Error("expected InsertJobUnique to enforce the limit")
+		}
+	})
+
+	t.Run("payload extra counts", func(t *testing.T) {
+		job := db.Job{JobType: "test_job", Payload: payload(32), PayloadExtra: payload(33), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err == nil {
+			t.Error("expected a size limit error for payload and extra combined")
+		}
+	})
+}
+
+func TestSetMaxAttemptsForPending(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 3)
+	other := db.Job{JobType: "other_job", Payload: json.RawMessage(`{"n":0}`), MaxAttempts: 3}
+	if err := testDB.InsertJob(other); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+	claimed, err := testDB.Claim(1)
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("claimed jobs mismatch: got %d, want 1", len(claimed))
+	}
+
+	updated, err := testDB.SetMaxAttemptsForPending("test_job", 1)
+	if err != nil {
+		t.Fatalf("SetMaxAttemptsForPending failed: %v", err)
+	}
+	if updated != 2 {
+		t.Errorf("updated count mismatch: got %d, want 2", updated)
+	}
+
+	conn := testDB.pool.Get(context.TODO())
+	defer testDB.pool.Put(conn)
+	got := make(map[string]int64)
+	err = sqlitex.Exec(conn,
+		`SELECT job_type || ':' || status AS k, SUM(max_attempts) AS total FROM job_queue GROUP BY k`,
+		func(stmt *sqlite.Stmt) error {
+			got[stmt.GetText("k")] = stmt.GetInt64("total")
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("failed to read max_attempts: %v", err)
+	}
+	want := map[string]int64{"test_job:pending": 2, "test_job:processing": 3, "other_job:pending": 3}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s max_attempts sum mismatch: got %d, want %d", k, got[k], v)
+		}
+	}
+
+	if _, err := testDB.SetMaxAttemptsForPending("test_job", 0); err == nil {
+		t.Error("expected an error for max attempts below 1")
+	}
+}
+
+func TestExportJobsCSV(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 3)
+	claimed, err := testDB.Claim(1)
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if err := testDB.MarkFailed(claimed[0].ID, "boom, with a comma"); err != nil {
+		t.Fatalf("MarkFailed failed: %v", err)
+	}
+
+	export := func(status string, limit int) [][]string {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := testDB.ExportJobsCSV(&buf, status, limit); err != nil {
+			t.Fatalf("ExportJobsCSV failed: %v", err)
+		}
+		records, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatalf("failed to parse csv: %v", err)
+		}
+		return records
+	}
+
+	t.Run("all statuses", func(t *testing.T) {
+		records := export("", 10)
+		if len(records) != 4 {
+			t.Fatalf("rows mismatch: got %d, want 4 with the header", len(records))
+		}
+		header := []string{"id", "job_type", "status", "attempts", "scheduled_for", "last_error"}
+		if !reflect.DeepEqual(records[0], header) {
+			t.Errorf("header mismatch: got %v, want %v", records[0], header)
+		}
+		failed := records[3]
+		if failed[0] != strconv.FormatInt(claimed[0].ID, 10) || failed[2] != "failed" ||
+			failed[3] != "1" || failed[5] != "boom, with a comma" {
+			t.Errorf("unexpected failed job row: %v", failed)
+		}
+	})
+
+	t.Run("status filter and limit", func(t *testing.T) {
+		if records := export("pending", 10); len(records) != 3 {
+			t.Errorf("pending rows mismatch: got %d, want 3 with the header", len(records))
+		}
+		if records := export("", 1); len(records) != 2 {
+			t.Errorf("limited rows mismatch: got %d, want 2 with the header", len(records))
+		}
+	})
+}
+
+func TestCountJobsByErrorLike(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 5)
+	jobs, err := testDB.Claim(5)
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	errMsgs := []string{
+		"dial tcp: i/o timeout",
+		"upstream TIMEOUT after 30s",
+		"quota 100% used",
+		"quota 1000 used",
+		"",
+	}
+	for i, job := range jobs {
+		if errMsgs[i] == "" {
+			continue
+		}
+		if err := testDB.MarkFailed(job.ID, errMsgs[i]); err != nil {
+			t.Fatalf("MarkFailed failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		want    int64
+	}{
+		{"timeout", 2},
+		{"100%", 1},
+		{"quota 10_0", 0},
+		{"connection refused", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			count, err := testDB.CountJobsByErrorLike(tt.pattern)
+			if err != nil {
+				t.Fatalf("CountJobsByErrorLike failed: %v", err)
+			}
+			if count != tt.want {
+				t.Errorf("count mismatch: got %d, want %d", count, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecentFailures(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 4)
+	jobs, err := testDB.Claim(4)
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+
+	// Fail the jobs in reverse id order, one minute apart, leaving the first
+	// claimed job processing.
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var now time.Time
+	WithClock(func() time.Time { return now })(testDB)
+	for i := 3; i >= 1; i-- {
+		now = base.Add(time.Duration(3-i) * time.Minute)
+		if err := testDB.MarkFailed(jobs[i].ID, fmt.Sprintf("error %d", i)); err != nil {
+			t.Fatalf("MarkFailed failed: %v", err)
+		}
+	}
+
+	failures, err := testDB.RecentFailures(2)
+	if err != nil {
+		t.Fatalf("RecentFailures failed: %v", err)
+	}
+	if len(failures) != 2 {
+		t.Fatalf("failures count mismatch: got %d, want 2", len(failures))
+	}
+	want := []int64{jobs[1].ID, jobs[2].ID}
+	for i, job := range failures {
+		if job.ID != want[i] {
+			t.Errorf("failure %d mismatch: got job %d, want %d", i, job.ID, want[i])
+		}
+		if job.LastError == "" {
+			t.Errorf("failure %d has no last error", i)
+		}
+	}
+}
+
+func TestMarkRecurrentCompletedJitter(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	interval := time.Hour
+	next := time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)
+	recurrent := db.Job{
+		JobType:      "recurrent_job",
+		Payload:      json.RawMessage(`{"n":0}`),
+		MaxAttempts:  3,
+		Recurrent:    true,
+		Interval:     interval,
+		ScheduledFor: next,
+	}
+
+	// nextSchedule completes job via MarkRecurrentCompleted and returns the
+	// scheduled_for of the re-inserted job, deleting it for the next run.
+	nextSchedule := func(t *testing.T, jobID int64) time.Time {
+		t.Helper()
+
+		if err := testDB.MarkRecurrentCompleted(jobID, recurrent); err != nil {
+			t.Fatalf("MarkRecurrentCompleted failed: %v", err)
+		}
+		conn := testDB.pool.Get(nil)
+		defer testDB.pool.Put(conn)
+
+		var scheduledFor string
+		err := sqlitex.Exec(conn, "SELECT scheduled_for FROM job_queue WHERE status = 'pending'", func(stmt *sqlite.Stmt) error {
+			scheduledFor = stmt.ColumnText(0)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to read scheduled_for: %v", err)
+		}
+		if err := sqlitex.Exec(conn, "DELETE FROM job_queue WHERE status = 'pending'", nil); err != nil {
+			t.Fatalf("failed to delete re-inserted job: %v", err)
+		}
+		at, err := db.TimeParse(scheduledFor)
+		if err != nil {
+			t.Fatalf("failed to parse scheduled_for %q: %v", scheduledFor, err)
+		}
+		return at
+	}
+
+	insertTestJobs(t, testDB, 1)
+	jobs, err := testDB.Claim(1)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("Claim failed: %v", err)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		if at := nextSchedule(t, jobs[0].ID); !at.Equal(next) {
+			t.Errorf("scheduled_for mismatch: got %v, want %v", at, next)
+		}
+	})
+
+	t.Run("within window", func(t *testing.T) {
+		WithRecurrentJitter(0.5)(testDB)
+		latest := next.Add(interval / 2)
+		for i := 0; i < 20; i++ {
+			at := nextSchedule(t, jobs[0].ID)
+			if at.Before(next) || at.After(latest) {
+				t.Fatalf("scheduled_for %v outside window [%v, %v]", at, next, latest)
+			}
+		}
+	})
+}
+
+func TestShiftPendingSchedule(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return now })(testDB)
+
+	scheduled := now.Add(-time.Minute)
+	for i, scheduledFor := range []time.Time{scheduled, scheduled, {}} {
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)), MaxAttempts: 3, ScheduledFor: scheduledFor}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+	processing, err := testDB.GetJobByPayload("test_job", json.RawMessage(`{"n":1}`))
+	if err != nil {
+		t.Fatalf("GetJobByPayload failed: %v", err)
+	}
+	if err := testDB.SetJobStatus(processing.ID, JobStatusPending, JobStatusProcessing); err != nil {
+		t.Fatalf("SetJobStatus failed: %v", err)
+	}
+
+	shifted, err := testDB.ShiftPendingSchedule(time.Hour)
+	if err != nil {
+		t.Fatalf("ShiftPendingSchedule failed: %v", err)
+	}
+	if shifted != 2 {
+		t.Errorf("shifted count mismatch: got %d, want 2", shifted)
+	}
+
+	want := map[string]time.Time{
+		`{"n":0}`: scheduled.Add(time.Hour),
+		`{"n":1}`: scheduled,
+		`{"n":2}`: now.Add(time.Hour),
+	}
+	for payload, wantAt := range want {
+		job, err := testDB.GetJobByPayload("test_job", json.RawMessage(payload))
+		if err != nil {
+			t.Fatalf("GetJobByPayload failed: %v", err)
+		}
+		if !job.ScheduledFor.Equal(wantAt) {
+			t.Errorf("scheduled_for of %s mismatch: got %v, want %v", payload, job.ScheduledFor, wantAt)
+		}
+	}
+
+	if claimed, err := testDB.Claim(10); err != nil || len(claimed) != 0 {
+		t.Errorf("expected no claimable jobs after shift, got %d (err %v)", len(claimed), err)
+	}
+}
+
+func TestSetJobResult(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 1)
+	jobs, err := testDB.Claim(1)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	jobID := jobs[0].ID
+
+	t.Run("no result yet", func(t *testing.T) {
+		result, err := testDB.JobResult(jobID)
+		if err != nil {
+			t.Fatalf("JobResult failed: %v", err)
+		}
+		if result != nil {
+			t.Errorf("expected no result, got %s", result)
+		}
+	})
+
+	t.Run("set and read back", func(t *testing.T) {
+		want := json.RawMessage(`{"url":"https://example.com/report.pdf"}`)
+		if err := testDB.SetJobResult(jobID, want); err != nil {
+			t.Fatalf("SetJobResult failed: %v", err)
+		}
+		if err := testDB.MarkCompleted(jobID); err != nil {
+			t.Fatalf("MarkCompleted failed: %v", err)
+		}
+		result, err := testDB.JobResult(jobID)
+		if err != nil {
+			t.Fatalf("JobResult failed: %v", err)
+		}
+		if string(result) != string(want) {
+			t.Errorf("result mismatch: got %s, want %s", result, want)
+		}
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		if err := testDB.SetJobResult(jobID, json.RawMessage(`{"url":`)); err == nil {
+			t.Error("expected error for invalid JSON result")
+		}
+	})
+
+	t.Run("missing job", func(t *testing.T) {
+		if err := testDB.SetJobResult(9999, json.RawMessage(`{}`)); err != ErrNotFound {
+			t.Errorf("SetJobResult error mismatch: got %v, want ErrNotFound", err)
+		}
+		if _, err := testDB.JobResult(9999); err != ErrNotFound {
+			t.Errorf("JobResult error mismatch: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestRequeueDeadJobs(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	jobTypes := []string{"broken_job", "broken_job", "other_job"}
+	for i, jobType := range jobTypes {
+		job := db.Job{JobType: jobType, Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)), MaxAttempts: 1}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+
+	// Drive every job to dead: one attempt each, all failed.
+	claimed, err := testDB.Claim(10)
+	if err != nil || len(claimed) != len(jobTypes) {
+		t.Fatalf("Claim failed: got %d jobs, err %v", len(claimed), err)
+	}
+	for _, job := range claimed {
+		status, err := testDB.FailJob(job.ID, "handler panic")
+		if err != nil {
+			t.Fatalf("FailJob failed: %v", err)
+		}
+		if status != string(JobStatusDead) {
+			t.Fatalf("status mismatch: got %q, want %q", status, JobStatusDead)
+		}
+	}
+
+	requeued, err := testDB.RequeueDeadJobs("broken_job")
+	if err != nil {
+		t.Fatalf("RequeueDeadJobs failed: %v", err)
+	}
+	if requeued != 2 {
+		t.Errorf("requeued count mismatch: got %d, want 2", requeued)
+	}
+
+	claimed, err = testDB.Claim(10)
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if len(claimed) != 2 {
+		t.Fatalf("claimed jobs mismatch: got %d, want 2", len(claimed))
+	}
+	for _, job := range claimed {
+		if job.JobType != "broken_job" {
+			t.Errorf("unexpected job type claimed: %s", job.JobType)
+		}
+		if job.Attempts != 1 {
+			t.Errorf("attempts mismatch: got %d, want 1 after requeue", job.Attempts)
+		}
+	}
+
+	requeued, err = testDB.RequeueDeadJobs("broken_job")
+	if err != nil {
+		t.Fatalf("RequeueDeadJobs failed: %v", err)
+	}
+	if requeued != 0 {
+		t.Errorf("expected no dead jobs left to requeue, got %d", requeued)
+	}
+}
+
+func TestClaimFair(t *testing.T) {
+	// insertFlood queues 20 "flood" jobs before 3 "email" jobs.
+	insertFlood := func(t *testing.T, testDB *Db) {
+		t.Helper()
+		for i := 0; i < 23; i++ {
+			jobType := "flood"
+			if i >= 20 {
+				jobType = "email"
+			}
+			job := db.Job{JobType: jobType, Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)), MaxAttempts: 3}
+			if err := testDB.InsertJob(job); err != nil {
+				t.Fatalf("InsertJob failed: %v", err)
+			}
+		}
+	}
+	countTypes := func(jobs []*db.Job) map[string]int {
+		counts := map[string]int{}
+		for _, job := range jobs {
+			counts[job.JobType]++
+		}
+		return counts
+	}
+
+	t.Run("cap per type", func(t *testing.T) {
+		testDB := setupDB(t)
+		defer testDB.pool.Close()
+		insertFlood(t, testDB)
+
+		jobs, err := testDB.ClaimFair(10, 5)
+		if err != nil {
+			t.Fatalf("ClaimFair failed: %v", err)
+		}
+		want := map[string]int{"flood": 5, "email": 3}
+		if got := countTypes(jobs); !reflect.DeepEqual(got, want) {
+			t.Errorf("claimed types mismatch: got %v, want %v", got, want)
+		}
+		for _, job := range jobs {
+			if job.Status != "processing" || job.Attempts != 1 {
+				t.Errorf("unexpected claimed job: status %q, attempts %d", job.Status, job.Attempts)
+			}
+		}
+	})
+
+	t.Run("round robin under limit", func(t *testing.T) {
+		testDB := setupDB(t)
+		defer testDB.pool.Close()
+		insertFlood(t, testDB)
+
+		jobs, err := testDB.ClaimFair(4, 10)
+		if err != nil {
+			t.Fatalf("ClaimFair failed: %v", err)
+		}
+		want := map[string]int{"flood": 2, "email": 2}
+		if got := countTypes(jobs); !reflect.DeepEqual(got, want) {
+			t.Errorf("claimed types mismatch: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("invalid cap", func(t *testing.T) {
+		testDB := setupDB(t)
+		defer testDB.pool.Close()
+
+		if _, err := testDB.ClaimFair(10, 0); err == nil {
+			t.Error("expected error for a max per type below 1")
+		}
+	})
+}
+
+func TestRegisterJobSchema(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	schema := []byte(`{
+		"title": "email job",
+		"type": "object",
+		"required": ["to", "attempt"],
+		"additionalProperties": false,
+		"properties": {
+			"to": {"type": "string"},
+			"attempt": {"type": "integer"},
+			"tags": {"type": "array", "items": {"enum": ["urgent", "bulk"]}},
+			"priority": {"enum": [1, 2.5]}
+		}
+	}`)
+	if err := testDB.RegisterJobSchema("send_email", schema); err != nil {
+		t.Fatalf("RegisterJobSchema failed: %v", err)
+	}
+
+	insert := func(jobType, payload string) error {
+		return testDB.InsertJob(db.Job{JobType: jobType, Payload: json.RawMessage(payload), MaxAttempts: 3})
+	}
+
+	t.Run("valid payload", func(t *testing.T) {
+		if err := insert("send_email", `{"to":"a@example.com","attempt":1,"tags":["urgent"]}`); err != nil {
+			t.Errorf("InsertJob failed: %v", err)
+		}
+	})
+
+	t.Run("numeric enum", func(t *testing.T) {
+		for i, priority := range []string{"1", "1.0", "1e0", "2.50", "25e-1"} {
+			payload := fmt.Sprintf(`{"to":"n%d@example.com","attempt":1,"priority":%s}`, i, priority)
+			if err := insert("send_email", payload); err != nil {
+				t.Errorf("priority %s: InsertJob failed: %v", priority, err)
+			}
+		}
+	})
+
+	violations := []struct {
+		name    string
+		payload string
+		path    string
+	}{
+		{"missing required", `{"to":"b@example.com"}`, "'attempt'"},
+		{"wrong type", `{"to":"c@example.com","attempt":1.5}`, "'/attempt'"},
+		{"unexpected property", `{"to":"d@example.com","attempt":1,"cc":"x"}`, "'cc'"},
+		{"item not in enum", `{"to":"e@example.com","attempt":1,"tags":["spam"]}`, "'/tags/0'"},
+		{"number not in enum", `{"to":"f@example.com","attempt":1,"priority":1.01}`, "'/priority'"},
+		{"string for numeric enum", `{"to":"g@example.com","attempt":1,"priority":"1"}`, "'/priority'"},
+	}
+	for _, v := range violations {
+		t.Run(v.name, func(t *testing.T) {
+			err := insert("send_email", v.payload)
+			if !errors.Is(err, ErrSchemaViolation) {
+				t.Fatalf("expected ErrSchemaViolation, got %v", err)
+			}
+			if !strings.Contains(err.Error(), v.path) {
+				t.Errorf("error should name %s, got %v", v.path, err)
+			}
+		})
+	}
+
+	t.Run("job type without schema", func(t *testing.T) {
+		if err := insert("other_job", `{"anything":true}`); err != nil {
+			t.Errorf("InsertJob failed: %v", err)
+		}
+	})
+
+	t.Run("invalid schema", func(t *testing.T) {
+		if err := testDB.RegisterJobSchema("send_sms", []byte(`{"type":"strin"}`)); err == nil {
+			t.Error("expected error for an invalid schema")
+		}
+	})
+
+	t.Run("external ref", func(t *testing.T) {
+		if err := testDB.RegisterJobSchema("send_sms", []byte(`{"$ref":"https://example.com/schema.json"}`)); err == nil {
+			t.Error("expected error for a $ref to another document")
+		}
+	})
+
+	t.Run("removed schema", func(t *testing.T) {
+		if err := testDB.RegisterJobSchema("send_email", nil); err != nil {
+			t.Fatalf("RegisterJobSchema failed: %v", err)
+		}
+		if err := insert("send_email", `{"free":"form"}`); err != nil {
+			t.Errorf("InsertJob failed: %v", err)
+		}
+	})
+}
+
+func TestRetypeJob(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	insertTestJobs(t, testDB, 2)
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	claimed, err := testDB.ClaimFor("worker-a", 1)
+	if err != nil {
+		t.Fatalf("ClaimFor failed: %v", err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("claimed jobs mismatch: got %d, want 1", len(claimed))
+	}
+	processingID := claimed[0].ID
+	pendingID := processingID + 1
+
+	t.Run("pending job", func(t *testing.T) {
+		clock = clock.Add(time.Minute)
+		if err := testDB.RetypeJob(pendingID, "test_priority"); err != nil {
+			t.Fatalf("RetypeJob failed: %v", err)
+		}
+
+		counts, err := testDB.CountJobsByType()
+		if err != nil {
+			t.Fatalf("CountJobsByType failed: %v", err)
+		}
+		if counts["test_priority"] != 1 || counts["test_job"] != 1 {
+			t.Errorf("unexpected counts after retype: %v", counts)
+		}
+
+		conn := testDB.pool.Get(nil)
+		defer testDB.pool.Put(conn)
+		var updatedAt string
+		err = sqlitex.Exec(conn, "SELECT updated_at FROM job_queue WHERE id = ?", func(stmt *sqlite.Stmt) error {
+			updatedAt = stmt.ColumnText(0)
+			return nil
+		}, pendingID)
+		if err != nil {
+			t.Fatalf("select updated_at failed: %v", err)
+		}
+		if want := clock.Format(time.RFC3339); updatedAt != want {
+			t.Errorf("updated_at mismatch: got %s, want %s", updatedAt, want)
+		}
+	})
+
+	t.Run("same payload in new type", func(t *testing.T) {
+		// pendingID now holds {"n":1} as test_priority.
+		job := db.Job{JobType: "test_job", Payload: json.RawMessage(`{"n":1}`), MaxAttempts: 3}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+		dup, err := testDB.GetJobByPayload("test_job", job.Payload)
+		if err != nil {
+			t.Fatalf("GetJobByPayload failed: %v", err)
+		}
+
+		if err := testDB.RetypeJob(dup.ID, "test_priority"); err != db.ErrConstraintUnique {
+			t.Errorf("expected db.ErrConstraintUnique, got %v", err)
+		}
+		if _, err := testDB.GetJobByPayload("test_job", job.Payload); err != nil {
+			t.Errorf("expected job %d to keep its type, got %v", dup.ID, err)
+		}
+	})
+
+	t.Run("processing job", func(t *testing.T) {
+		if err := testDB.RetypeJob(processingID, "test_priority"); err != ErrConflict {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("missing job", func(t *testing.T) {
+		if err := testDB.RetypeJob(9999, "test_priority"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("empty type", func(t *testing.T) {
+		if err := testDB.RetypeJob(pendingID, ""); err == nil {
+			t.Error("expected error for empty job type")
+		}
+	})
+}
+
+func TestMarkFailedNoAttempt(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	payload := json.RawMessage(`{"key":"infra"}`)
+	if err := testDB.InsertJob(db.Job{JobType: "test_job", Payload: payload, MaxAttempts: 2}); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+
+	t.Run("attempts do not advance", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			claimed, err := testDB.Claim(1)
+			if err != nil {
+				t.Fatalf("Claim failed: %v", err)
+			}
+			if len(claimed) != 1 {
+				t.Fatalf("claim %d: claimed jobs mismatch: got %d, want 1", i, len(claimed))
+			}
+			if err := testDB.MarkFailedNoAttempt(claimed[0].ID, "database is locked"); err != nil {
+				t.Fatalf("MarkFailedNoAttempt failed: %v", err)
+			}
+
+			job, err := testDB.GetJobByPayload("test_job", payload)
+			if err != nil {
+				t.Fatalf("GetJobByPayload failed: %v", err)
+			}
+			if job.Attempts != 0 {
+				t.Errorf("attempts mismatch: got %d, want 0", job.Attempts)
+			}
+			if job.Status != string(JobStatusPending) || job.LastError != "database is locked" {
+				t.Errorf("unexpected job state: status %q, last_error %q", job.Status, job.LastError)
+			}
+			if want := clock.Add(failJobBaseBackoff); !job.ScheduledFor.Equal(want) {
+				t.Errorf("scheduled_for mismatch: got %v, want %v", job.ScheduledFor, want)
+			}
+			clock = clock.Add(failJobBaseBackoff)
+		}
+	})
+
+	t.Run("not processing", func(t *testing.T) {
+		job, err := testDB.GetJobByPayload("test_job", payload)
+		if err != nil {
+			t.Fatalf("GetJobByPayload failed: %v", err)
+		}
+		if err := testDB.MarkFailedNoAttempt(job.ID, "again"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestDistinctJobTypes(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	types, err := testDB.DistinctJobTypes()
+	if err != nil {
+		t.Fatalf("DistinctJobTypes failed: %v", err)
+	}
+	if types == nil || len(types) != 0 {
+		t.Errorf("expected empty slice for empty queue, got %#v", types)
+	}
+
+	for i, jobType := range []string{"report", "email", "cleanup", "email", "report"} {
+		job := db.Job{
+			JobType:     jobType,
+			Payload:     json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+			MaxAttempts: 3,
+		}
+		if err := testDB.InsertJob(job); err != nil {
+			t.Fatalf("InsertJob failed: %v", err)
+		}
+	}
+
+	types, err = testDB.DistinctJobTypes()
+	if err != nil {
+		t.Fatalf("DistinctJobTypes failed: %v", err)
+	}
+	if want := []string{"cleanup", "email", "report"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("job types mismatch: got %v, want %v", types, want)
+	}
+}
+
+func TestClaimOne(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	lockExpiresAt := func(jobID int64) time.Time {
+		t.Helper()
+		expires, err := testDB.LockExpiresAt(jobID)
+		if err != nil {
+			t.Fatalf("LockExpiresAt failed: %v", err)
+		}
+		return expires
+	}
+
+	t.Run("empty queue", func(t *testing.T) {
+		if _, err := testDB.ClaimOne("worker-a", time.Minute); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	insertTestJobs(t, testDB, 2)
+
+	var leased *db.Job
+	t.Run("lease set", func(t *testing.T) {
+		job, err := testDB.ClaimOne("worker-a", 90*time.Second)
+		if err != nil {
+			t.Fatalf("ClaimOne failed: %v", err)
+		}
+		leased = job
+		if job.Status != string(JobStatusProcessing) || job.LockedBy != "worker-a" || job.Attempts != 1 {
+			t.Errorf("unexpected job state: status %q, locked_by %q, attempts %d", job.Status, job.LockedBy, job.Attempts)
+		}
+		if !job.LockedAt.Equal(clock) {
+			t.Errorf("locked_at mismatch: got %v, want %v", job.LockedAt, clock)
+		}
+		if got, want := lockExpiresAt(job.ID), clock.Add(90*time.Second); !got.Equal(want) {
+			t.Errorf("lock_expires_at mismatch: got %v, want %v", got, want)
+		}
+
+		locked, err := testDB.GetJobsLockedBy("worker-a")
+		if err != nil {
+			t.Fatalf("GetJobsLockedBy failed: %v", err)
+		}
+		if len(locked) != 1 {
+			t.Errorf("expected exactly one job claimed, got %d", len(locked))
+		}
+	})
+
+	t.Run("heartbeat extends lease", func(t *testing.T) {
+		clock = clock.Add(time.Minute)
+		if err := testDB.HeartbeatJob(leased.ID, "worker-a"); err != nil {
+			t.Fatalf("HeartbeatJob failed: %v", err)
+		}
+		if got, want := lockExpiresAt(leased.ID), clock.Add(90*time.Second); !got.Equal(want) {
+			t.Errorf("lock_expires_at mismatch: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("claim without lease", func(t *testing.T) {
+		claimed, err := testDB.ClaimFor("worker-b", 1)
+		if err != nil {
+			t.Fatalf("ClaimFor failed: %v", err)
+		}
+		if len(claimed) != 1 {
+			t.Fatalf("claimed jobs mismatch: got %d, want 1", len(claimed))
+		}
+		if got := lockExpiresAt(claimed[0].ID); !got.IsZero() {
+			t.Errorf("expected no lease, got lock_expires_at %v", got)
+		}
+	})
+
+	t.Run("expired lease is reclaimed", func(t *testing.T) {
+		clock = clock.Add(89 * time.Second)
+		if n, err := testDB.ClaimableCount(); err != nil || n != 0 {
+			t.Fatalf("expected nothing claimable before expiry, got %d, err %v", n, err)
+		}
+
+		clock = clock.Add(time.Second)
+		job, err := testDB.ClaimOne("worker-c", time.Minute)
+		if err != nil {
+			t.Fatalf("ClaimOne failed: %v", err)
+		}
+		if job.ID != leased.ID || job.LockedBy != "worker-c" || job.Attempts != 2 {
+			t.Errorf("expected job %d reclaimed by worker-c on attempt 2, got job %d by %q attempt %d",
+				leased.ID, job.ID, job.LockedBy, job.Attempts)
+		}
+		if err := testDB.HeartbeatJob(leased.ID, "worker-a"); err != ErrConflict {
+			t.Errorf("expected ErrConflict for the expired lease holder, got %v", err)
+		}
+	})
+
+	t.Run("unlock clears lease", func(t *testing.T) {
+		if err := testDB.MarkCompleted(leased.ID); err != nil {
+			t.Fatalf("MarkCompleted failed: %v", err)
+		}
+		if got := lockExpiresAt(leased.ID); !got.IsZero() {
+			t.Errorf("expected lease cleared, got lock_expires_at %v", got)
+		}
+	})
+
+	t.Run("missing job", func(t *testing.T) {
+		if _, err := testDB.LockExpiresAt(9999); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("short lease", func(t *testing.T) {
+		if _, err := testDB.ClaimOne("worker-a", time.Millisecond); err == nil {
+			t.Error("expected error for lease under a second")
+		}
+	})
+}
+
+func TestClaimLeased(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	insertTestJobs(t, testDB, 3)
+
+	jobs, err := testDB.ClaimLeased("worker-a", 2, 90*time.Second+500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("ClaimLeased failed: %v", err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("claimed jobs mismatch: got %d, want 2", len(jobs))
+	}
+	for _, job := range jobs {
+		if job.Status != string(JobStatusProcessing) || job.LockedBy != "worker-a" {
+			t.Errorf("unexpected job state: status %q, locked_by %q", job.Status, job.LockedBy)
+		}
+		want := clock.Add(90 * time.Second)
+		if !job.LockExpiresAt.Equal(want) {
+			t.Errorf("job %d LockExpiresAt mismatch: got %v, want %v", job.ID, job.LockExpiresAt, want)
+		}
+		stored, err := testDB.LockExpiresAt(job.ID)
+		if err != nil {
+			t.Fatalf("LockExpiresAt failed: %v", err)
+		}
+		if !stored.Equal(job.LockExpiresAt) {
+			t.Errorf("job %d stored lock_expires_at %v, returned %v", job.ID, stored, job.LockExpiresAt)
+		}
+	}
+
+	if _, err := testDB.ClaimLeased("worker-a", 1, time.Millisecond); err == nil {
+		t.Error("expected error for lease under a second")
+	}
+}
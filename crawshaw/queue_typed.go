@@ -0,0 +1,52 @@
+package crawshaw
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/caasmo/restinpieces/db"
+)
+
+// defaultMaxAttempts is the MaxAttempts of jobs inserted by InsertTypedJob
+// when JobOptions does not set one.
+const defaultMaxAttempts = 3
+
+// JobOptions are the optional fields of a job inserted with InsertTypedJob.
+// Zero values get defaults: MaxAttempts defaultMaxAttempts and ScheduledFor now.
+// DedupKey, if set, is the job's idempotency key (see InsertJobWithDedupKey).
+type JobOptions struct {
+	MaxAttempts  int
+	ScheduledFor time.Time
+	Recurrent    bool
+	Interval     time.Duration
+	DedupKey     string
+}
+
+// InsertTypedJob marshals payload to JSON and inserts it as a job of jobType
+// with InsertJobWithDedupKey. encoding/json writes struct fields in order and
+// sorts map keys, so equal payloads marshal to equal JSON and the unique
+// constraint on payload holds.
+func InsertTypedJob[T any](d *Db, jobType string, payload T, opts JobOptions) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload for job type %s: %w", jobType, err)
+	}
+
+	job := db.Job{
+		JobType:      jobType,
+		Payload:      raw,
+		MaxAttempts:  opts.MaxAttempts,
+		ScheduledFor: opts.ScheduledFor,
+		Recurrent:    opts.Recurrent,
+		Interval:     opts.Interval,
+	}
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = defaultMaxAttempts
+	}
+	if job.ScheduledFor.IsZero() {
+		job.ScheduledFor = d.clock()
+	}
+
+	return d.InsertJobWithDedupKey(job, opts.DedupKey)
+}
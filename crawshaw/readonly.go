@@ -0,0 +1,157 @@
+package crawshaw
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/caasmo/restinpieces/db"
+)
+
+// ReadOnlyDb exposes only the read methods of Db, for reporting processes or
+// read replicas that must not mutate the database. Pair it with a pool opened
+// read-only (SQLITE_OPEN_READONLY) to also enforce it at the engine level.
+type ReadOnlyDb struct {
+	d *Db
+}
+
+// NewReadOnly creates a ReadOnlyDb using an existing pool provided by the user.
+// The lifecycle of the pool is managed externally.
+func NewReadOnly(pool *sqlitex.Pool) (*ReadOnlyDb, error) {
+	d, err := New(pool)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadOnlyDb{d: d}, nil
+}
+
+// GetUserByEmail see Db.GetUserByEmail.
+func (r *ReadOnlyDb) GetUserByEmail(email string) (*db.User, error) {
+	return r.d.GetUserByEmail(email)
+}
+
+// GetUserById see Db.GetUserById.
+func (r *ReadOnlyDb) GetUserById(id string) (*db.User, error) {
+	return r.d.GetUserById(id)
+}
+
+// GetUserByEmailPasswordAuth see Db.GetUserByEmailPasswordAuth.
+func (r *ReadOnlyDb) GetUserByEmailPasswordAuth(email string) (*db.User, error) {
+	return r.d.GetUserByEmailPasswordAuth(email)
+}
+
+// GetUserByEmailOauth2 see Db.GetUserByEmailOauth2.
+func (r *ReadOnlyDb) GetUserByEmailOauth2(email string) (*db.User, error) {
+	return r.d.GetUserByEmailOauth2(email)
+}
+
+// ListUsersCreatedBetween see Db.ListUsersCreatedBetween.
+func (r *ReadOnlyDb) ListUsersCreatedBetween(start, end time.Time, limit, offset int) ([]*db.User, error) {
+	return r.d.ListUsersCreatedBetween(start, end, limit, offset)
+}
+
+// ListInactiveUsers see Db.ListInactiveUsers.
+func (r *ReadOnlyDb) ListInactiveUsers(since time.Time, limit, offset int) ([]*db.User, error) {
+	return r.d.ListInactiveUsers(since, limit, offset)
+}
+
+// LastLoginAt see Db.LastLoginAt.
+func (r *ReadOnlyDb) LastLoginAt(userId string) (time.Time, error) {
+	return r.d.LastLoginAt(userId)
+}
+
+// FindDuplicateEmails see Db.FindDuplicateEmails.
+func (r *ReadOnlyDb) FindDuplicateEmails() ([]string, error) {
+	return r.d.FindDuplicateEmails()
+}
+
+// AuthMethodStats see Db.AuthMethodStats.
+func (r *ReadOnlyDb) AuthMethodStats() (passwordOnly, oauth2Only, both int64, err error) {
+	return r.d.AuthMethodStats()
+}
+
+// UserVerificationCounts see Db.UserVerificationCounts.
+func (r *ReadOnlyDb) UserVerificationCounts() (verified, unverified int64, err error) {
+	return r.d.UserVerificationCounts()
+}
+
+// LatestConfig see Db.LatestConfig.
+func (r *ReadOnlyDb) LatestConfig(scope string) ([]byte, error) {
+	return r.d.LatestConfig(scope)
+}
+
+// DiffConfig see Db.DiffConfig.
+func (r *ReadOnlyDb) DiffConfig(scope string, idA, idB int64) (a, b []byte, equal bool, err error) {
+	return r.d.DiffConfig(scope, idA, idB)
+}
+
+// LatestConfigStream see Db.LatestConfigStream.
+func (r *ReadOnlyDb) LatestConfigStream(scope string, w io.Writer) (int64, error) {
+	return r.d.LatestConfigStream(scope, w)
+}
+
+// ListAllConfigChanges see Db.ListAllConfigChanges.
+func (r *ReadOnlyDb) ListAllConfigChanges(limit, offset int) ([]ConfigVersion, error) {
+	return r.d.ListAllConfigChanges(limit, offset)
+}
+
+// ExportLatestConfigs see Db.ExportLatestConfigs.
+func (r *ReadOnlyDb) ExportLatestConfigs(w io.Writer) error {
+	return r.d.ExportLatestConfigs(w)
+}
+
+// GetJobByPayload see Db.GetJobByPayload.
+func (r *ReadOnlyDb) GetJobByPayload(jobType string, payload json.RawMessage) (*db.Job, error) {
+	return r.d.GetJobByPayload(jobType, payload)
+}
+
+// CountJobsByType see Db.CountJobsByType.
+func (r *ReadOnlyDb) CountJobsByType() (map[string]int64, error) {
+	return r.d.CountJobsByType()
+}
+
+// RecentFailures see Db.RecentFailures.
+func (r *ReadOnlyDb) RecentFailures(limit int) ([]*db.Job, error) {
+	return r.d.RecentFailures(limit)
+}
+
+// GetJobsLockedBy see Db.GetJobsLockedBy.
+func (r *ReadOnlyDb) GetJobsLockedBy(workerID string) ([]*db.Job, error) {
+	return r.d.GetJobsLockedBy(workerID)
+}
+
+// GetJobsByPayloadField see Db.GetJobsByPayloadField.
+func (r *ReadOnlyDb) GetJobsByPayloadField(field, value string, limit int) ([]*db.Job, error) {
+	return r.d.GetJobsByPayloadField(field, value, limit)
+}
+
+// ClaimableCount see Db.ClaimableCount.
+func (r *ReadOnlyDb) ClaimableCount() (int64, error) {
+	return r.d.ClaimableCount()
+}
+
+// CountJobsByErrorLike see Db.CountJobsByErrorLike.
+func (r *ReadOnlyDb) CountJobsByErrorLike(pattern string) (int64, error) {
+	return r.d.CountJobsByErrorLike(pattern)
+}
+
+// DistinctJobTypes see Db.DistinctJobTypes.
+func (r *ReadOnlyDb) DistinctJobTypes() ([]string, error) {
+	return r.d.DistinctJobTypes()
+}
+
+// JobResult see Db.JobResult.
+func (r *ReadOnlyDb) JobResult(jobID int64) (json.RawMessage, error) {
+	return r.d.JobResult(jobID)
+}
+
+// LockExpiresAt see Db.LockExpiresAt.
+func (r *ReadOnlyDb) LockExpiresAt(jobID int64) (time.Time, error) {
+	return r.d.LockExpiresAt(jobID)
+}
+
+// ExportJobsCSV see Db.ExportJobsCSV.
+func (r *ReadOnlyDb) ExportJobsCSV(w io.Writer, status string, limit int) error {
+	return r.d.ExportJobsCSV(w, status, limit)
+}
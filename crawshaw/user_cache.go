@@ -0,0 +1,101 @@
+package crawshaw
+
+import (
+	"time"
+
+	"github.com/caasmo/restinpieces/db"
+)
+
+// maxUserCacheEntries bounds the memory used by the user cache.
+const maxUserCacheEntries = 10000
+
+// userCacheEntry is a cached user and the time it expires.
+type userCacheEntry struct {
+	user    db.User
+	expires time.Time
+}
+
+// EnableUserCache makes GetUserById keep the users it reads in memory for
+// ttl, so handlers resolving the same id many times per request do not query
+// the database each time. Entries are invalidated by the user writes of this
+// Db; changes made by other processes or Db instances are seen once the
+// entry expires, so keep ttl short. At most maxUserCacheEntries users are
+// kept. The cache is disabled by default.
+func (d *Db) EnableUserCache(ttl time.Duration) {
+	d.userMu.Lock()
+	defer d.userMu.Unlock()
+
+	d.userTTL = ttl
+	if d.userCache == nil {
+		d.userCache = make(map[string]userCacheEntry)
+	}
+}
+
+// cachedUser returns a copy of the cached user with id, if any and not
+// expired, and the cache generation to pass to storeUser after a miss.
+func (d *Db) cachedUser(id string) (*db.User, uint64, bool) {
+	d.userMu.RLock()
+	defer d.userMu.RUnlock()
+
+	entry, ok := d.userCache[id]
+	if !ok || !d.clock().Before(entry.expires) {
+		return nil, d.userGen, false
+	}
+	user := entry.user
+	return &user, d.userGen, true
+}
+
+// storeUser caches a copy of user read at generation gen. It is dropped if
+// an invalidation happened since, as the read may be stale. When the cache
+// is full, expired entries are evicted first, then arbitrary ones.
+func (d *Db) storeUser(user *db.User, gen uint64) {
+	d.userMu.Lock()
+	defer d.userMu.Unlock()
+
+	if d.userCache == nil || d.userGen != gen {
+		return
+	}
+
+	now := d.clock()
+	if len(d.userCache) >= maxUserCacheEntries {
+		for id, entry := range d.userCache {
+			if !now.Before(entry.expires) {
+				delete(d.userCache, id)
+			}
+		}
+	}
+	for id := range d.userCache {
+		if len(d.userCache) < maxUserCacheEntries {
+			break
+		}
+		delete(d.userCache, id)
+	}
+	d.userCache[user.ID] = userCacheEntry{user: *user, expires: now.Add(d.userTTL)}
+}
+
+// invalidateUsers drops the cached users with the given ids.
+func (d *Db) invalidateUsers(ids ...string) {
+	d.userMu.Lock()
+	defer d.userMu.Unlock()
+
+	if d.userCache == nil {
+		return
+	}
+	for _, id := range ids {
+		delete(d.userCache, id)
+	}
+	d.userGen++
+}
+
+// invalidateAllUsers empties the user cache, after a write touching users
+// not known by id.
+func (d *Db) invalidateAllUsers() {
+	d.userMu.Lock()
+	defer d.userMu.Unlock()
+
+	if d.userCache == nil {
+		return
+	}
+	clear(d.userCache)
+	d.userGen++
+}
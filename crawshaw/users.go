@@ -3,8 +3,12 @@ package crawshaw
 import (
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"errors"
 	"fmt"
 	"github.com/caasmo/restinpieces/db"
+	"slices"
+	"strings"
+	"time"
 )
 
 // newUserFromStmt creates a User struct from a SQLite statement
@@ -33,20 +37,144 @@ func newUserFromStmt(stmt *sqlite.Stmt) (*db.User, error) {
 	}, nil
 }
 
-// GetUserByEmail retrieves a user by email address.
+// singleUserRow returns a result func storing the user of a statement
+// expected to return at most one row, such as an INSERT ... RETURNING. A
+// second row means a schema or constraint bug and fails the statement
+// instead of silently keeping the last row.
+func singleUserRow(dst **db.User) func(stmt *sqlite.Stmt) error {
+	return func(stmt *sqlite.Stmt) error {
+		if *dst != nil {
+			return fmt.Errorf("expected a single user row, got more")
+		}
+		user, err := newUserFromStmt(stmt)
+		if err != nil {
+			return err
+		}
+		*dst = user
+		return nil
+	}
+}
+
+// GetUserByEmail retrieves a user by email address, ignoring case and
+// surrounding whitespace. The lookup uses the indexed email_normalized column
+// added by Migrate, and falls back to a table scan on databases not migrated.
+// Of users whose emails differ only in case, the oldest is returned.
 // Returns:
 // - *db.User: User record if found, nil if no matching record exists
 // - returned time Fields are in UTC, RFC3339
 // - error: Only returned for database errors, nil on successful query (even if no results)
 // Note: A nil user with nil error indicates no matching record was found
 func (d *Db) GetUserByEmail(email string) (*db.User, error) {
-	conn := d.pool.Get(nil)
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for get user by email: %w", d.connErr())
+	}
 	defer d.pool.Put(conn)
 
+	user, err := d.userByEmail(conn, email)
+	d.metrics.observe("GetUserByEmail", opRead, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUserByEmailPasswordAuth returns the user with the given email only if it
+// can log in with a password. Like GetUserByEmail it returns a nil user and
+// nil error when there is no such user.
+func (d *Db) GetUserByEmailPasswordAuth(email string) (*db.User, error) {
+	user, err := d.userByEmailFiltered(email)
+	if err != nil || user == nil || user.Password == "" {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUserByEmailOauth2 returns the user with the given email only if it has
+// oauth2 enabled. Like GetUserByEmail it returns a nil user and nil error
+// when there is no such user.
+func (d *Db) GetUserByEmailOauth2(email string) (*db.User, error) {
+	user, err := d.userByEmailFiltered(email)
+	if err != nil || user == nil || !user.Oauth2 {
+		return nil, err
+	}
+	return user, nil
+}
+
+// userByEmailFiltered loads a user by email on a pooled connection for the
+// auth method specific lookups.
+func (d *Db) userByEmailFiltered(email string) (*db.User, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for get user by email: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	return d.userByEmail(conn, email)
+}
+
+// userByEmailSQL selects a user by email through idx_users_email_normalized.
+// The index is not unique: the schema only rejects exact duplicates, so case
+// variants of an email may be different users and the oldest one is picked.
+const userByEmailSQL = `SELECT id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated
+		FROM users WHERE email_normalized = lower(trim(?, ' ' || char(9, 10, 13)))
+		ORDER BY created, id LIMIT 1`
+
+// userByEmailScanSQL is userByEmailSQL for databases without the
+// email_normalized column, normalizing every email of the table.
+const userByEmailScanSQL = `SELECT id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated
+		FROM users WHERE lower(trim(email, ' ' || char(9, 10, 13))) = lower(trim(?, ' ' || char(9, 10, 13)))
+		ORDER BY created, id LIMIT 1`
+
+// userByExactEmailSQL selects a user by the email as stored, the column of the
+// schema's case sensitive unique constraint and the upserts' conflict target.
+const userByExactEmailSQL = `SELECT id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated
+		FROM users WHERE email = ?`
+
+// userByEmail runs the GetUserByEmail query on the given connection.
+func (d *Db) userByEmail(conn *sqlite.Conn, email string) (*db.User, error) {
+	migrated, err := d.hasEmailNormalized(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !migrated {
+		return d.selectUser(conn, userByEmailScanSQL, email)
+	}
+	return d.selectUser(conn, userByEmailSQL, email)
+}
+
+// hasEmailNormalized reports whether the users table has the email_normalized
+// column of schema migration 1. The answer is cached until the next Migrate.
+func (d *Db) hasEmailNormalized(conn *sqlite.Conn) (bool, error) {
+	switch d.emailNormalized.Load() {
+	case columnPresent:
+		return true, nil
+	case columnMissing:
+		return false, nil
+	}
+
+	found := false
+	err := d.exec(conn, `SELECT 1 FROM pragma_table_xinfo('users') WHERE name = 'email_normalized'`,
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			return nil
+		})
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect users table: %w", err)
+	}
+	if found {
+		d.emailNormalized.Store(columnPresent)
+	} else {
+		d.emailNormalized.Store(columnMissing)
+	}
+	return found, nil
+}
+
+// selectUser runs a query selecting at most one user by email.
+func (d *Db) selectUser(conn *sqlite.Conn, query string, email string) (*db.User, error) {
 	var user *db.User // Will remain nil if no rows found
-	err := sqlitex.Exec(conn,
-		`SELECT id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated
-		FROM users WHERE email = ? LIMIT 1`,
+	err := d.exec(conn, query,
 		func(stmt *sqlite.Stmt) error {
 
 			var err error
@@ -64,6 +192,27 @@ func (d *Db) GetUserByEmail(email string) (*db.User, error) {
 	return user, nil
 }
 
+// upsertedUser returns the user produced by an upsert's RETURNING clause.
+// RETURNING yields no row when the conflict update is skipped (e.g. by a
+// trigger, or on some SQLite versions), in which case the user is re-selected
+// by email so the upsert never returns a nil user with a nil error. The
+// re-select matches the email exactly, like the conflict target of the
+// upserts, so it finds the row the upsert conflicted with.
+func (d *Db) upsertedUser(conn *sqlite.Conn, returned *db.User, email string) (*db.User, error) {
+	if returned != nil {
+		return returned, nil
+	}
+
+	user, err := d.selectUser(conn, userByExactEmailSQL, email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user with email %s not found after upsert", email)
+	}
+	return user, nil
+}
+
 // validateUserFields checks that required user fields are present
 // Returns:
 // - *db.User: User record if found, nil if no matching record exists
@@ -71,30 +220,224 @@ func (d *Db) GetUserByEmail(email string) (*db.User, error) {
 // - error: Only returned for database errors, nil on successful query (even if no results)
 // Note: A nil user with nil error indicates no matching record was found
 func (d *Db) VerifyEmail(userId string) error {
-	conn := d.pool.Get(nil)
-	defer d.pool.Put(conn)
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for verify email: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+	defer d.invalidateUsers(userId)
 
-	err := sqlitex.Exec(conn,
+	err := d.exec(conn,
 		`UPDATE users 
 		SET verified = true,
-			updated = strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+			updated = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
 		WHERE id = ?`,
 		nil,
+		d.sqlNow(),
 		userId,
 	)
 
+	d.metrics.observe("VerifyEmail", opWrite, err)
 	if err != nil {
 		return fmt.Errorf("failed to verify email: %w", err)
 	}
 	return nil
 }
 
+// verifyEmailsBatchSize is the number of ids per statement of VerifyEmails,
+// well below SQLITE_MAX_VARIABLE_NUMBER.
+const verifyEmailsBatchSize = 500
+
+// VerifyEmails marks all users with the given ids as verified in one
+// transaction and returns how many users matched. The ids are updated in
+// batches of verifyEmailsBatchSize, so the list has no size limit. An empty
+// slice is a no-op.
+func (d *Db) VerifyEmails(userIDs []string) (int64, error) {
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for verify emails: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+	defer d.invalidateUsers(userIDs...)
+
+	// A repeated id would be counted once per batch it is in.
+	ids := slices.Compact(slices.Sorted(slices.Values(userIDs)))
+	now := d.sqlNow()
+
+	err := d.exec(conn, "BEGIN IMMEDIATE;", nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for verify emails: %w", err)
+	}
+
+	var verified int64
+	for batch := range slices.Chunk(ids, verifyEmailsBatchSize) {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		args := make([]any, 0, len(batch)+1)
+		args = append(args, now)
+		for _, id := range batch {
+			args = append(args, id)
+		}
+
+		err = d.exec(conn,
+			`UPDATE users 
+			SET verified = true,
+				updated = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+			WHERE id IN (`+placeholders+`)`,
+			nil,
+			args...,
+		)
+		if err != nil {
+			_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+			return 0, fmt.Errorf("failed to verify emails: %w", err)
+		}
+		verified += int64(conn.Changes())
+	}
+
+	err = d.exec(conn, "COMMIT;", nil)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return 0, fmt.Errorf("failed to commit transaction for verify emails: %w", err)
+	}
+	return verified, nil
+}
+
+// RewriteAvatarPrefix replaces oldPrefix with newPrefix in the avatar of every
+// user whose avatar starts with oldPrefix, e.g. after moving avatars to a new
+// CDN, and returns how many users changed. The prefix is compared literally,
+// not as a LIKE pattern. An empty oldPrefix is rejected.
+func (d *Db) RewriteAvatarPrefix(oldPrefix, newPrefix string) (int64, error) {
+	if oldPrefix == "" {
+		return 0, fmt.Errorf("old avatar prefix cannot be empty")
+	}
+
+	conn := d.getWriteConn()
+	if conn == nil {
+		return 0, fmt.Errorf("failed to get db connection for rewrite avatar prefix: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+	defer d.invalidateAllUsers()
+
+	err := d.exec(conn,
+		`UPDATE users
+		SET avatar = ? || substr(avatar, length(?) + 1),
+			updated = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE substr(avatar, 1, length(?)) = ?`,
+		nil,
+		newPrefix,
+		oldPrefix,
+		d.sqlNow(),
+		oldPrefix,
+		oldPrefix,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to rewrite avatar prefix: %w", err)
+	}
+	return int64(conn.Changes()), nil
+}
+
+// AuthMethodStats returns the number of users that can authenticate with a
+// password only, with oauth2 only, and with both. Users with neither are not
+// counted.
+func (d *Db) AuthMethodStats() (passwordOnly, oauth2Only, both int64, err error) {
+	conn := d.getConn()
+	if conn == nil {
+		return 0, 0, 0, fmt.Errorf("failed to get db connection for auth method stats: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	err = d.exec(conn,
+		`SELECT
+			COUNT(CASE WHEN password != '' AND NOT oauth2 THEN 1 END) AS password_only,
+			COUNT(CASE WHEN password = '' AND oauth2 THEN 1 END) AS oauth2_only,
+			COUNT(CASE WHEN password != '' AND oauth2 THEN 1 END) AS both_methods
+		FROM users`,
+		func(stmt *sqlite.Stmt) error {
+			passwordOnly = stmt.GetInt64("password_only")
+			oauth2Only = stmt.GetInt64("oauth2_only")
+			both = stmt.GetInt64("both_methods")
+			return nil
+		})
+
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to get auth method stats: %w", err)
+	}
+	return passwordOnly, oauth2Only, both, nil
+}
+
+// UserVerificationCounts returns the number of verified and unverified users
+// in a single query, e.g. for a signup funnel metric.
+func (d *Db) UserVerificationCounts() (verified, unverified int64, err error) {
+	conn := d.getConn()
+	if conn == nil {
+		return 0, 0, fmt.Errorf("failed to get db connection for user verification counts: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	err = d.exec(conn,
+		`SELECT
+			COUNT(CASE WHEN verified THEN 1 END) AS verified,
+			COUNT(CASE WHEN NOT verified THEN 1 END) AS unverified
+		FROM users`,
+		func(stmt *sqlite.Stmt) error {
+			verified = stmt.GetInt64("verified")
+			unverified = stmt.GetInt64("unverified")
+			return nil
+		})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get user verification counts: %w", err)
+	}
+	return verified, unverified, nil
+}
+
+// FindDuplicateEmails returns, sorted, the normalized emails shared by more
+// than one user. Users are expected to be unique per email, as the create
+// methods upsert on it, but the unique constraint of the schema is case
+// sensitive and may be missing from older databases; this backs integrity
+// audits. Returns an empty slice when there are no duplicates.
+func (d *Db) FindDuplicateEmails() ([]string, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for find duplicate emails: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	emails := []string{}
+	err := d.exec(conn,
+		`SELECT lower(trim(email, ' ' || char(9, 10, 13))) AS normalized FROM users
+		GROUP BY normalized
+		HAVING COUNT(*) > 1
+		ORDER BY normalized`,
+		func(stmt *sqlite.Stmt) error {
+			emails = append(emails, stmt.ColumnText(0))
+			return nil
+		})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to find duplicate emails: %w", err)
+	}
+	return emails, nil
+}
+
 func (d *Db) GetUserById(id string) (*db.User, error) {
-	conn := d.pool.Get(nil)
+	cached, gen, ok := d.cachedUser(id)
+	if ok {
+		d.metrics.observe("GetUserById", opRead, nil)
+		return cached, nil
+	}
+
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for get user by id: %w", d.connErr())
+	}
 	defer d.pool.Put(conn)
 
 	var user *db.User // Will remain nil if no rows found
-	err := sqlitex.Exec(conn,
+	err := d.exec(conn,
 		`SELECT id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated
 		FROM users WHERE id = ? LIMIT 1`,
 		func(stmt *sqlite.Stmt) error {
@@ -107,32 +450,76 @@ func (d *Db) GetUserById(id string) (*db.User, error) {
 			return nil
 		}, id)
 
+	d.metrics.observe("GetUserById", opRead, err)
 	if err != nil {
 		return nil, err
 	}
 
+	if user != nil {
+		d.storeUser(user, gen)
+	}
 	return user, nil
 }
 
+// ListUsersCreatedBetween returns the users created in [start, end), oldest
+// first, e.g. for cohort analysis. The pagination arguments are clamped by
+// normalizeLimitOffset. Returns an empty slice when no user matches.
+func (d *Db) ListUsersCreatedBetween(start, end time.Time, limit, offset int) ([]*db.User, error) {
+	limit, offset = normalizeLimitOffset(limit, offset)
+
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for list users created between: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	users := []*db.User{}
+	err := d.exec(conn,
+		`SELECT id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated
+		FROM users
+		WHERE created >= ? AND created < ?
+		ORDER BY created ASC, id ASC
+		LIMIT ? OFFSET ?`,
+		func(stmt *sqlite.Stmt) error {
+			user, err := newUserFromStmt(stmt)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		},
+		db.TimeFormat(start),
+		db.TimeFormat(end),
+		limit,
+		offset,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users created between %s and %s: %w", db.TimeFormat(start), db.TimeFormat(end), err)
+	}
+	return users, nil
+}
+
 // writing os two consecutive writes with two different password will succeed but the password will be not written.
 // its responsability of the caller to check if interested.
 func (d *Db) CreateUserWithPassword(user db.User) (*db.User, error) {
-	conn := d.pool.Get(nil)
-	defer d.pool.Put(conn)
+	conn := d.getWriteConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for create user with password: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
 
 	var createdUser *db.User
-	err := sqlitex.Exec(conn,
-		`INSERT INTO users (name, password, verified, oauth2, avatar, email, emailVisibility) 
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+	err := d.exec(conn,
+		`INSERT INTO users (name, password, verified, oauth2, avatar, email, emailVisibility, created, updated) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, strftime('%Y-%m-%dT%H:%M:%SZ', ?), strftime('%Y-%m-%dT%H:%M:%SZ', ?))
 		ON CONFLICT(email) DO UPDATE SET 
 			password = IIF(password = '', excluded.password, password),
-			updated = (strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+			updated = excluded.updated
 		RETURNING id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated`,
-		func(stmt *sqlite.Stmt) error {
-			var err error
-			createdUser, err = newUserFromStmt(stmt)
-			return err
-		},
+		singleUserRow(&createdUser),
 		user.Name,            // 1. name
 		user.Password,        // 2. password
 		user.Verified,        // 3. verified
@@ -140,12 +527,60 @@ func (d *Db) CreateUserWithPassword(user db.User) (*db.User, error) {
 		user.Avatar,          // 5. avatar
 		user.Email,           // 6. email
 		user.EmailVisibility, // 7. emailVisibility
+		now,                  // 8. created
+		now,                  // 9. updated
 	)
 
+	d.metrics.observe("CreateUserWithPassword", opWrite, err)
 	if err != nil {
 		return nil, err
 	}
 
+	createdUser, err = d.upsertedUser(conn, createdUser, user.Email)
+	if err != nil {
+		return nil, err
+	}
+	d.invalidateUsers(createdUser.ID)
+	return createdUser, nil
+}
+
+// RegisterNewUserWithPassword is a strict CreateUserWithPassword for flows
+// that must only create new users: it returns db.ErrConstraintUnique when the
+// email is taken, instead of returning the existing user. The conflict is
+// decided by the unique constraint on email.
+func (d *Db) RegisterNewUserWithPassword(user db.User) (*db.User, error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for register new user with password: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
+
+	var createdUser *db.User
+	err := d.exec(conn,
+		`INSERT INTO users (name, password, verified, oauth2, avatar, email, emailVisibility, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, strftime('%Y-%m-%dT%H:%M:%SZ', ?), strftime('%Y-%m-%dT%H:%M:%SZ', ?))
+		ON CONFLICT(email) DO NOTHING
+		RETURNING id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated`,
+		singleUserRow(&createdUser),
+		user.Name,
+		user.Password,
+		user.Verified,
+		false,
+		user.Avatar,
+		user.Email,
+		user.EmailVisibility,
+		now,
+		now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register user: %w", err)
+	}
+	if createdUser == nil {
+		return nil, db.ErrConstraintUnique
+	}
+
 	return createdUser, nil
 }
 
@@ -154,22 +589,53 @@ func (d *Db) CreateUserWithPassword(user db.User) (*db.User, error) {
 // - OAuth2 registration updates OAuth-specific fields
 // The resulting user will have both authentication methods properly set up without either one completely overwriting the other.
 func (d *Db) CreateUserWithOauth2(user db.User) (*db.User, error) {
-	conn := d.pool.Get(nil)
-	defer d.pool.Put(conn)
+	createdUser, _, err := d.UpsertUserWithOauth2(user)
+	d.metrics.observe("CreateUserWithOauth2", opWrite, err)
+	return createdUser, err
+}
+
+// UpsertUserWithOauth2 is CreateUserWithOauth2 also reporting whether a new
+// user was created, as opposed to oauth2 being added to an existing one.
+// With WithOauth2ProfileBackfill, an existing user with an empty name or
+// avatar gets the ones provided. With Oauth2FailIfExists, an existing user
+// without oauth2 makes it return db.ErrConstraintUnique.
+func (d *Db) UpsertUserWithOauth2(user db.User) (*db.User, bool, error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return nil, false, fmt.Errorf("failed to get db connection for create user with oauth2: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	now := d.sqlNow()
+
+	// IMMEDIATE so the existence check and the upsert see the same row.
+	err := d.exec(conn, "BEGIN IMMEDIATE;", nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction for create user with oauth2: %w", err)
+	}
+
+	// Match the email exactly, like the conflict target of the upsert.
+	existing, err := d.selectUser(conn, userByExactEmailSQL, user.Email)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return nil, false, err
+	}
+	if existing != nil && !existing.Oauth2 && d.oauth2Conflict == Oauth2FailIfExists {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return nil, false, db.ErrConstraintUnique
+	}
 
 	var createdUser *db.User
-	err := sqlitex.Exec(conn,
-		`INSERT INTO users (name, password, verified, oauth2, avatar, email, emailVisibility) 
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+	err = d.exec(conn,
+		`INSERT INTO users (name, password, verified, oauth2, avatar, email, emailVisibility, created, updated) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, strftime('%Y-%m-%dT%H:%M:%SZ', ?), strftime('%Y-%m-%dT%H:%M:%SZ', ?))
 		ON CONFLICT(email) DO UPDATE SET 
 			oauth2 = true,
-			updated = (strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+			name = IIF(? AND name = '', excluded.name, name),
+			avatar = IIF(? AND avatar = '', excluded.avatar, avatar),
+			updated = excluded.updated
 		RETURNING id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated`,
-		func(stmt *sqlite.Stmt) error {
-			var err error
-			createdUser, err = newUserFromStmt(stmt)
-			return err
-		},
+		singleUserRow(&createdUser),
 		user.Name,            // 1. name
 		"",                   // 2. password
 		user.Verified,        // 3. verified, shoudl be true TODO
@@ -177,28 +643,50 @@ func (d *Db) CreateUserWithOauth2(user db.User) (*db.User, error) {
 		user.Avatar,          // 5. avatar
 		user.Email,           // 6. email
 		user.EmailVisibility, // 7. emailVisibility
+		now,                  // 8. created
+		now,                  // 9. updated
+		d.oauth2Backfill,     // 10. backfill name
+		d.oauth2Backfill,     // 11. backfill avatar
 	)
 
 	if err != nil {
-		return nil, err
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return nil, false, err
 	}
 
-	return createdUser, nil
+	err = d.exec(conn, "COMMIT;", nil)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return nil, false, fmt.Errorf("failed to commit transaction for create user with oauth2: %w", err)
+	}
+
+	createdUser, err = d.upsertedUser(conn, createdUser, user.Email)
+	if err != nil {
+		return nil, false, err
+	}
+	d.invalidateUsers(createdUser.ID)
+	return createdUser, existing == nil, nil
 }
 
 func (d *Db) UpdatePassword(userId string, newPassword string) error {
-	conn := d.pool.Get(nil)
-	defer d.pool.Put(conn)
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for update password: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+	defer d.invalidateUsers(userId)
 
 	// Update password and timestamp
-	err := sqlitex.Exec(conn,
+	err := d.exec(conn,
 		`UPDATE users 
 		SET password = ?,
-			updated = (strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+			updated = (strftime('%Y-%m-%dT%H:%M:%SZ', ?))
 		WHERE id = ?`,
 		nil,
 		newPassword,
+		d.sqlNow(),
 		userId)
+	d.metrics.observe("UpdatePassword", opWrite, err)
 	if err != nil {
 		return fmt.Errorf("failed to update password: %w", err)
 	}
@@ -206,22 +694,258 @@ func (d *Db) UpdatePassword(userId string, newPassword string) error {
 	return nil
 }
 
+// ErrNoAuthMethod is returned by ClearPassword for a user without oauth2,
+// who would be left with no way to authenticate.
+var ErrNoAuthMethod = errors.New("user would be left without an auth method")
+
+// ClearPassword removes the password of a user who keeps oauth2 as the only
+// auth method, e.g. after unlinking the password. Returns ErrNoAuthMethod if
+// the user has no oauth2, and ErrNotFound if the user does not exist.
+func (d *Db) ClearPassword(userId string) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for clear password: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+	defer d.invalidateUsers(userId)
+
+	err := d.exec(conn,
+		`UPDATE users
+		SET password = '',
+			updated = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE id = ? AND oauth2`,
+		nil,
+		d.sqlNow(),
+		userId)
+	if err != nil {
+		return fmt.Errorf("failed to clear password: %w", err)
+	}
+	if conn.Changes() > 0 {
+		return nil
+	}
+
+	exists := false
+	err = d.exec(conn, `SELECT 1 FROM users WHERE id = ?`,
+		func(stmt *sqlite.Stmt) error {
+			exists = true
+			return nil
+		}, userId)
+	if err != nil {
+		return fmt.Errorf("failed to clear password: %w", err)
+	}
+	if exists {
+		return ErrNoAuthMethod
+	}
+	return ErrNotFound
+}
+
 func (d *Db) UpdateEmail(userId string, newEmail string) error {
-	conn := d.pool.Get(nil)
-	defer d.pool.Put(conn)
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for update email: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+	defer d.invalidateUsers(userId)
 
 	// Update email and timestamp
-	err := sqlitex.Exec(conn,
+	err := d.exec(conn,
 		`UPDATE users 
 		SET email = ?,
-			updated = (strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+			updated = (strftime('%Y-%m-%dT%H:%M:%SZ', ?))
 		WHERE id = ?`,
 		nil,
 		newEmail,
+		d.sqlNow(),
 		userId)
+	d.metrics.observe("UpdateEmail", opWrite, err)
 	if err != nil {
 		return fmt.Errorf("failed to update email: %w", err)
 	}
 
 	return nil
 }
+
+// ChangeEmail sets the email of a user and resets its verified flag, in one
+// transaction. Unlike UpdateEmail it first checks, ignoring case and
+// surrounding whitespace, that newEmail does not belong to another user and
+// returns db.ErrConstraintUnique if it does. Returns ErrNotFound if the user
+// does not exist.
+func (d *Db) ChangeEmail(userId, newEmail string) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for change email: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+	defer d.invalidateUsers(userId)
+
+	if err := d.exec(conn, "BEGIN IMMEDIATE;", nil); err != nil {
+		return fmt.Errorf("failed to begin transaction for change email: %w", err)
+	}
+
+	owner, err := d.userByEmail(conn, newEmail)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return fmt.Errorf("failed to check email owner: %w", err)
+	}
+	if owner != nil && owner.ID != userId {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return db.ErrConstraintUnique
+	}
+
+	err = d.exec(conn,
+		`UPDATE users
+		SET email = ?,
+			verified = false,
+			updated = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE id = ?`,
+		nil,
+		newEmail,
+		d.sqlNow(),
+		userId)
+	if err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return fmt.Errorf("failed to change email: %w", err)
+	}
+	if conn.Changes() == 0 {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return ErrNotFound
+	}
+
+	if err := d.exec(conn, "COMMIT;", nil); err != nil {
+		_ = sqlitex.Exec(conn, "ROLLBACK;", nil)
+		return fmt.Errorf("failed to commit transaction for change email: %w", err)
+	}
+	return nil
+}
+
+// UpdatePasswordIfMatches updates the password only if the currently stored hash
+// equals expectedHash, an optimistic-concurrency guard for password rotation.
+// Returns true if the password was changed, false if the stored hash did not
+// match (or the user does not exist).
+func (d *Db) UpdatePasswordIfMatches(userId, expectedHash, newHash string) (bool, error) {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return false, fmt.Errorf("failed to get db connection for update password if matches: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+	defer d.invalidateUsers(userId)
+
+	err := d.exec(conn,
+		`UPDATE users 
+		SET password = ?,
+			updated = (strftime('%Y-%m-%dT%H:%M:%SZ', ?))
+		WHERE id = ? AND password = ?`,
+		nil,
+		newHash,
+		d.sqlNow(),
+		userId,
+		expectedHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	return conn.Changes() > 0, nil
+}
+
+// RecordLogin stores at as the time the user last authenticated. It does not
+// touch updated, as a login is not a change of the user. Returns ErrNotFound
+// if the user does not exist.
+func (d *Db) RecordLogin(userId string, at time.Time) error {
+	conn := d.getWriteConn()
+	if conn == nil {
+		return fmt.Errorf("failed to get db connection for record login: %w", d.connErr())
+	}
+	defer d.putWriteConn(conn)
+
+	err := d.exec(conn,
+		`UPDATE users
+		SET last_login_at = strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		WHERE id = ?`,
+		nil,
+		db.TimeFormat(at),
+		userId)
+	if err != nil {
+		return fmt.Errorf("failed to record login: %w", err)
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// LastLoginAt returns the time recorded by the last RecordLogin of the user,
+// or the zero time if the user never logged in. Returns ErrNotFound if the
+// user does not exist.
+func (d *Db) LastLoginAt(userId string) (time.Time, error) {
+	conn := d.getConn()
+	if conn == nil {
+		return time.Time{}, fmt.Errorf("failed to get db connection for last login: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	var (
+		found     bool
+		lastLogin string
+	)
+	err := d.exec(conn, `SELECT COALESCE(last_login_at, '') FROM users WHERE id = ?`,
+		func(stmt *sqlite.Stmt) error {
+			found = true
+			lastLogin = stmt.ColumnText(0)
+			return nil
+		}, userId)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get last login: %w", err)
+	}
+	if !found {
+		return time.Time{}, ErrNotFound
+	}
+	if lastLogin == "" {
+		return time.Time{}, nil
+	}
+
+	at, err := db.TimeParse(lastLogin)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing last login time: %w", err)
+	}
+	return at, nil
+}
+
+// ListInactiveUsers returns the users whose last login is before since,
+// including those who never logged in, oldest login first and never logged in
+// users leading. It supports account cleanup workflows. The pagination
+// arguments are clamped by normalizeLimitOffset. Returns an empty slice when
+// no user matches.
+func (d *Db) ListInactiveUsers(since time.Time, limit, offset int) ([]*db.User, error) {
+	limit, offset = normalizeLimitOffset(limit, offset)
+
+	conn := d.getConn()
+	if conn == nil {
+		return nil, fmt.Errorf("failed to get db connection for list inactive users: %w", d.connErr())
+	}
+	defer d.pool.Put(conn)
+
+	users := []*db.User{}
+	err := d.exec(conn,
+		`SELECT id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated
+		FROM users
+		WHERE last_login_at IS NULL OR last_login_at < strftime('%Y-%m-%dT%H:%M:%SZ', ?)
+		ORDER BY last_login_at ASC, id ASC
+		LIMIT ? OFFSET ?`,
+		func(stmt *sqlite.Stmt) error {
+			user, err := newUserFromStmt(stmt)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		},
+		db.TimeFormat(since),
+		limit,
+		offset,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users inactive since %s: %w", db.TimeFormat(since), err)
+	}
+	return users, nil
+}
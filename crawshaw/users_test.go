@@ -5,9 +5,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
-	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"github.com/caasmo/restinpieces/db"
 	"github.com/caasmo/restinpieces/migrations"
@@ -30,16 +33,31 @@ type tableSchema struct {
 var tables = []tableSchema{
 	{
 		name:      "users",
-		schema:    migrations.UsersSchema,
+		schema:    mustReadSchema("users.sql"),
 		inserts:   []string{},
 		knownHash: "a8442a840a7adb04578fe2f1b3a14debd9f669a3e7cd48eda8ff365cf027398d",
 	},
 	{
 		name:      "job_queue",
-		schema:    migrations.JobQueueSchema,
+		schema:    mustReadSchema("job_queue.sql"),
 		inserts:   []string{},
-		knownHash: "422048f8b833e0882218a579e76aa2ee3b417c525ff3399a27542ed8fa796188",
+		knownHash: "d6156177278ee0076d8e3a8eb92de68da0ff7245761d756d5a52f9d71d836c2b",
 	},
+	{
+		name:      "app_config",
+		schema:    mustReadSchema("app_config.sql"),
+		inserts:   []string{},
+		knownHash: "6cac1a559686b1106923aa44396843f338629c2c2116b52d0ff2ad27e96f3bde",
+	},
+}
+
+// mustReadSchema returns the content of an embedded migration schema file.
+func mustReadSchema(name string) string {
+	b, err := fs.ReadFile(migrations.Schema(), name)
+	if err != nil {
+		panic(fmt.Sprintf("failed to read schema %s: %v", name, err))
+	}
+	return string(b)
 }
 
 // TestSchemaVersion ensures embedded schemas match known hashes.
@@ -57,7 +75,7 @@ func TestSchemaVersion(t *testing.T) {
 	}
 }
 
-func setupDB(t *testing.T) *Db {
+func setupDB(t testing.TB) *Db {
 	t.Helper()
 
 	// Using a named in-memory database with the URI format
@@ -86,6 +104,13 @@ func setupDB(t *testing.T) *Db {
 		}
 	}
 
+	// Drop the tables created by Migrate so it runs from scratch.
+	for _, name := range []string{"crawshaw_schema_migrations", "crawshaw_config_active", "crawshaw_kv"} {
+		if err := sqlitex.ExecScript(conn, fmt.Sprintf("DROP TABLE IF EXISTS %s", name)); err != nil {
+			t.Fatalf("failed to drop %s table: %v", name, err)
+		}
+	}
+
 	// Insert test data after all tables are created
 	for _, tbl := range tables {
 		for _, insertSQL := range tbl.inserts {
@@ -99,15 +124,18 @@ func setupDB(t *testing.T) *Db {
 	}
 
 	// Return DB instance with the existing pool that has our schema
-	return &Db{
+	testDB := &Db{
 		pool: pool,
-		rwCh: make(chan *sqlite.Conn, 1),
 	}
+	if err := testDB.Migrate(); err != nil {
+		t.Fatalf("failed to migrate test schema: %v", err)
+	}
+	return testDB
 }
 
 func TestGetUserByEmail(t *testing.T) {
 	testDB := setupDB(t)
-	defer testDB.Close()
+	defer testDB.pool.Close()
 
 	// Create test user first
 	testEmail := "test@example.com"
@@ -178,7 +206,7 @@ func TestGetUserByEmail(t *testing.T) {
 
 func TestCreateUserWithOauth2(t *testing.T) {
 	testDB := setupDB(t)
-	defer testDB.Close()
+	defer testDB.pool.Close()
 
 	// Base user data
 	email := "test@example.com"
@@ -308,7 +336,7 @@ func TestCreateUserWithOauth2(t *testing.T) {
 
 func TestCreateUserWithPassword(t *testing.T) {
 	testDB := setupDB(t)
-	defer testDB.Close()
+	defer testDB.pool.Close()
 
 	// Test valid user creation
 	t.Run("successful creation", func(t *testing.T) {
@@ -381,3 +409,981 @@ func TestCreateUserWithPassword(t *testing.T) {
 		}
 	})
 }
+
+func TestUpdatePasswordIfMatches(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	user, err := testDB.CreateUserWithPassword(db.User{
+		Email:    "rotate@test.com",
+		Password: "old_hash",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	t.Run("matching hash", func(t *testing.T) {
+		updated, err := testDB.UpdatePasswordIfMatches(user.ID, "old_hash", "new_hash")
+		if err != nil {
+			t.Fatalf("UpdatePasswordIfMatches failed: %v", err)
+		}
+		if !updated {
+			t.Error("expected password to be updated")
+		}
+
+		got, err := testDB.GetUserById(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if got.Password != "new_hash" {
+			t.Errorf("Password mismatch: got %q, want %q", got.Password, "new_hash")
+		}
+	})
+
+	t.Run("non-matching hash", func(t *testing.T) {
+		updated, err := testDB.UpdatePasswordIfMatches(user.ID, "old_hash", "other_hash")
+		if err != nil {
+			t.Fatalf("UpdatePasswordIfMatches failed: %v", err)
+		}
+		if updated {
+			t.Error("expected password not to be updated")
+		}
+
+		got, err := testDB.GetUserById(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if got.Password != "new_hash" {
+			t.Errorf("Password was overwritten: got %q, want %q", got.Password, "new_hash")
+		}
+	})
+}
+
+func TestCreateUserReturningNoRow(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	email := "conflict@test.com"
+	original, err := testDB.CreateUserWithPassword(db.User{Email: email, Password: "hash1"})
+	if err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	// Skip every update so the conflict path of the upsert yields no RETURNING row.
+	conn := testDB.pool.Get(nil)
+	err = sqlitex.ExecScript(conn, `CREATE TRIGGER skip_user_update BEFORE UPDATE ON users
+		BEGIN SELECT RAISE(IGNORE); END;`)
+	testDB.pool.Put(conn)
+	if err != nil {
+		t.Fatalf("failed to create trigger: %v", err)
+	}
+
+	t.Run("password", func(t *testing.T) {
+		user, err := testDB.CreateUserWithPassword(db.User{Email: email, Password: "hash2"})
+		if err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+		if user == nil {
+			t.Fatal("expected user but got nil")
+		}
+		if user.ID != original.ID {
+			t.Errorf("ID mismatch: got %q, want %q", user.ID, original.ID)
+		}
+	})
+
+	t.Run("oauth2", func(t *testing.T) {
+		user, err := testDB.CreateUserWithOauth2(db.User{Email: email, Verified: true})
+		if err != nil {
+			t.Fatalf("CreateUserWithOauth2 failed: %v", err)
+		}
+		if user == nil {
+			t.Fatal("expected user but got nil")
+		}
+		if user.ID != original.ID {
+			t.Errorf("ID mismatch: got %q, want %q", user.ID, original.ID)
+		}
+	})
+}
+
+func TestGetUserByEmailNormalized(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	created, err := testDB.CreateUserWithPassword(db.User{Email: "Mixed.Case@Example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	for _, email := range []string{
+		"Mixed.Case@Example.com",
+		"mixed.case@example.com",
+		"MIXED.CASE@EXAMPLE.COM",
+		"  mixed.case@example.com\t",
+	} {
+		t.Run(email, func(t *testing.T) {
+			user, err := testDB.GetUserByEmail(email)
+			if err != nil {
+				t.Fatalf("GetUserByEmail failed: %v", err)
+			}
+			if user == nil {
+				t.Fatal("expected user but got nil")
+			}
+			if user.ID != created.ID {
+				t.Errorf("ID mismatch: got %q, want %q", user.ID, created.ID)
+			}
+		})
+	}
+}
+
+func TestEmailCaseVariants(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+
+	older, err := testDB.CreateUserWithPassword(db.User{Email: "Mixed.Case@Example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+
+	// The schema's unique constraint is case sensitive: a case variant is a
+	// different user, and the oauth2 upsert reports it as created.
+	clock = clock.Add(time.Second)
+	newer, created, err := testDB.UpsertUserWithOauth2(db.User{Email: "mixed.case@example.com", Oauth2: true})
+	if err != nil {
+		t.Fatalf("UpsertUserWithOauth2 failed: %v", err)
+	}
+	if !created || newer.ID == older.ID {
+		t.Errorf("expected a new user, got created %v and user %q", created, newer.ID)
+	}
+
+	got, err := testDB.GetUserByEmail(" MIXED.case@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail failed: %v", err)
+	}
+	if got == nil || got.ID != older.ID {
+		t.Errorf("expected the oldest user %q, got %+v", older.ID, got)
+	}
+
+	duplicates, err := testDB.FindDuplicateEmails()
+	if err != nil {
+		t.Fatalf("FindDuplicateEmails failed: %v", err)
+	}
+	if len(duplicates) != 1 || duplicates[0] != "mixed.case@example.com" {
+		t.Errorf("duplicates mismatch: got %v", duplicates)
+	}
+}
+
+func TestGetUserByEmailUnmigrated(t *testing.T) {
+	pool, err := sqlitex.Open("file:unmigrated?mode=memory&cache=shared", 0, 2)
+	if err != nil {
+		t.Fatalf("failed to open pool: %v", err)
+	}
+	defer pool.Close()
+
+	conn := pool.Get(nil)
+	err = sqlitex.ExecScript(conn, mustReadSchema("users.sql")+mustReadSchema("job_queue.sql"))
+	pool.Put(conn)
+	if err != nil {
+		t.Fatalf("failed to create tables: %v", err)
+	}
+
+	d, err := New(pool)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	user, err := d.CreateUserWithPassword(db.User{Email: "Plain@Example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+
+	lookup := func(t *testing.T) {
+		t.Helper()
+		got, err := d.GetUserByEmail("  plain@example.COM ")
+		if err != nil {
+			t.Fatalf("GetUserByEmail failed: %v", err)
+		}
+		if got == nil || got.ID != user.ID {
+			t.Errorf("expected user %q, got %+v", user.ID, got)
+		}
+	}
+
+	t.Run("before migrate", lookup)
+
+	if err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	t.Run("after migrate", func(t *testing.T) {
+		lookup(t)
+		if d.emailNormalized.Load() != columnPresent {
+			t.Error("expected the lookup to use the email_normalized column")
+		}
+	})
+}
+
+func TestMigrateIdempotent(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	if err := testDB.Migrate(); err != nil {
+		t.Fatalf("second Migrate failed: %v", err)
+	}
+}
+
+func TestUpsertUserWithOauth2(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	t.Run("created flag", func(t *testing.T) {
+		user := db.User{Email: "created@example.com", Name: "Created", Verified: true, Oauth2: true}
+
+		_, created, err := testDB.UpsertUserWithOauth2(user)
+		if err != nil {
+			t.Fatalf("UpsertUserWithOauth2 failed: %v", err)
+		}
+		if !created {
+			t.Error("expected created to be true for a new user")
+		}
+
+		_, created, err = testDB.UpsertUserWithOauth2(user)
+		if err != nil {
+			t.Fatalf("UpsertUserWithOauth2 failed: %v", err)
+		}
+		if created {
+			t.Error("expected created to be false for an existing user")
+		}
+	})
+
+	t.Run("no backfill by default", func(t *testing.T) {
+		passwordUser := db.User{Email: "default@example.com", Password: "hashed_password"}
+		if _, err := testDB.CreateUserWithPassword(passwordUser); err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+
+		oauth2User := db.User{Email: passwordUser.Email, Name: "Provider Name", Avatar: "avatar.jpg", Oauth2: true}
+		user, created, err := testDB.UpsertUserWithOauth2(oauth2User)
+		if err != nil {
+			t.Fatalf("UpsertUserWithOauth2 failed: %v", err)
+		}
+		if created {
+			t.Error("expected created to be false for an existing user")
+		}
+		if user.Name != "" || user.Avatar != "" {
+			t.Errorf("expected profile untouched, got name %q avatar %q", user.Name, user.Avatar)
+		}
+	})
+
+	t.Run("backfill empty avatar", func(t *testing.T) {
+		backfillDB := &Db{pool: testDB.pool}
+		WithOauth2ProfileBackfill()(backfillDB)
+
+		passwordUser := db.User{Email: "backfill@example.com", Name: "Own Name", Password: "hashed_password"}
+		if _, err := backfillDB.CreateUserWithPassword(passwordUser); err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+
+		oauth2User := db.User{Email: passwordUser.Email, Name: "Provider Name", Avatar: "avatar.jpg", Oauth2: true}
+		user, err := backfillDB.CreateUserWithOauth2(oauth2User)
+		if err != nil {
+			t.Fatalf("CreateUserWithOauth2 failed: %v", err)
+		}
+		if user.Avatar != "avatar.jpg" {
+			t.Errorf("Avatar mismatch: got %q, want %q", user.Avatar, "avatar.jpg")
+		}
+		if user.Name != "Own Name" {
+			t.Errorf("non-empty Name should be kept: got %q, want %q", user.Name, "Own Name")
+		}
+		if user.Password != "hashed_password" {
+			t.Error("Password should be preserved from original user")
+		}
+	})
+}
+
+func TestVerifyEmails(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	var ids []string
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		user, err := testDB.CreateUserWithPassword(db.User{Email: email, Password: "hash"})
+		if err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+		ids = append(ids, user.ID)
+	}
+
+	t.Run("empty slice", func(t *testing.T) {
+		n, err := testDB.VerifyEmails(nil)
+		if err != nil {
+			t.Fatalf("VerifyEmails failed: %v", err)
+		}
+		if n != 0 {
+			t.Errorf("verified count mismatch: got %d, want 0", n)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		n, err := testDB.VerifyEmails([]string{ids[0], ids[1], "no-such-id"})
+		if err != nil {
+			t.Fatalf("VerifyEmails failed: %v", err)
+		}
+		if n != 2 {
+			t.Errorf("verified count mismatch: got %d, want 2", n)
+		}
+
+		for i, id := range ids {
+			user, err := testDB.GetUserById(id)
+			if err != nil {
+				t.Fatalf("GetUserById failed: %v", err)
+			}
+			if want := i < 2; user.Verified != want {
+				t.Errorf("user %s Verified mismatch: got %v, want %v", id, user.Verified, want)
+			}
+		}
+	})
+
+	t.Run("more ids than sqlite variables", func(t *testing.T) {
+		// SQLITE_MAX_VARIABLE_NUMBER defaults to 32766.
+		many := make([]string, 0, 33000)
+		for i := 0; len(many) < cap(many)-3; i++ {
+			many = append(many, fmt.Sprintf("no-such-id-%d", i))
+		}
+		many = append(many, ids[2], ids[2], ids[0])
+
+		n, err := testDB.VerifyEmails(many)
+		if err != nil {
+			t.Fatalf("VerifyEmails failed: %v", err)
+		}
+		if n != 2 {
+			t.Errorf("verified count mismatch: got %d, want 2", n)
+		}
+
+		user, err := testDB.GetUserById(ids[2])
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if !user.Verified {
+			t.Errorf("user %s not verified", ids[2])
+		}
+	})
+}
+
+func TestGetUserByEmailAuthMethod(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	if _, err := testDB.CreateUserWithPassword(db.User{Email: "password@example.com", Password: "hash"}); err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	if _, err := testDB.CreateUserWithOauth2(db.User{Email: "oauth2@example.com", Oauth2: true}); err != nil {
+		t.Fatalf("CreateUserWithOauth2 failed: %v", err)
+	}
+	if _, err := testDB.CreateUserWithPassword(db.User{Email: "dual@example.com", Password: "hash"}); err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	if _, err := testDB.CreateUserWithOauth2(db.User{Email: "dual@example.com", Oauth2: true}); err != nil {
+		t.Fatalf("CreateUserWithOauth2 failed: %v", err)
+	}
+
+	tests := []struct {
+		email        string
+		wantPassword bool
+		wantOauth2   bool
+	}{
+		{email: "password@example.com", wantPassword: true, wantOauth2: false},
+		{email: "oauth2@example.com", wantPassword: false, wantOauth2: true},
+		{email: "dual@example.com", wantPassword: true, wantOauth2: true},
+		{email: "none@example.com", wantPassword: false, wantOauth2: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			user, err := testDB.GetUserByEmailPasswordAuth(tt.email)
+			if err != nil {
+				t.Fatalf("GetUserByEmailPasswordAuth failed: %v", err)
+			}
+			if got := user != nil; got != tt.wantPassword {
+				t.Errorf("password auth user found = %v, want %v", got, tt.wantPassword)
+			}
+
+			user, err = testDB.GetUserByEmailOauth2(tt.email)
+			if err != nil {
+				t.Fatalf("GetUserByEmailOauth2 failed: %v", err)
+			}
+			if got := user != nil; got != tt.wantOauth2 {
+				t.Errorf("oauth2 user found = %v, want %v", got, tt.wantOauth2)
+			}
+		})
+	}
+}
+
+func TestAuthMethodStats(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	for _, email := range []string{"pwd1@example.com", "pwd2@example.com", "both@example.com"} {
+		if _, err := testDB.CreateUserWithPassword(db.User{Email: email, Password: "hash"}); err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+	}
+	for _, email := range []string{"oauth2@example.com", "both@example.com"} {
+		if _, err := testDB.CreateUserWithOauth2(db.User{Email: email, Oauth2: true}); err != nil {
+			t.Fatalf("CreateUserWithOauth2 failed: %v", err)
+		}
+	}
+
+	passwordOnly, oauth2Only, both, err := testDB.AuthMethodStats()
+	if err != nil {
+		t.Fatalf("AuthMethodStats failed: %v", err)
+	}
+	if passwordOnly != 2 || oauth2Only != 1 || both != 1 {
+		t.Errorf("stats mismatch: got password-only %d, oauth2-only %d, both %d, want 2, 1, 1",
+			passwordOnly, oauth2Only, both)
+	}
+}
+
+func TestUserVerificationCounts(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	for i := 0; i < 5; i++ {
+		user, err := testDB.CreateUserWithPassword(db.User{Email: fmt.Sprintf("user%d@example.com", i), Password: "hash"})
+		if err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+		if i < 3 {
+			if err := testDB.VerifyEmail(user.ID); err != nil {
+				t.Fatalf("VerifyEmail failed: %v", err)
+			}
+		}
+	}
+
+	verified, unverified, err := testDB.UserVerificationCounts()
+	if err != nil {
+		t.Fatalf("UserVerificationCounts failed: %v", err)
+	}
+	if verified != 3 || unverified != 2 {
+		t.Errorf("counts mismatch: got verified %d, unverified %d, want 3, 2", verified, unverified)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	alice, err := testDB.CreateUserWithPassword(db.User{Email: "alice@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	if _, err := testDB.CreateUserWithPassword(db.User{Email: "bob@example.com", Password: "hash"}); err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	if err := testDB.VerifyEmail(alice.ID); err != nil {
+		t.Fatalf("VerifyEmail failed: %v", err)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		if err := testDB.ChangeEmail(alice.ID, "alice@new.example.com"); err != nil {
+			t.Fatalf("ChangeEmail failed: %v", err)
+		}
+		user, err := testDB.GetUserById(alice.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if user.Email != "alice@new.example.com" {
+			t.Errorf("email mismatch: got %q, want %q", user.Email, "alice@new.example.com")
+		}
+		if user.Verified {
+			t.Error("expected verified to be reset")
+		}
+	})
+
+	t.Run("taken by another user", func(t *testing.T) {
+		if err := testDB.ChangeEmail(alice.ID, " BOB@example.com"); err != db.ErrConstraintUnique {
+			t.Errorf("expected ErrConstraintUnique, got %v", err)
+		}
+		user, err := testDB.GetUserById(alice.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if user.Email != "alice@new.example.com" {
+			t.Errorf("email should be unchanged, got %q", user.Email)
+		}
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		if err := testDB.ChangeEmail("no-such-id", "carol@example.com"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestFindDuplicateEmails(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	// Recreate users without the unique email constraint, as in a drifted
+	// schema, keeping the email_normalized column of migration 1.
+	schema := strings.Replace(mustReadSchema("users.sql"), "NOT NULL UNIQUE", "NOT NULL", 1)
+	conn := testDB.pool.Get(context.TODO())
+	err := sqlitex.ExecScript(conn, "DROP TABLE users;\n"+schema+"\n"+schemaMigrations[0])
+	if err == nil {
+		err = sqlitex.ExecScript(conn, `INSERT INTO users (email) VALUES
+			('dup@example.com'), ('dup@example.com'),
+			('Case@example.com'), ('case@example.com '),
+			('single@example.com');`)
+	}
+	testDB.pool.Put(conn)
+	if err != nil {
+		t.Fatalf("failed to set up users without unique email: %v", err)
+	}
+
+	emails, err := testDB.FindDuplicateEmails()
+	if err != nil {
+		t.Fatalf("FindDuplicateEmails failed: %v", err)
+	}
+	want := []string{"case@example.com", "dup@example.com"}
+	if !reflect.DeepEqual(emails, want) {
+		t.Errorf("duplicates mismatch: got %v, want %v", emails, want)
+	}
+}
+
+func TestClearPassword(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	t.Run("oauth2 user", func(t *testing.T) {
+		if _, err := testDB.CreateUserWithPassword(db.User{Email: "both@example.com", Password: "hash"}); err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+		user, err := testDB.CreateUserWithOauth2(db.User{Email: "both@example.com", Oauth2: true})
+		if err != nil {
+			t.Fatalf("CreateUserWithOauth2 failed: %v", err)
+		}
+
+		if err := testDB.ClearPassword(user.ID); err != nil {
+			t.Fatalf("ClearPassword failed: %v", err)
+		}
+		got, err := testDB.GetUserById(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if got.Password != "" || !got.Oauth2 {
+			t.Errorf("expected oauth2-only user, got password %q oauth2 %v", got.Password, got.Oauth2)
+		}
+	})
+
+	t.Run("password only user", func(t *testing.T) {
+		user, err := testDB.CreateUserWithPassword(db.User{Email: "pwd@example.com", Password: "hash"})
+		if err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+
+		if err := testDB.ClearPassword(user.ID); err != ErrNoAuthMethod {
+			t.Errorf("expected ErrNoAuthMethod, got %v", err)
+		}
+		got, err := testDB.GetUserById(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if got.Password != "hash" {
+			t.Errorf("password should be kept, got %q", got.Password)
+		}
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		if err := testDB.ClearPassword("no-such-id"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestRegisterNewUserWithPassword(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	t.Run("new email", func(t *testing.T) {
+		user, err := testDB.RegisterNewUserWithPassword(db.User{Email: "new@example.com", Name: "New", Password: "hash"})
+		if err != nil {
+			t.Fatalf("RegisterNewUserWithPassword failed: %v", err)
+		}
+		if user.ID == "" || user.Email != "new@example.com" || user.Password != "hash" || user.Oauth2 {
+			t.Errorf("unexpected registered user: %+v", user)
+		}
+	})
+
+	t.Run("existing email", func(t *testing.T) {
+		_, err := testDB.RegisterNewUserWithPassword(db.User{Email: "new@example.com", Password: "other"})
+		if err != db.ErrConstraintUnique {
+			t.Errorf("expected ErrConstraintUnique, got %v", err)
+		}
+
+		user, err := testDB.GetUserByEmail("new@example.com")
+		if err != nil {
+			t.Fatalf("GetUserByEmail failed: %v", err)
+		}
+		if user.Password != "hash" {
+			t.Errorf("existing user should be unchanged, got password %q", user.Password)
+		}
+	})
+}
+
+func TestSingleUserRow(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	conn := testDB.pool.Get(context.TODO())
+	defer testDB.pool.Put(conn)
+
+	// A contrived users table without the unique email constraint, read with
+	// a query returning two rows where one is expected.
+	schema := strings.Replace(mustReadSchema("users.sql"), "CREATE TABLE `users`", "CREATE TEMP TABLE `contrived_users`", 1)
+	schema = strings.Replace(schema, "NOT NULL UNIQUE", "NOT NULL", 1)
+	err := sqlitex.ExecScript(conn, schema+`
+		INSERT INTO contrived_users (email) VALUES ('dup@example.com'), ('dup@example.com');`)
+	if err != nil {
+		t.Fatalf("failed to create contrived schema: %v", err)
+	}
+	defer sqlitex.ExecScript(conn, "DROP TABLE contrived_users;")
+
+	query := `SELECT id, name, password, verified, oauth2, avatar, email, emailVisibility, created, updated
+		FROM contrived_users WHERE email = ?`
+
+	t.Run("multiple rows", func(t *testing.T) {
+		var user *db.User
+		err := sqlitex.Exec(conn, query, singleUserRow(&user), "dup@example.com")
+		if err == nil || !strings.Contains(err.Error(), "expected a single user row") {
+			t.Errorf("expected a single row error, got %v", err)
+		}
+	})
+
+	t.Run("single row", func(t *testing.T) {
+		var user *db.User
+		err := sqlitex.Exec(conn, query+" LIMIT 1", singleUserRow(&user), "dup@example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if user == nil || user.Email != "dup@example.com" {
+			t.Errorf("unexpected user: %+v", user)
+		}
+	})
+}
+
+func TestRewriteAvatarPrefix(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	avatars := map[string]string{
+		"a@example.com": "https://old.cdn.example.com/a.png",
+		"b@example.com": "https://old.cdn.example.com/b.png",
+		"c@example.com": "https://other.example.com/https://old.cdn.example.com/c.png",
+		"d@example.com": "https://old_cdn.example.com/d.png",
+		"e@example.com": "",
+	}
+	ids := make(map[string]string)
+	for email, avatar := range avatars {
+		user, err := testDB.CreateUserWithOauth2(db.User{Email: email, Avatar: avatar, Oauth2: true})
+		if err != nil {
+			t.Fatalf("CreateUserWithOauth2 failed: %v", err)
+		}
+		ids[email] = user.ID
+	}
+
+	n, err := testDB.RewriteAvatarPrefix("https://old.cdn.example.com/", "https://new.cdn.example.com/")
+	if err != nil {
+		t.Fatalf("RewriteAvatarPrefix failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("changed count mismatch: got %d, want 2", n)
+	}
+
+	want := map[string]string{
+		"a@example.com": "https://new.cdn.example.com/a.png",
+		"b@example.com": "https://new.cdn.example.com/b.png",
+		"c@example.com": avatars["c@example.com"],
+		"d@example.com": avatars["d@example.com"],
+		"e@example.com": "",
+	}
+	for email, id := range ids {
+		user, err := testDB.GetUserById(id)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if user.Avatar != want[email] {
+			t.Errorf("%s avatar mismatch: got %q, want %q", email, user.Avatar, want[email])
+		}
+	}
+
+	if _, err := testDB.RewriteAvatarPrefix("", "https://new.cdn.example.com/"); err == nil {
+		t.Error("expected an error for an empty old prefix")
+	}
+}
+
+func TestOauth2ConflictPolicy(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	if _, err := testDB.CreateUserWithPassword(db.User{Email: "existing@example.com", Password: "hash"}); err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	oauth2User := db.User{Email: "existing@example.com", Oauth2: true}
+
+	t.Run("fail if exists", func(t *testing.T) {
+		WithOauth2ConflictPolicy(Oauth2FailIfExists)(testDB)
+		if _, err := testDB.CreateUserWithOauth2(oauth2User); err != db.ErrConstraintUnique {
+			t.Errorf("expected ErrConstraintUnique, got %v", err)
+		}
+		user, err := testDB.GetUserByEmail("existing@example.com")
+		if err != nil {
+			t.Fatalf("GetUserByEmail failed: %v", err)
+		}
+		if user.Oauth2 {
+			t.Error("oauth2 should not be linked onto the existing user")
+		}
+
+		if _, err := testDB.CreateUserWithOauth2(db.User{Email: "fresh@example.com", Oauth2: true}); err != nil {
+			t.Errorf("a new email should still be created: %v", err)
+		}
+	})
+
+	t.Run("link if exists", func(t *testing.T) {
+		WithOauth2ConflictPolicy(Oauth2LinkIfExists)(testDB)
+		user, err := testDB.CreateUserWithOauth2(oauth2User)
+		if err != nil {
+			t.Fatalf("CreateUserWithOauth2 failed: %v", err)
+		}
+		if !user.Oauth2 || user.Password != "hash" {
+			t.Errorf("expected oauth2 linked onto the password user, got %+v", user)
+		}
+	})
+
+	t.Run("existing oauth2 user under fail if exists", func(t *testing.T) {
+		WithOauth2ConflictPolicy(Oauth2FailIfExists)(testDB)
+		if _, err := testDB.CreateUserWithOauth2(oauth2User); err != nil {
+			t.Errorf("an oauth2 user logging in again should not be rejected: %v", err)
+		}
+	})
+}
+
+func TestListUsersCreatedBetween(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var now time.Time
+	WithClock(func() time.Time { return now })(testDB)
+	for day, email := range []string{"d0@example.com", "d1@example.com", "d2@example.com", "d3@example.com"} {
+		now = base.AddDate(0, 0, day)
+		if _, err := testDB.CreateUserWithPassword(db.User{Email: email, Password: "hash"}); err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+	}
+
+	emails := func(users []*db.User) []string {
+		out := []string{}
+		for _, u := range users {
+			out = append(out, u.Email)
+		}
+		return out
+	}
+
+	t.Run("range", func(t *testing.T) {
+		users, err := testDB.ListUsersCreatedBetween(base.AddDate(0, 0, 1), base.AddDate(0, 0, 3), 10, 0)
+		if err != nil {
+			t.Fatalf("ListUsersCreatedBetween failed: %v", err)
+		}
+		want := []string{"d1@example.com", "d2@example.com"}
+		if got := emails(users); !reflect.DeepEqual(got, want) {
+			t.Errorf("users mismatch: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		users, err := testDB.ListUsersCreatedBetween(base, base.AddDate(0, 0, 4), 2, 1)
+		if err != nil {
+			t.Fatalf("ListUsersCreatedBetween failed: %v", err)
+		}
+		want := []string{"d1@example.com", "d2@example.com"}
+		if got := emails(users); !reflect.DeepEqual(got, want) {
+			t.Errorf("users mismatch: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("empty range", func(t *testing.T) {
+		users, err := testDB.ListUsersCreatedBetween(base.AddDate(1, 0, 0), base.AddDate(2, 0, 0), 10, 0)
+		if err != nil {
+			t.Fatalf("ListUsersCreatedBetween failed: %v", err)
+		}
+		if users == nil || len(users) != 0 {
+			t.Errorf("expected an empty non-nil slice, got %v", users)
+		}
+	})
+}
+
+func TestRecordLogin(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	user, err := testDB.CreateUserWithPassword(db.User{Email: "login@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+
+	t.Run("never logged in", func(t *testing.T) {
+		at, err := testDB.LastLoginAt(user.ID)
+		if err != nil {
+			t.Fatalf("LastLoginAt failed: %v", err)
+		}
+		if !at.IsZero() {
+			t.Errorf("expected zero time, got %v", at)
+		}
+	})
+
+	t.Run("recorded login", func(t *testing.T) {
+		loginAt := time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)
+		if err := testDB.RecordLogin(user.ID, loginAt); err != nil {
+			t.Fatalf("RecordLogin failed: %v", err)
+		}
+		at, err := testDB.LastLoginAt(user.ID)
+		if err != nil {
+			t.Fatalf("LastLoginAt failed: %v", err)
+		}
+		if !at.Equal(loginAt) {
+			t.Errorf("last login mismatch: got %v, want %v", at, loginAt)
+		}
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		if err := testDB.RecordLogin("missing", time.Now()); err != ErrNotFound {
+			t.Errorf("RecordLogin error mismatch: got %v, want ErrNotFound", err)
+		}
+		if _, err := testDB.LastLoginAt("missing"); err != ErrNotFound {
+			t.Errorf("LastLoginAt error mismatch: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestListInactiveUsers(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	since := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	logins := []struct {
+		email   string
+		loginAt time.Time
+	}{
+		{"never@example.com", time.Time{}},
+		{"stale@example.com", since.AddDate(0, -3, 0)},
+		{"recent@example.com", since.AddDate(0, 0, 7)},
+		{"boundary@example.com", since},
+	}
+	for _, l := range logins {
+		user, err := testDB.CreateUserWithPassword(db.User{Email: l.email, Password: "hash"})
+		if err != nil {
+			t.Fatalf("CreateUserWithPassword failed: %v", err)
+		}
+		if l.loginAt.IsZero() {
+			continue
+		}
+		if err := testDB.RecordLogin(user.ID, l.loginAt); err != nil {
+			t.Fatalf("RecordLogin failed: %v", err)
+		}
+	}
+
+	users, err := testDB.ListInactiveUsers(since, 10, 0)
+	if err != nil {
+		t.Fatalf("ListInactiveUsers failed: %v", err)
+	}
+	got := []string{}
+	for _, u := range users {
+		got = append(got, u.Email)
+	}
+	want := []string{"never@example.com", "stale@example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("inactive users mismatch: got %v, want %v", got, want)
+	}
+
+	users, err = testDB.ListInactiveUsers(since.AddDate(-1, 0, 0), 10, 0)
+	if err != nil {
+		t.Fatalf("ListInactiveUsers failed: %v", err)
+	}
+	if len(users) != 1 || users[0].Email != "never@example.com" {
+		t.Errorf("expected only the never logged in user, got %v", users)
+	}
+}
+
+func TestUserCache(t *testing.T) {
+	testDB := setupDB(t)
+	defer testDB.pool.Close()
+
+	clock := time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)
+	WithClock(func() time.Time { return clock })(testDB)
+	testDB.EnableUserCache(time.Minute)
+
+	user, err := testDB.CreateUserWithPassword(db.User{Email: "cached@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUserWithPassword failed: %v", err)
+	}
+	if _, err := testDB.GetUserById(user.ID); err != nil {
+		t.Fatalf("GetUserById failed: %v", err)
+	}
+
+	// Change the row behind the Db's back: only a database read sees it.
+	setName := func(name string) {
+		conn := testDB.pool.Get(nil)
+		defer testDB.pool.Put(conn)
+		if err := sqlitex.Exec(conn, "UPDATE users SET name = ? WHERE id = ?", nil, name, user.ID); err != nil {
+			t.Fatalf("update name failed: %v", err)
+		}
+	}
+	getName := func() string {
+		got, err := testDB.GetUserById(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		return got.Name
+	}
+
+	t.Run("hit avoids db", func(t *testing.T) {
+		setName("direct")
+		if got := getName(); got != "" {
+			t.Errorf("expected cached empty name, got %q", got)
+		}
+	})
+
+	t.Run("expired entry is reloaded", func(t *testing.T) {
+		clock = clock.Add(time.Minute)
+		if got := getName(); got != "direct" {
+			t.Errorf("expected reloaded name %q, got %q", "direct", got)
+		}
+	})
+
+	t.Run("mutation invalidates", func(t *testing.T) {
+		if err := testDB.UpdateEmail(user.ID, "changed@example.com"); err != nil {
+			t.Fatalf("UpdateEmail failed: %v", err)
+		}
+		got, err := testDB.GetUserById(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if got.Email != "changed@example.com" {
+			t.Errorf("expected updated email, got %q", got.Email)
+		}
+	})
+
+	t.Run("returned copy is not shared", func(t *testing.T) {
+		got, err := testDB.GetUserById(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		got.Email = "mutated@example.com"
+		again, err := testDB.GetUserById(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserById failed: %v", err)
+		}
+		if again.Email != "changed@example.com" {
+			t.Errorf("cached user was modified through a returned copy: %q", again.Email)
+		}
+	})
+}
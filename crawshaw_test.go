@@ -0,0 +1,279 @@
+package sqlitecrawshaw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/caasmo/restinpieces-sqlite-crawshaw/crawshaw"
+	"github.com/caasmo/restinpieces/core"
+	"github.com/caasmo/restinpieces/db"
+	"github.com/caasmo/restinpieces/migrations"
+)
+
+// createTestDbFile writes a database file with enough rows to span many pages.
+func createTestDbFile(t *testing.T) string {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	pool, err := NewCrawshawPool(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	conn := pool.Get(context.TODO())
+	if err := sqlitex.ExecScript(conn, "CREATE TABLE foo (id INTEGER PRIMARY KEY, value TEXT NOT NULL);"); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	value := strings.Repeat("x", 512)
+	for i := 0; i < 1000; i++ {
+		if err := sqlitex.Exec(conn, "INSERT INTO foo (value) VALUES (?)", nil, value); err != nil {
+			t.Fatalf("failed to insert row: %v", err)
+		}
+	}
+	pool.Put(conn)
+
+	// Closing the last connection checkpoints the WAL into the main file.
+	if err := pool.Close(); err != nil {
+		t.Fatalf("failed to close pool: %v", err)
+	}
+	return dbPath
+}
+
+func TestNewCrawshawPoolVerified(t *testing.T) {
+	t.Run("healthy file", func(t *testing.T) {
+		dbPath := createTestDbFile(t)
+
+		pool, err := NewCrawshawPoolVerified(dbPath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		pool.Close()
+	})
+
+	t.Run("truncated file", func(t *testing.T) {
+		dbPath := createTestDbFile(t)
+
+		info, err := os.Stat(dbPath)
+		if err != nil {
+			t.Fatalf("failed to stat db file: %v", err)
+		}
+		if err := os.Truncate(dbPath, info.Size()/2); err != nil {
+			t.Fatalf("failed to truncate db file: %v", err)
+		}
+
+		pool, err := NewCrawshawPoolVerified(dbPath)
+		if err == nil {
+			pool.Close()
+			t.Fatal("expected corruption error but got none")
+		}
+		if !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("expected corruption error, got %v", err)
+		}
+	})
+}
+
+func TestNewCrawshawPoolWalAutocheckpoint(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	pool, err := NewCrawshawPool(dbPath, WithWalAutocheckpoint(250))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	conn := pool.Get(context.TODO())
+	defer pool.Put(conn)
+
+	var pages int64
+	err = sqlitex.Exec(conn, "PRAGMA wal_autocheckpoint;", func(stmt *sqlite.Stmt) error {
+		pages = stmt.ColumnInt64(0)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read wal_autocheckpoint: %v", err)
+	}
+	if pages != 250 {
+		t.Errorf("wal_autocheckpoint mismatch: got %d, want %d", pages, 250)
+	}
+}
+
+func TestNewCrawshawPoolSynchronousNormal(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	pool, err := NewCrawshawPool(dbPath, WithSynchronousNormal())
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	// Hold every connection at once so each pooled connection is checked.
+	conns := make([]*sqlite.Conn, 0, runtime.NumCPU())
+	defer func() {
+		for _, conn := range conns {
+			pool.Put(conn)
+		}
+	}()
+	for i := 0; i < runtime.NumCPU(); i++ {
+		conn := pool.Get(context.TODO())
+		conns = append(conns, conn)
+
+		var level int64
+		err := sqlitex.Exec(conn, "PRAGMA synchronous;", func(stmt *sqlite.Stmt) error {
+			level = stmt.ColumnInt64(0)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to read synchronous: %v", err)
+		}
+		if level != 1 {
+			t.Errorf("synchronous mismatch on connection %d: got %d, want 1 (NORMAL)", i+1, level)
+		}
+	}
+}
+
+// createAppDbFile writes a migrated database file with the restinpieces tables,
+// which are created by the application setup and not by this library.
+func createAppDbFile(t *testing.T) string {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "app.db")
+	pool, err := NewCrawshawPool(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	conn := pool.Get(context.TODO())
+	for _, name := range []string{"users.sql", "job_queue.sql", "app_config.sql"} {
+		schema, err := fs.ReadFile(migrations.Schema(), name)
+		if err != nil {
+			t.Fatalf("failed to read schema %s: %v", name, err)
+		}
+		if err := sqlitex.ExecScript(conn, string(schema)); err != nil {
+			t.Fatalf("failed to create schema %s: %v", name, err)
+		}
+	}
+	pool.Put(conn)
+
+	dbInstance, err := crawshaw.New(pool)
+	if err != nil {
+		t.Fatalf("failed to create db: %v", err)
+	}
+	if err := dbInstance.Migrate(); err != nil {
+		t.Fatalf("failed to migrate db: %v", err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatalf("failed to close pool: %v", err)
+	}
+	return dbPath
+}
+
+func TestWithDbCrawshawPath(t *testing.T) {
+	dbPath := createAppDbFile(t)
+
+	app := &core.App{}
+	WithDbCrawshawPath(dbPath)(app)
+
+	job := db.Job{JobType: "test_job", Payload: json.RawMessage(`{"key":"value"}`), MaxAttempts: 3}
+	if err := app.DbQueue().InsertJob(job); err != nil {
+		t.Fatalf("InsertJob failed: %v", err)
+	}
+	jobs, err := app.DbQueue().Claim(10)
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("claimed jobs mismatch: got %d, want 1", len(jobs))
+	}
+
+	// The option registered for the shutdown signals, so this one is
+	// delivered to it instead of terminating the test process.
+	if err := syscall.Kill(os.Getpid(), syscall.SIGQUIT); err != nil {
+		t.Fatalf("failed to send SIGQUIT: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := app.DbQueue().Claim(10)
+		if errors.Is(err, crawshaw.ErrClosed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected ErrClosed after the shutdown signal, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadOnlyDb(t *testing.T) {
+	dbPath := createAppDbFile(t)
+
+	pool, err := NewCrawshawPoolReadOnly(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create read-only pool: %v", err)
+	}
+	defer pool.Close()
+
+	roDb, err := crawshaw.NewReadOnly(pool)
+	if err != nil {
+		t.Fatalf("NewReadOnly failed: %v", err)
+	}
+
+	if _, ok := any(roDb).(db.DbQueue); ok {
+		t.Error("ReadOnlyDb must not implement the write methods of db.DbQueue")
+	}
+	user, err := roDb.GetUserByEmail("test@example.com")
+	if err != nil {
+		t.Errorf("GetUserByEmail failed: %v", err)
+	}
+	if user != nil {
+		t.Errorf("expected no user, got %+v", user)
+	}
+
+	conn := pool.Get(context.TODO())
+	defer pool.Put(conn)
+	err = sqlitex.Exec(conn, "INSERT INTO users (email) VALUES ('test@example.com')", nil)
+	if sqlite.ErrCode(err) != sqlite.SQLITE_READONLY {
+		t.Errorf("expected SQLITE_READONLY for a write, got %v", err)
+	}
+}
+
+func TestWarmPool(t *testing.T) {
+	dbPath := createAppDbFile(t)
+	poolSize := runtime.NumCPU()
+
+	pool, err := NewCrawshawPool(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	if err := WarmPool(pool, poolSize); err != nil {
+		t.Fatalf("WarmPool failed: %v", err)
+	}
+
+	// All connections were released: every one of them is available at once.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	conns := make([]*sqlite.Conn, 0, poolSize)
+	for i := 0; i < poolSize; i++ {
+		conn := pool.Get(ctx)
+		if conn == nil {
+			t.Fatalf("connection %d not immediately available after warmup", i+1)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		pool.Put(conn)
+	}
+
+	if err := WarmPool(pool, poolSize+1); err == nil {
+		t.Error("expected error when warming more connections than the pool size")
+	}
+}